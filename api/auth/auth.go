@@ -0,0 +1,247 @@
+// Package auth authenticates API clients by API key or HTTP Basic credentials and authorizes them by role
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"kiezbox/internal/audit"
+	cfg "kiezbox/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role grants access to a group of routes, every role includes the rights of the lower ones
+type Role int
+
+const (
+	RoleViewer Role = iota + 1
+	RoleOperator
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleViewer:   "viewer",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole returns the role with the given name
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q", name)
+}
+
+// Identity is the authenticated client of a request
+type Identity struct {
+	Name   string `json:"name"`
+	Role   Role   `json:"-"`
+	Method string `json:"method"`
+}
+
+// Anonymous is the identity of all requests when authentication is disabled
+var Anonymous = Identity{Name: "anonymous", Role: RoleAdmin, Method: "none"}
+
+// Key under which the identity is stored in the gin context
+const identityKey = "auth.identity"
+
+// Credential of a single API key or Basic auth user
+type credential struct {
+	name string
+	role Role
+	// SHA-256 of the key or password, so all secrets are compared in constant time and with the same length
+	hash []byte
+}
+
+// Authenticator checks the credentials of requests, a nil Authenticator lets every request pass as Anonymous
+type Authenticator struct {
+	keys  []credential
+	users map[string]credential
+}
+
+// Default authenticator used by the routes, nil disables authentication
+var Default *Authenticator
+
+var ErrNoCredentials = errors.New("authentication enabled without credentials")
+
+// New creates an Authenticator from API keys formatted as <name>:<role>:<key>
+// and Basic auth users formatted as <name>:<role>:<password>, where the password
+// may also be given as sha256:<hex digest>
+func New(keys []string, users []string) (*Authenticator, error) {
+	a := &Authenticator{users: make(map[string]credential)}
+	for _, entry := range keys {
+		if entry == "" {
+			continue
+		}
+		c, err := parseCredential(entry, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API key: %w", err)
+		}
+		a.keys = append(a.keys, c)
+	}
+	for _, entry := range users {
+		if entry == "" {
+			continue
+		}
+		c, err := parseCredential(entry, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user: %w", err)
+		}
+		if _, ok := a.users[c.name]; ok {
+			return nil, fmt.Errorf("invalid user: %q is defined twice", c.name)
+		}
+		a.users[c.name] = c
+	}
+	if len(a.keys) == 0 && len(a.users) == 0 {
+		return nil, ErrNoCredentials
+	}
+	return a, nil
+}
+
+// FromConfig creates the Authenticator for the gateway configuration, nil if authentication is disabled
+func FromConfig() (*Authenticator, error) {
+	if !cfg.Cfg.ApiAuth {
+		return nil, nil
+	}
+	return New(cfg.Cfg.ApiKeys, cfg.Cfg.ApiUsers)
+}
+
+func parseCredential(entry string, hashed bool) (credential, error) {
+	parts := strings.SplitN(entry, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return credential{}, fmt.Errorf("expected <name>:<role>:<secret>")
+	}
+	role, err := ParseRole(parts[1])
+	if err != nil {
+		return credential{}, fmt.Errorf("%s: %w", parts[0], err)
+	}
+	c := credential{name: parts[0], role: role}
+	if digest, ok := strings.CutPrefix(parts[2], "sha256:"); hashed && ok {
+		c.hash, err = hex.DecodeString(digest)
+		if err != nil || len(c.hash) != sha256.Size {
+			return credential{}, fmt.Errorf("%s: invalid sha256 digest", parts[0])
+		}
+		return c, nil
+	}
+	sum := sha256.Sum256([]byte(parts[2]))
+	c.hash = sum[:]
+	return c, nil
+}
+
+// Authenticate returns the identity for the credentials of a request.
+// API keys are taken from the X-API-Key header or an Authorization Bearer token.
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, bool) {
+	if a == nil {
+		return Anonymous, true
+	}
+	key := r.Header.Get("X-API-Key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = bearer
+	}
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		var match *credential
+		// Compare with all keys, so the time does not depend on which key matched
+		for i := range a.keys {
+			if subtle.ConstantTimeCompare(sum[:], a.keys[i].hash) == 1 {
+				match = &a.keys[i]
+			}
+		}
+		if match == nil {
+			return Identity{}, false
+		}
+		return Identity{Name: match.name, Role: match.role, Method: "api_key"}, true
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		user, known := a.users[name]
+		sum := sha256.Sum256([]byte(password))
+		if !known {
+			// Compare anyway, so unknown users take as long as wrong passwords
+			user = credential{hash: make([]byte, sha256.Size)}
+		}
+		if subtle.ConstantTimeCompare(sum[:], user.hash) != 1 || !known {
+			return Identity{}, false
+		}
+		return Identity{Name: user.name, Role: user.role, Method: "basic"}, true
+	}
+	return Identity{}, false
+}
+
+// Require returns a middleware which only lets requests pass whose identity has at least the given role.
+// Denied requests to operator and admin routes are audited.
+func (a *Authenticator) Require(role Role) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		identity, ok := a.Authenticate(ctx.Request)
+		if !ok {
+			deny(ctx, role, Identity{Name: "unknown"}, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if identity.Role < role {
+			deny(ctx, role, identity, http.StatusForbidden, "role "+role.String()+" required")
+			return
+		}
+		ctx.Set(identityKey, identity)
+		ctx.Next()
+	}
+}
+
+func deny(ctx *gin.Context, role Role, identity Identity, status int, reason string) {
+	if role >= RoleOperator {
+		audit.Log(audit.Entry{
+			Who:    identity.Name,
+			Role:   roleName(identity.Role),
+			Source: ctx.ClientIP(),
+			Action: ctx.Request.Method + " " + ctx.FullPath(),
+			Result: "denied",
+			Error:  reason,
+		})
+	}
+	if status == http.StatusUnauthorized {
+		ctx.Header("WWW-Authenticate", `Basic realm="kiezbox"`)
+	}
+	ctx.AbortWithStatusJSON(status, gin.H{"error": reason})
+}
+
+// Current returns the identity of the client of a request, Anonymous if the route is not protected
+func Current(ctx *gin.Context) Identity {
+	if value, ok := ctx.Get(identityKey); ok {
+		if identity, ok := value.(Identity); ok {
+			return identity
+		}
+	}
+	return Anonymous
+}
+
+// AuditEntry prefills an audit entry with the client of a request
+func AuditEntry(ctx *gin.Context, action string) audit.Entry {
+	identity := Current(ctx)
+	return audit.Entry{
+		Who:    identity.Name,
+		Role:   roleName(identity.Role),
+		Source: ctx.ClientIP(),
+		Action: action,
+	}
+}
+
+func roleName(role Role) string {
+	if role == 0 {
+		return ""
+	}
+	return role.String()
+}
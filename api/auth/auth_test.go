@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kiezbox/internal/audit"
+)
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func testRouter(a *Authenticator) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	handler := func(ctx *gin.Context) {
+		identity := Current(ctx)
+		ctx.String(http.StatusOK, identity.Name+" "+identity.Method)
+	}
+	r.GET("/view", a.Require(RoleViewer), handler)
+	r.POST("/admin", a.Require(RoleAdmin), handler)
+	return r
+}
+
+func TestNew(t *testing.T) {
+	digest := sha256.Sum256([]byte("secret"))
+	_, err := New([]string{"ci:admin:key"}, []string{"ops:operator:sha256:" + hex.EncodeToString(digest[:])})
+	assert.NoError(t, err)
+
+	_, err = New(nil, []string{""})
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	_, err = New([]string{"ci:root:key"}, nil)
+	assert.ErrorContains(t, err, "unknown role")
+	_, err = New([]string{"ci:admin"}, nil)
+	assert.Error(t, err)
+	_, err = New(nil, []string{"ops:operator:sha256:abc"})
+	assert.ErrorContains(t, err, "invalid sha256 digest")
+	_, err = New(nil, []string{"ops:operator:a", "ops:viewer:b"})
+	assert.ErrorContains(t, err, "defined twice")
+}
+
+func TestRequire(t *testing.T) {
+	digest := sha256.Sum256([]byte("hashed secret"))
+	a, err := New(
+		[]string{"grafana:viewer:view-key", "provisioning:admin:admin-key"},
+		[]string{"alice:operator:plain secret", "bob:admin:sha256:" + hex.EncodeToString(digest[:])},
+	)
+	require.NoError(t, err)
+	var auditLog bytes.Buffer
+	audit.Default = audit.NewLogger(nopCloser{&auditLog})
+	defer func() { audit.Default = &audit.Logger{} }()
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		prepare  func(r *http.Request)
+		expected int
+		body     string
+	}{
+		{"no credentials", http.MethodGet, "/view", func(r *http.Request) {}, http.StatusUnauthorized, ""},
+		{"api key header", http.MethodGet, "/view", func(r *http.Request) { r.Header.Set("X-API-Key", "view-key") }, http.StatusOK, "grafana api_key"},
+		{"bearer token", http.MethodPost, "/admin", func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-key") }, http.StatusOK, "provisioning api_key"},
+		{"wrong api key", http.MethodGet, "/view", func(r *http.Request) { r.Header.Set("X-API-Key", "guess") }, http.StatusUnauthorized, ""},
+		{"basic auth", http.MethodGet, "/view", func(r *http.Request) { r.SetBasicAuth("alice", "plain secret") }, http.StatusOK, "alice basic"},
+		{"basic auth with digest", http.MethodPost, "/admin", func(r *http.Request) { r.SetBasicAuth("bob", "hashed secret") }, http.StatusOK, "bob basic"},
+		{"wrong password", http.MethodGet, "/view", func(r *http.Request) { r.SetBasicAuth("alice", "guess") }, http.StatusUnauthorized, ""},
+		{"unknown user", http.MethodGet, "/view", func(r *http.Request) { r.SetBasicAuth("mallory", "plain secret") }, http.StatusUnauthorized, ""},
+		{"insufficient role", http.MethodPost, "/admin", func(r *http.Request) { r.SetBasicAuth("alice", "plain secret") }, http.StatusForbidden, ""},
+	}
+	router := testRouter(a)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(tc.method, tc.path, nil)
+			tc.prepare(request)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			assert.Equal(t, tc.expected, recorder.Code)
+			if tc.body != "" {
+				assert.Equal(t, tc.body, recorder.Body.String())
+			}
+			if tc.expected == http.StatusUnauthorized {
+				assert.Equal(t, `Basic realm="kiezbox"`, recorder.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// Only the denied request to the admin route is audited
+	var entry audit.Entry
+	require.NoError(t, json.Unmarshal(auditLog.Bytes(), &entry))
+	assert.Equal(t, "alice", entry.Who)
+	assert.Equal(t, "operator", entry.Role)
+	assert.Equal(t, "POST /admin", entry.Action)
+	assert.Equal(t, "denied", entry.Result)
+}
+
+func TestRequireDisabled(t *testing.T) {
+	var a *Authenticator
+	recorder := httptest.NewRecorder()
+	testRouter(a).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "anonymous none", recorder.Body.String())
+}
@@ -1,22 +1,99 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
-	"sync"
+	"time"
 
+	"kiezbox/api/auth"
+	"kiezbox/internal/audit"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
 	"kiezbox/internal/meshtastic"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Maximum number of settings accepted in one /admin/control request
+const maxControlSettings = 64
+
+// Maximum time to send all settings of one /admin/control request
+const controlBatchTimeout = time.Minute
+
+// Reported for a key, value or filter which can not be put into a control message
+const errInvalidSetting = "Invalid key, value or filter."
+
+// ControlValue is a control value or filter given as JSON string, number or boolean
+type ControlValue string
+
+// UnmarshalJSON accepts strings as they are and keeps numbers and booleans in their JSON notation
+func (v *ControlValue) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*v = ""
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = ControlValue(s)
+	case len(data) > 0 && (data[0] == '{' || data[0] == '['):
+		return fmt.Errorf("expected a string, number or boolean, got %s", data)
+	default:
+		*v = ControlValue(data)
+	}
+	return nil
+}
+
+// ControlTarget addresses the boxes which should apply the settings, empty fields match every box
+type ControlTarget struct {
+	BoxId   ControlValue `json:"box_id"`
+	DistId  ControlValue `json:"dist_id"`
+	SensId  ControlValue `json:"sens_id"`
+	DevType ControlValue `json:"dev_type"`
+}
+
+// ControlSetting is a single key and value to set
+type ControlSetting struct {
+	Key   string       `json:"key"`
+	Value ControlValue `json:"value"`
+}
+
+// ControlRequest is the JSON body of /admin/control
+type ControlRequest struct {
+	Target   ControlTarget    `json:"target"`
+	Settings []ControlSetting `json:"settings"`
+}
+
+// ControlSettingResult reports the outcome of a single setting of a ControlRequest
+type ControlSettingResult struct {
+	Key    string               `json:"key"`
+	Value  string               `json:"value"`
+	Status string               `json:"status"`
+	Error  string               `json:"error,omitempty"`
+	Result *meshtastic.TxResult `json:"result,omitempty"`
+}
+
 // SetKiezboxControlValue sets a Kiezbox control value based on the provided key and value
-func SetKiezboxControlValue(device meshtastic.MeshtasticDevice, ctx context.Context, wg *sync.WaitGroup) gin.HandlerFunc {
+// and reports whether the box acknowledged the control message.
+// A broadcast is only relayed by the mesh, so it is answered with 202 instead of claiming the value was set.
+// A JSON body sets several values for a structured target, see ControlRequest.
+func SetKiezboxControlValue(device meshtastic.MeshtasticDevice) gin.HandlerFunc {
 	return func(ginCtx *gin.Context) {
+		if ginCtx.ContentType() == gin.MIMEJSON {
+			setKiezboxControlValues(ginCtx, device)
+			return
+		}
+
 		// Extract key and value parameters from the query string
 		key := ginCtx.PostForm("key")
 		value := ginCtx.PostForm("value")
-		filter := []string{ginCtx.PostForm("box_id"),ginCtx.PostForm("dist_id"),ginCtx.PostForm("sens_id"),ginCtx.PostForm("dev_type")}
+		filter := []string{ginCtx.PostForm("box_id"), ginCtx.PostForm("dist_id"), ginCtx.PostForm("sens_id"), ginCtx.PostForm("dev_type")}
 		if key == "" || value == "" {
 			ginCtx.JSON(400, gin.H{"error": "Missing key or value query parameter."})
 			return
@@ -25,13 +102,137 @@ func SetKiezboxControlValue(device meshtastic.MeshtasticDevice, ctx context.Cont
 		// Build the control message for the provided key and value
 		control := meshtastic.BuildKiezboxControlMessage(key, value, filter)
 		if control == nil {
-			ginCtx.JSON(400, gin.H{"error": "Invalid key or value."})
+			auditControl(ginCtx, filter, key, value, "invalid", errInvalidSetting)
+			ginCtx.JSON(400, gin.H{"error": errInvalidSetting})
 			return
 		}
 
-		// Set the control value
-		go device.SetKiezboxControlValue(ctx, wg, control)
-		// Reply to the client with success
-		ginCtx.JSON(http.StatusOK, gin.H{"status": "control value set", "key": key, "value": value})
+		// Set the control value and wait for the result, as long as the client waits
+		result, err := device.SendKiezboxControl(ginCtx.Request.Context(), control)
+		if err != nil {
+			auditControl(ginCtx, filter, key, value, "error", err.Error())
+			ginCtx.JSON(controlErrorStatus(err), gin.H{"error": err.Error(), "key": key, "value": value})
+			return
+		}
+		auditControl(ginCtx, filter, key, value, result.Status.String(), "")
+		switch result.Status {
+		case meshtastic.TxTimeout:
+			ginCtx.JSON(http.StatusGatewayTimeout, gin.H{"error": "control value not acknowledged", "key": key, "value": value, "result": result})
+		case meshtastic.TxNak:
+			ginCtx.JSON(http.StatusBadGateway, gin.H{"error": "control value rejected: " + result.Error.String(), "key": key, "value": value, "result": result})
+		case meshtastic.TxRelayed:
+			ginCtx.JSON(http.StatusAccepted, gin.H{"status": "control value relayed", "key": key, "value": value, "result": result})
+		default:
+			// Reply to the client with success
+			ginCtx.JSON(http.StatusOK, gin.H{"status": "control value set", "key": key, "value": value, "result": result})
+		}
+	}
+}
+
+// setKiezboxControlValues validates all settings of a ControlRequest before sending any of them,
+// then sends one control packet per setting in the given order and reports the result of each.
+// Sending stops at the first setting which is not acknowledged, the remaining ones are skipped.
+// The response status is the one of the failed setting, as for a single value, or 202 if any setting was only relayed.
+func setKiezboxControlValues(ginCtx *gin.Context, device meshtastic.MeshtasticDevice) {
+	var request ControlRequest
+	if err := ginCtx.ShouldBindJSON(&request); err != nil {
+		ginCtx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if len(request.Settings) == 0 {
+		ginCtx.JSON(http.StatusBadRequest, gin.H{"error": "No settings given."})
+		return
+	}
+	if len(request.Settings) > maxControlSettings {
+		ginCtx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d settings are accepted per request.", maxControlSettings)})
+		return
+	}
+
+	filter := []string{string(request.Target.BoxId), string(request.Target.DistId), string(request.Target.SensId), string(request.Target.DevType)}
+	results := make([]ControlSettingResult, len(request.Settings))
+	controls := make([]*generated.KiezboxMessage_Control, len(request.Settings))
+	valid := true
+	for i, setting := range request.Settings {
+		results[i] = ControlSettingResult{Key: setting.Key, Value: string(setting.Value), Status: "pending"}
+		control := meshtastic.BuildKiezboxControlMessage(setting.Key, string(setting.Value), filter)
+		if control == nil {
+			results[i].Status = "invalid"
+			results[i].Error = errInvalidSetting
+			valid = false
+			continue
+		}
+		controls[i] = control
+	}
+	if !valid {
+		for _, result := range results {
+			auditControl(ginCtx, filter, result.Key, result.Value, "invalid", result.Error)
+		}
+		ginCtx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid settings, nothing was sent.", "target": request.Target, "results": results})
+		return
+	}
+
+	// Bound the whole batch, each setting may wait for all resends
+	ctx, cancel := context.WithTimeout(ginCtx.Request.Context(), controlBatchTimeout)
+	defer cancel()
+	status := http.StatusOK
+	for i, control := range controls {
+		result, err := device.SendKiezboxControl(ctx, control)
+		failed := http.StatusOK
+		if err != nil {
+			results[i].Status = "error"
+			results[i].Error = err.Error()
+			failed = controlErrorStatus(err)
+		} else {
+			results[i].Result = result
+			results[i].Status = result.Status.String()
+			switch result.Status {
+			case meshtastic.TxTimeout:
+				failed = http.StatusGatewayTimeout
+				results[i].Error = "control value not acknowledged"
+			case meshtastic.TxNak:
+				failed = http.StatusBadGateway
+				results[i].Error = "control value rejected: " + result.Error.String()
+			case meshtastic.TxRelayed:
+				status = http.StatusAccepted
+			}
+		}
+		auditControl(ginCtx, filter, results[i].Key, results[i].Value, results[i].Status, results[i].Error)
+		if failed != http.StatusOK {
+			status = failed
+			// The remaining settings would wait and fail the same way
+			for j := i + 1; j < len(results); j++ {
+				results[j].Status = "skipped"
+				auditControl(ginCtx, filter, results[j].Key, results[j].Value, results[j].Status, results[i].Error)
+			}
+			break
+		}
+	}
+	slog.Info("Control values set", "settings", len(results), "status", status)
+	ginCtx.JSON(status, gin.H{"target": request.Target, "results": results})
+}
+
+// auditControl records setting a control value in the audit log
+func auditControl(ginCtx *gin.Context, filter []string, key string, value string, result string, reason string) {
+	entry := auth.AuditEntry(ginCtx, "control.set")
+	entry.Target = make(map[string]string)
+	for i, name := range []string{"box_id", "dist_id", "sens_id", "dev_type"} {
+		if filter[i] != "" {
+			entry.Target[name] = filter[i]
+		}
+	}
+	entry.Details = map[string]string{"key": key, "value": value}
+	entry.Result = result
+	entry.Error = reason
+	audit.Log(entry)
+}
+
+// controlErrorStatus maps an error from sending a control message to the response status
+func controlErrorStatus(err error) int {
+	if errors.Is(err, meshtastic.ErrNotReady) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
 	}
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/meshtastic"
+)
+
+// controlDevice answers control messages with the given statuses in order, the other methods are not used
+type controlDevice struct {
+	meshtastic.MeshtasticDevice
+	statuses []meshtastic.TxStatus
+	sent     int
+}
+
+func (d *controlDevice) SendKiezboxControl(ctx context.Context, control *generated.KiezboxMessage_Control) (*meshtastic.TxResult, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, context.Canceled
+	}
+	status := d.statuses[d.sent]
+	d.sent++
+	return &meshtastic.TxResult{PacketId: uint32(d.sent), Status: status, Attempts: 1}, nil
+}
+
+func TestSetKiezboxControlValues(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	body := `{"target": {"box_id": 1}, "settings": [{"key": "mode", "value": "normal"}, {"key": "router_power", "value": true}, {"key": "status_interval", "value": 60}]}`
+
+	testCases := []struct {
+		name             string
+		statuses         []meshtastic.TxStatus
+		expectedCode     int
+		expectedStatuses []string
+	}{
+		{"All acknowledged", []meshtastic.TxStatus{meshtastic.TxAcked, meshtastic.TxAcked, meshtastic.TxAcked}, http.StatusOK, []string{"acked", "acked", "acked"}},
+		{"Relayed", []meshtastic.TxStatus{meshtastic.TxRelayed, meshtastic.TxRelayed, meshtastic.TxRelayed}, http.StatusAccepted, []string{"relayed", "relayed", "relayed"}},
+		{"Timeout skips the rest", []meshtastic.TxStatus{meshtastic.TxAcked, meshtastic.TxTimeout}, http.StatusGatewayTimeout, []string{"acked", "timeout", "skipped"}},
+		{"Rejection skips the rest", []meshtastic.TxStatus{meshtastic.TxNak}, http.StatusBadGateway, []string{"nak", "skipped", "skipped"}},
+		{"Rejection after relay", []meshtastic.TxStatus{meshtastic.TxRelayed, meshtastic.TxNak}, http.StatusBadGateway, []string{"relayed", "nak", "skipped"}},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			device := &controlDevice{statuses: tc.statuses}
+			r := gin.New()
+			r.POST("/admin/control", SetKiezboxControlValue(device))
+
+			request := httptest.NewRequest(http.MethodPost, "/admin/control", strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, request)
+
+			assert.Equal(t, tc.expectedCode, recorder.Code, recorder.Body.String())
+			var response struct {
+				Results []ControlSettingResult `json:"results"`
+			}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+			var statuses []string
+			for _, result := range response.Results {
+				statuses = append(statuses, result.Status)
+			}
+			assert.Equal(t, tc.expectedStatuses, statuses)
+			assert.Equal(t, len(tc.statuses), device.sent)
+		})
+	}
+}
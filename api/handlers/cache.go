@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"kiezbox/internal/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetCacheStatus returns the fill level of the offline cache and the progress of replaying it
+func GetCacheStatus(cache *db.Cache) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if cache == nil {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "No offline cache configured."})
+			return
+		}
+		ctx.JSON(http.StatusOK, cache.Status())
+	}
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"net/http"
+
+	"kiezbox/internal/meshtastic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetControlSchema lists the keys accepted by /admin/control with their types and enum values
+func GetControlSchema(ginCtx *gin.Context) {
+	ginCtx.JSON(http.StatusOK, meshtastic.GetControlSchema())
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"kiezbox/internal/meshtastic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetDeviceState returns the state of the connection to the meshtastic device and its recent transitions
+func GetDeviceState(device meshtastic.MeshtasticDevice) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, device.ConnectionStatus())
+	}
+}
+
+// GetDeviceLogs returns the latest log messages of the meshtastic device
+// They can be filtered by minimum level, module and a text contained in the message.
+func GetDeviceLogs(device meshtastic.MeshtasticDevice) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		filter := meshtastic.DeviceLogFilter{
+			Module: ctx.Query("module"),
+			Text:   ctx.Query("q"),
+		}
+		if level := ctx.Query("level"); level != "" {
+			name, err := meshtastic.ParseDeviceLogLevel(level)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			filter.Level = name
+		}
+		if limit := ctx.Query("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit."})
+				return
+			}
+			filter.Limit = n
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"records": device.DeviceLogs().Records(filter),
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"kiezbox/api/auth"
+	"kiezbox/internal/audit"
+	"kiezbox/internal/state"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetEmergencies lists all emergencies which have not been acknowledged yet
+func GetEmergencies(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"emergencies": state.GetEmergencies(),
+	})
+}
+
+// AckEmergency acknowledges an open emergency, which removes it from the list of open emergencies
+func AckEmergency(ctx *gin.Context) {
+	id := ctx.Param("id")
+	emergency, ok := state.AckEmergency(id)
+	entry := auth.AuditEntry(ctx, "emergency.ack")
+	entry.Target = map[string]string{"id": id}
+	if !ok {
+		entry.Result = "not_found"
+		audit.Log(entry)
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "No open emergency with this id."})
+		return
+	}
+	entry.Result = "acked"
+	audit.Log(entry)
+	slog.Info("Emergency acknowledged", "id", id, "type", emergency.Type, "button_id", emergency.ButtonId)
+	ctx.JSON(http.StatusOK, emergency)
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/state"
+)
+
+func clearEmergencies() {
+	for _, emergency := range state.GetEmergencies() {
+		state.AckEmergency(emergency.ID)
+	}
+}
+
+func TestEmergencies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/emergencies", GetEmergencies)
+	r.POST("/emergencies/:id/ack", AckEmergency)
+	clearEmergencies()
+	defer clearEmergencies()
+
+	list := func() []state.Emergency {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/emergencies", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var body struct {
+			Emergencies []state.Emergency `json:"emergencies"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+		return body.Emergencies
+	}
+	ack := func(id string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/emergencies/"+id+"/ack", nil))
+		return recorder
+	}
+
+	assert.Empty(t, list())
+	emergency, _ := state.AddEmergency(&generated.KiezboxMessage_Emergency{Type: generated.KiezboxMessage_medical, ButtonId: 7, UnixTime: 1700000000})
+	emergencies := list()
+	require.Len(t, emergencies, 1)
+	assert.Equal(t, emergency.ID, emergencies[0].ID)
+	assert.Equal(t, "medical", emergencies[0].Type)
+	assert.Equal(t, int32(7), emergencies[0].ButtonId)
+
+	recorder := ack(emergency.ID)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var acked state.Emergency
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &acked))
+	assert.Equal(t, emergency.ID, acked.ID)
+	assert.NotZero(t, acked.AckTime)
+	assert.Empty(t, list())
+
+	assert.Equal(t, http.StatusNotFound, ack(emergency.ID).Code)
+	assert.Equal(t, http.StatusNotFound, ack("unknown").Code)
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"kiezbox/internal/meshtastic"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// Amount of events buffered per client before events are dropped for this client
+	eventsClientBuffer = 64
+	// Interval of the keepalive comments sent to idle clients
+	eventsKeepalive = 15 * time.Second
+)
+
+// Event types of the KiezboxMessages
+const (
+	eventUpdate   = "update"
+	eventControl  = "control"
+	eventDistress = "distress"
+)
+
+// Event is a single live event, as it is sent to the client
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+// liveEvent converts an envelope from the bus into the event sent to the client
+// KiezboxMessages are sent in their canonical JSON representation, typed by the variant they contain.
+func liveEvent(envelope *meshtastic.Envelope) (Event, bool) {
+	event := Event{Time: time.Now()}
+	if envelope.Event != nil {
+		event.Type, event.Data = envelope.Event.Type, envelope.Event.Data
+		return event, true
+	}
+	message := envelope.Kiezbox
+	switch {
+	case message.GetUpdate() != nil:
+		event.Type = eventUpdate
+	case message.GetControl() != nil:
+		event.Type = eventControl
+	case message.GetDistress() != nil:
+		event.Type = eventDistress
+	default:
+		return event, false
+	}
+	raw, err := protojson.Marshal(message)
+	if err != nil {
+		slog.Error("Failed to marshal event to JSON", "type", event.Type, "err", err)
+		return event, false
+	}
+	event.Data = json.RawMessage(raw)
+	return event, true
+}
+
+// Events streams live gateway events (KiezboxMessages, mode changes and serial connection changes)
+// to the client as Server-Sent Events, until the client disconnects or the gateway shuts down
+func Events(device meshtastic.MeshtasticDevice) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		subscription := device.SubscribeEvents(eventsClientBuffer)
+		defer func() {
+			device.UnsubscribeEvents(subscription)
+			slog.Info("Event stream closed", "client", ctx.ClientIP())
+		}()
+		slog.Info("Event stream opened", "client", ctx.ClientIP())
+
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("Connection", "keep-alive")
+		ctx.Status(http.StatusOK)
+
+		keepalive := time.NewTicker(eventsKeepalive)
+		defer keepalive.Stop()
+
+		ctx.Stream(func(w io.Writer) bool {
+			select {
+			case <-ctx.Request.Context().Done():
+				return false
+			case <-subscription.Done():
+				return false
+			case envelope := <-subscription.C:
+				if event, ok := liveEvent(envelope); ok {
+					ctx.SSEvent(event.Type, event)
+				}
+				return true
+			case <-keepalive.C:
+				// SSE comment lines are ignored by clients but keep proxies from closing the connection
+				_, err := io.WriteString(w, ": keepalive\n\n")
+				return err == nil
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kiezbox/internal/meshtastic"
+	"kiezbox/testutils"
+)
+
+func TestLiveEvent(t *testing.T) {
+	// KiezboxMessages are sent as their canonical JSON, typed by their variant
+	event, ok := liveEvent(&meshtastic.Envelope{Kiezbox: testutils.CreateDistressMessage(1672531200)})
+	require.True(t, ok)
+	assert.Equal(t, "distress", event.Type)
+	raw, ok := event.Data.(json.RawMessage)
+	require.True(t, ok, "protobuf messages should be sent as raw JSON")
+	var decoded map[string]map[string]any
+	require.NoError(t, json.Unmarshal(raw, &decoded))
+	assert.Equal(t, "fire", decoded["distress"]["type"])
+
+	event, ok = liveEvent(&meshtastic.Envelope{Kiezbox: testutils.CreateKiezboxMessage(1672531200)})
+	require.True(t, ok)
+	assert.Equal(t, "update", event.Type)
+
+	// Gateway events are sent as they were published
+	event, ok = liveEvent(&meshtastic.Envelope{Event: &meshtastic.GatewayEvent{Type: meshtastic.EventMode, Data: map[string]any{"mode": 1}}})
+	require.True(t, ok)
+	assert.Equal(t, "mode", event.Type)
+	assert.Equal(t, map[string]any{"mode": 1}, event.Data)
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+
+	"kiezbox/internal/supervisor"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthStatus answers 503 while a critical worker (like the reader or writer of the device connection) is not running
+func healthStatus(workers *supervisor.Supervisor) (int, string) {
+	if !workers.Healthy() {
+		return http.StatusServiceUnavailable, "degraded"
+	}
+	return http.StatusOK, "ok"
+}
+
+// Health reports whether the gateway is healthy, without any details of the workers
+// It is served without auth, so it must not expose their errors.
+func Health(workers *supervisor.Supervisor) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		status, state := healthStatus(workers)
+		ctx.JSON(status, gin.H{"status": state})
+	}
+}
+
+// GetWorkers reports the health together with the status and last error of all gateway workers
+func GetWorkers(workers *supervisor.Supervisor) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		status, state := healthStatus(workers)
+		ctx.JSON(status, gin.H{"status": state, "workers": workers.Status()})
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiezbox/internal/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Time range used when the request does not specify one
+const defaultMetricsRange = 24 * time.Hour
+
+// GetMetrics returns the history of a measurement as JSON or CSV
+// Query parameters: the meta tags (box_id, dist_id, sens_id, dev_type), start and stop
+// (RFC3339 or relative like -6h), window (e.g. 5m), aggregate (mean, min, max, last) and format (json, csv).
+func GetMetrics(sink db.Sink) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		querier, ok := sink.(db.Querier)
+		if !ok {
+			ctx.JSON(http.StatusNotImplemented, gin.H{"error": "The storage sink does not support queries."})
+			return
+		}
+
+		now := time.Now()
+		query := db.MetricsQuery{
+			Measurement: ctx.Param("measurement"),
+			Tags:        make(map[string]string),
+			Aggregate:   ctx.Query("aggregate"),
+		}
+		for _, tag := range db.MetaTags() {
+			if value, ok := ctx.GetQuery(tag); ok {
+				query.Tags[tag] = value
+			}
+		}
+		var err error
+		if query.Start, err = parseQueryTime(ctx.Query("start"), now, now.Add(-defaultMetricsRange)); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start: " + err.Error()})
+			return
+		}
+		if query.Stop, err = parseQueryTime(ctx.Query("stop"), now, now); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid stop: " + err.Error()})
+			return
+		}
+		if window := ctx.Query("window"); window != "" {
+			if query.Window, err = time.ParseDuration(window); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid window: " + err.Error()})
+				return
+			}
+		}
+
+		rows, err := querier.QueryMetrics(ctx.Request.Context(), query)
+		if errors.Is(err, db.ErrInvalidQuery) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			slog.Error("Failed to query metrics", "measurement", query.Measurement, "err", err)
+			ctx.JSON(http.StatusBadGateway, gin.H{"error": "Failed to query metrics."})
+			return
+		}
+		if rows == nil {
+			rows = []db.MetricRow{}
+		}
+
+		if ctx.Query("format") == "csv" || (ctx.Query("format") == "" && strings.Contains(ctx.GetHeader("Accept"), "text/csv")) {
+			writeMetricsCSV(ctx, rows)
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"measurement": query.Measurement,
+			"start":       query.Start,
+			"stop":        query.Stop,
+			"window":      query.Window.String(),
+			"aggregate":   query.Aggregate,
+			"rows":        rows,
+		})
+	}
+}
+
+// parseQueryTime parses an RFC3339 timestamp or a duration relative to now
+func parseQueryTime(value string, now time.Time, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if strings.HasPrefix(value, "-") {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(duration), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// writeMetricsCSV writes one line per row with a column per tag and value
+func writeMetricsCSV(ctx *gin.Context, rows []db.MetricRow) {
+	tagSet := make(map[string]bool)
+	valueSet := make(map[string]bool)
+	for _, row := range rows {
+		for tag := range row.Tags {
+			tagSet[tag] = true
+		}
+		for value := range row.Values {
+			valueSet[value] = true
+		}
+	}
+	tags := sortedSet(tagSet)
+	values := sortedSet(valueSet)
+
+	ctx.Header("Content-Type", "text/csv")
+	ctx.Status(http.StatusOK)
+	writer := csv.NewWriter(ctx.Writer)
+	writer.Write(append(append([]string{"time"}, tags...), values...))
+	for _, row := range rows {
+		record := []string{row.Time.UTC().Format(time.RFC3339)}
+		for _, tag := range tags {
+			record = append(record, row.Tags[tag])
+		}
+		for _, value := range values {
+			if number, ok := row.Values[value]; ok {
+				record = append(record, strconv.FormatFloat(number, 'f', -1, 64))
+			} else {
+				record = append(record, "")
+			}
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+}
+
+func sortedSet(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for item := range set {
+		list = append(list, item)
+	}
+	sort.Strings(list)
+	return list
+}
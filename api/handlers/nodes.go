@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"kiezbox/internal/meshtastic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetNodes lists all mesh nodes known to the gateway
+func GetNodes(device meshtastic.MeshtasticDevice) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{
+			"nodes": device.Nodes().List(),
+		})
+	}
+}
+
+// GetNode returns a single mesh node by its node number
+func GetNode(device meshtastic.MeshtasticDevice) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		num, err := strconv.ParseUint(ctx.Param("num"), 10, 32)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid node number."})
+			return
+		}
+		node, ok := device.Nodes().Get(uint32(num))
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Node not found."})
+			return
+		}
+		ctx.JSON(http.StatusOK, node)
+	}
+}
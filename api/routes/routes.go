@@ -1,10 +1,13 @@
 package routes
 
 import (
-	"context"
+	"kiezbox/api/auth"
 	"kiezbox/api/handlers"
+	"kiezbox/api/server"
+	"kiezbox/internal/db"
 	"kiezbox/internal/meshtastic"
-	"sync"
+	"kiezbox/internal/metrics"
+	"kiezbox/internal/supervisor"
 
 	cfg "kiezbox/internal/config"
 
@@ -27,14 +30,47 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
-func RegisterRoutes(r *gin.Engine, device meshtastic.MeshtasticDevice, ctx context.Context, wg *sync.WaitGroup) {
+// RegisterGroups registers the routes of the given groups, so every listener only serves its own
+// The health of the workers is taken from the supervisor, which may be nil if the routines are not supervised.
+func RegisterGroups(r *gin.Engine, groups []string, device meshtastic.MeshtasticDevice, sink db.Sink, cache *db.Cache, workers *supervisor.Supervisor) {
 	// Use Corse middlewar only for local testing
 	if cfg.Cfg.CorsLocalhost {
 		r.Use(CORSMiddleware())
 	}
-	r.GET("/mode", handlers.GetMode)
-	r.GET("/info", handlers.Info)
-	r.Any("/session", handlers.Session)
-	r.POST("/asterisk/:pstype/:singlemulti", handlers.Asterisk)
-	r.POST("/admin/control", handlers.SetKiezboxControlValue(device, ctx, wg))
+	// Every listener reports the health of the gateway without auth, so it can be monitored on any of them
+	// The details of the workers are only served to viewers.
+	r.GET("/health", handlers.Health(workers))
+	for _, group := range groups {
+		switch group {
+		case server.GroupPublic:
+			// Routes used by the box itself and its WiFi clients stay public
+			r.GET("/mode", handlers.GetMode)
+			r.GET("/info", handlers.Info)
+			r.Any("/session", handlers.Session)
+		case server.GroupAsterisk:
+			r.POST("/asterisk/:pstype/:singlemulti", handlers.Asterisk)
+		case server.GroupViewer:
+			// Reading the state of the mesh and the gateway
+			viewer := r.Group("", auth.Default.Require(auth.RoleViewer))
+			viewer.GET("/emergencies", handlers.GetEmergencies)
+			viewer.GET("/events", handlers.Events(device))
+			viewer.GET("/health/workers", handlers.GetWorkers(workers))
+			viewer.GET("/nodes", handlers.GetNodes(device))
+			viewer.GET("/nodes/:num", handlers.GetNode(device))
+			viewer.GET("/device/state", handlers.GetDeviceState(device))
+			viewer.GET("/device/logs", handlers.GetDeviceLogs(device))
+			viewer.GET("/cache", handlers.GetCacheStatus(cache))
+			viewer.GET("/metrics", handlers.Prometheus(metrics.Registry))
+			viewer.GET("/metrics/:measurement", handlers.GetMetrics(sink))
+		case server.GroupOperator:
+			// Handling emergencies
+			operator := r.Group("", auth.Default.Require(auth.RoleOperator))
+			operator.POST("/emergencies/:id/ack", handlers.AckEmergency)
+		case server.GroupAdmin:
+			// Changing the configuration of the boxes
+			r.GET("/admin/control/schema", auth.Default.Require(auth.RoleViewer), handlers.GetControlSchema)
+			admin := r.Group("", auth.Default.Require(auth.RoleAdmin))
+			admin.POST("/admin/control", handlers.SetKiezboxControlValue(device))
+		}
+	}
 }
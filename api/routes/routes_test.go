@@ -0,0 +1,75 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kiezbox/api/auth"
+	"kiezbox/api/server"
+)
+
+func TestRegisterGroups(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authenticator, err := auth.New([]string{"grafana:viewer:view-key"}, nil)
+	require.NoError(t, err)
+	auth.Default = authenticator
+	defer func() { auth.Default = nil }()
+
+	testCases := []struct {
+		name     string
+		groups   []string
+		path     string
+		expected int
+	}{
+		{"Public route", server.Groups, "/mode", http.StatusOK},
+		{"Events require a viewer", server.Groups, "/events", http.StatusUnauthorized},
+		{"Events are not served to the public", []string{server.GroupPublic}, "/events", http.StatusNotFound},
+		{"Health without auth", server.Groups, "/health", http.StatusOK},
+		{"Health on every listener", []string{server.GroupAsterisk}, "/health", http.StatusOK},
+		{"Workers require a viewer", server.Groups, "/health/workers", http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := gin.New()
+			RegisterGroups(r, tc.groups, nil, nil, nil, nil)
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			assert.Equal(t, tc.expected, recorder.Code)
+		})
+	}
+}
+
+func TestHealthWithoutAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authenticator, err := auth.New([]string{"grafana:viewer:view-key"}, nil)
+	require.NoError(t, err)
+	auth.Default = authenticator
+	defer func() { auth.Default = nil }()
+
+	r := gin.New()
+	RegisterGroups(r, server.Groups, nil, nil, nil, nil)
+
+	// The errors of the workers are not exposed without auth
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var health map[string]any
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &health))
+	assert.Equal(t, "ok", health["status"])
+	assert.NotContains(t, health, "workers")
+
+	// A viewer gets the status of the workers
+	request := httptest.NewRequest(http.MethodGet, "/health/workers", nil)
+	request.Header.Set("X-API-Key", "view-key")
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"status": "ok", "workers": []}`, recorder.Body.String())
+}
@@ -0,0 +1,156 @@
+// Package server runs the HTTP listeners of the gateway API, each with its own address, TLS setup and route groups
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	cfg "kiezbox/internal/config"
+)
+
+// Route groups which can be served by a listener
+const (
+	// Routes used by the box itself and its WiFi clients (/mode, /info, /session)
+	GroupPublic = "public"
+	// Callbacks from the local telephony (/asterisk)
+	GroupAsterisk = "asterisk"
+	// Reading the state of the mesh and the gateway
+	GroupViewer = "viewer"
+	// Handling emergencies
+	GroupOperator = "operator"
+	// Changing the configuration of the boxes (/admin)
+	GroupAdmin = "admin"
+)
+
+// Groups lists all route groups
+var Groups = []string{GroupPublic, GroupAsterisk, GroupViewer, GroupOperator, GroupAdmin}
+
+// Route groups which are only served to authenticated clients
+var protectedGroups = []string{GroupViewer, GroupOperator, GroupAdmin}
+
+// Listener is a single address the API is served on
+type Listener struct {
+	Address string
+	// Certificate and key files, TLS is enabled when both are set
+	CertFile string
+	KeyFile  string
+	Groups   []string
+}
+
+// TLS reports whether the listener serves HTTPS
+func (l Listener) TLS() bool {
+	return l.CertFile != "" && l.KeyFile != ""
+}
+
+// Serves reports whether the listener serves the route group
+func (l Listener) Serves(group string) bool {
+	for _, g := range l.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Loopback reports whether the listener only accepts connections from the gateway itself
+func (l Listener) Loopback() bool {
+	host, _, err := net.SplitHostPort(l.Address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (l Listener) String() string {
+	scheme := "http"
+	if l.TLS() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s (%s)", scheme, l.Address, strings.Join(l.Groups, ","))
+}
+
+// ParseListener parses a listener given as URL, e.g.
+// http://localhost:9080 or https://0.0.0.0:9443?groups=public,viewer&cert=/etc/kb/cert.pem&key=/etc/kb/key.pem
+// Without groups, or with groups=all, the listener serves all route groups.
+func ParseListener(value string) (Listener, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return Listener{}, fmt.Errorf("invalid listener %q: %w", value, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Listener{}, fmt.Errorf("invalid listener %q: scheme must be http or https", value)
+	}
+	if u.Host == "" {
+		return Listener{}, fmt.Errorf("invalid listener %q: missing address", value)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return Listener{}, fmt.Errorf("invalid listener %q: %w", value, err)
+	}
+	query := u.Query()
+	l := Listener{Address: u.Host, CertFile: query.Get("cert"), KeyFile: query.Get("key")}
+	if u.Scheme == "https" && !l.TLS() {
+		return Listener{}, fmt.Errorf("invalid listener %q: https requires cert and key", value)
+	}
+	if u.Scheme == "http" && (l.CertFile != "" || l.KeyFile != "") {
+		return Listener{}, fmt.Errorf("invalid listener %q: cert and key require https", value)
+	}
+	groups := query.Get("groups")
+	if groups == "" || groups == "all" {
+		l.Groups = Groups
+		return l, nil
+	}
+	for _, group := range strings.Split(groups, ",") {
+		if !contains(Groups, group) {
+			return Listener{}, fmt.Errorf("invalid listener %q: unknown route group %q, expected one of %s", value, group, strings.Join(Groups, ", "))
+		}
+		if !contains(l.Groups, group) {
+			l.Groups = append(l.Groups, group)
+		}
+	}
+	return l, nil
+}
+
+// ListenersFromConfig returns the configured listeners, by default a single one on localhost:<api_port> serving all routes
+// Without authentication every client is admin, so the protected route groups are then only served on loopback.
+func ListenersFromConfig(authenticated bool) ([]Listener, error) {
+	if len(cfg.Cfg.ApiListeners) == 0 {
+		return []Listener{{Address: net.JoinHostPort("localhost", cfg.Cfg.ApiPort), Groups: Groups}}, nil
+	}
+	var listeners []Listener
+	for _, value := range cfg.Cfg.ApiListeners {
+		if value == "" {
+			continue
+		}
+		l, err := ParseListener(value)
+		if err != nil {
+			return nil, err
+		}
+		if !authenticated && !l.Loopback() {
+			for _, group := range protectedGroups {
+				if l.Serves(group) {
+					return nil, fmt.Errorf("listener %s serves the %s routes beyond loopback, which requires api_auth", l, group)
+				}
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no API listeners configured")
+	}
+	return listeners, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	cfg "kiezbox/internal/config"
+)
+
+func TestParseListener(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected Listener
+		err      string
+	}{
+		{"http://localhost:9080", Listener{Address: "localhost:9080", Groups: Groups}, ""},
+		{"http://0.0.0.0:80?groups=public,public,viewer", Listener{Address: "0.0.0.0:80", Groups: []string{GroupPublic, GroupViewer}}, ""},
+		{"https://[::]:9443?groups=all&cert=/etc/kb/cert.pem&key=/etc/kb/key.pem", Listener{Address: "[::]:9443", CertFile: "/etc/kb/cert.pem", KeyFile: "/etc/kb/key.pem", Groups: Groups}, ""},
+		{"http://localhost", Listener{}, "missing port"},
+		{"localhost:9080", Listener{}, "scheme must be http or https"},
+		{"https://0.0.0.0:9443?groups=public", Listener{}, "https requires cert and key"},
+		{"http://0.0.0.0:9080?cert=cert.pem&key=key.pem", Listener{}, "cert and key require https"},
+		{"http://0.0.0.0:9080?groups=public,root", Listener{}, `unknown route group "root"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			listener, err := ParseListener(tc.value)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, listener)
+		})
+	}
+}
+
+func TestListenersFromConfig(t *testing.T) {
+	defer func() { cfg.Cfg.ApiListeners = nil }()
+	testCases := []struct {
+		name          string
+		listeners     []string
+		authenticated bool
+		err           string
+	}{
+		{"Protected routes on loopback", []string{"http://localhost:9080", "http://127.0.0.1:9081?groups=admin", "http://[::1]:9082?groups=viewer"}, false, ""},
+		{"Public routes beyond loopback", []string{"http://0.0.0.0:80?groups=public,asterisk"}, false, ""},
+		{"Admin routes beyond loopback", []string{"http://0.0.0.0:9080?groups=public,admin"}, false, "serves the admin routes beyond loopback"},
+		{"All routes on the LAN", []string{"http://192.168.1.1:9080"}, false, "serves the viewer routes beyond loopback"},
+		{"All routes with auth", []string{"http://0.0.0.0:9080"}, true, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.Cfg.ApiListeners = tc.listeners
+			listeners, err := ListenersFromConfig(tc.authenticated)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, listeners, len(tc.listeners))
+		})
+	}
+}
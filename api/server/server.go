@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	cfg "kiezbox/internal/config"
+)
+
+// Time the open requests get to finish when a listener shuts down, if no shutdown_timeout is configured
+const shutdownTimeout = 5 * time.Second
+
+// Server serves the API on a single listener
+type Server struct {
+	listener Listener
+	http     *http.Server
+	ln       net.Listener
+	reloader *certReloader
+	done     chan error
+}
+
+// Start binds the listener and serves handler on it in the background
+func Start(l Listener, handler http.Handler) (*Server, error) {
+	s := &Server{
+		listener: l,
+		http:     &http.Server{Addr: l.Address, Handler: handler, ReadHeaderTimeout: 10 * time.Second},
+		done:     make(chan error, 1),
+	}
+	if l.TLS() {
+		reloader, err := newCertReloader(l.CertFile, l.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.reloader = reloader
+		s.http.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+	ln, err := net.Listen("tcp", l.Address)
+	if err != nil {
+		return nil, err
+	}
+	s.ln = ln
+	go func() {
+		var err error
+		if l.TLS() {
+			err = s.http.ServeTLS(ln, "", "")
+		} else {
+			err = s.http.Serve(ln)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		s.done <- err
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Done returns the result of serving once the server stopped
+func (s *Server) Done() <-chan error {
+	return s.done
+}
+
+// Shutdown stops accepting connections and waits for open requests until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// Run serves handler on the listener until ctx is canceled or serving fails
+func Run(ctx context.Context, l Listener, handler http.Handler) error {
+	s, err := Start(l, handler)
+	if err != nil {
+		return err
+	}
+	slog.Info("API listening", "listener", l.String(), "addr", s.Addr().String())
+	select {
+	case err := <-s.Done():
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("Shutting down API listener", "listener", l.String())
+	timeout := cfg.Cfg.StopTimeout
+	if timeout <= 0 {
+		timeout = shutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	return <-s.Done()
+}
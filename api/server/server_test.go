@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Write a self-signed certificate for localhost with the given serial number
+func writeCertificate(t *testing.T, certFile string, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func TestServeTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	s, err := Start(Listener{Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, Groups: Groups}, handler)
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+
+	// Returns the serial number of the certificate presented by the server
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(1), serial())
+	require.NotNil(t, s.reloader)
+
+	// Renewed certificates are picked up after the check interval
+	writeCertificate(t, certFile, keyFile, 2)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	assert.Equal(t, int64(1), serial())
+	s.reloader.lastCheck = time.Time{}
+	assert.Equal(t, int64(2), serial())
+
+	// A broken certificate keeps the previous one
+	require.NoError(t, os.WriteFile(certFile, []byte("broken"), 0600))
+	later := future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	s.reloader.lastCheck = time.Time{}
+	assert.Equal(t, int64(2), serial())
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	response, err := client.Get("https://" + s.Addr().String() + "/")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestRun(t *testing.T) {
+	// Serving fails when the address is already in use
+	s, err := Start(Listener{Address: "127.0.0.1:0", Groups: Groups}, http.NotFoundHandler())
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	err = Run(context.Background(), Listener{Address: s.Addr().String()}, http.NotFoundHandler())
+	assert.Error(t, err)
+
+	// Run returns after the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, Listener{Address: "127.0.0.1:0"}, http.NotFoundHandler())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was canceled")
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate from files and loads it again when the files change,
+// so renewed certificates are used without restarting the gateway
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: certCheckInterval}
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(certMod, keyMod); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (r *certReloader) load(certMod time.Time, keyMod time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// GetCertificate returns the current certificate, a failed reload keeps the previous one
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.lastCheck) < r.interval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		slog.Error("Failed to check TLS certificate", "cert", r.certFile, "key", r.keyFile, "err", err)
+		return r.cert, nil
+	}
+	if certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+	if err := r.load(certMod, keyMod); err != nil {
+		// Certificate and key may be replaced one after the other, the next check tries again
+		slog.Error("Failed to reload TLS certificate", "cert", r.certFile, "key", r.keyFile, "err", err)
+		return r.cert, nil
+	}
+	slog.Info("Reloaded TLS certificate", "cert", r.certFile)
+	return r.cert, nil
+}
@@ -0,0 +1,87 @@
+// Package audit records who changed what on the gateway and with which result
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is a single audited action
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	Who     string            `json:"who"`
+	Role    string            `json:"role,omitempty"`
+	Source  string            `json:"source,omitempty"`
+	Action  string            `json:"action"`
+	Target  map[string]string `json:"target,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	Result  string            `json:"result"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// Logger appends audit entries as JSON lines to a file and to the service log
+type Logger struct {
+	mutex  sync.Mutex
+	output io.WriteCloser
+}
+
+// Default audit logger, which only writes to the service log until a file is opened
+var Default = &Logger{}
+
+// Open creates a logger which appends to the file at path
+func Open(path string) (*Logger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{output: file}, nil
+}
+
+// NewLogger creates a logger writing to output, nil only writes to the service log
+func NewLogger(output io.WriteCloser) *Logger {
+	return &Logger{output: output}
+}
+
+// Log records an entry, the time is set if it is missing
+func (l *Logger) Log(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	slog.Info("Audit", "who", entry.Who, "role", entry.Role, "origin", entry.Source, "action", entry.Action,
+		"target", entry.Target, "details", entry.Details, "result", entry.Result, "error", entry.Error)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.output == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Failed to marshal audit entry", "err", err)
+		return
+	}
+	if _, err := l.output.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write audit entry", "err", err)
+	}
+}
+
+// Close closes the audit file
+func (l *Logger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.output == nil {
+		return nil
+	}
+	err := l.output.Close()
+	l.output = nil
+	return err
+}
+
+// Log records an entry with the default logger
+func Log(entry Entry) {
+	Default.Log(entry)
+}
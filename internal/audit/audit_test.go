@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Entries are appended across restarts
+	for _, result := range []string{"acked", "timeout"} {
+		logger, err := Open(path)
+		require.NoError(t, err)
+		logger.Log(Entry{Who: "alice", Role: "admin", Action: "control.set", Target: map[string]string{"box_id": "1"}, Result: result})
+		require.NoError(t, logger.Close())
+		// Logging after closing is ignored
+		logger.Log(Entry{Who: "alice", Action: "control.set", Result: "lost"})
+	}
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 2)
+	assert.Equal(t, "acked", entries[0].Result)
+	assert.Equal(t, "timeout", entries[1].Result)
+	assert.Equal(t, "1", entries[1].Target["box_id"])
+	assert.False(t, entries[0].Time.IsZero())
+}
@@ -0,0 +1,260 @@
+// Package capture records the raw stream between the gateway and the meshtastic device into capture files
+// and replays them, so issues seen in the field can be reproduced in tests and against the gateway.
+//
+// A capture file starts with the magic bytes "KBCAP01\n", followed by one record per read or write:
+//
+//	direction (1 byte) | unix time in nanoseconds (int64, big endian) | length (uint32, big endian) | data
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Magic bytes at the start of every capture file
+const Magic = "KBCAP01\n"
+
+// Direction of a record
+type Direction byte
+
+const (
+	// FromRadio marks data read from the device, as delivered by the port: frames, debug text and garbage
+	FromRadio Direction = '<'
+	// ToRadio marks frames written to the device
+	ToRadio Direction = '>'
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FromRadio:
+		return "from_radio"
+	case ToRadio:
+		return "to_radio"
+	default:
+		return fmt.Sprintf("unknown(%q)", byte(d))
+	}
+}
+
+// Maximum length of a single record, larger ones are taken as corrupt
+const maxRecordSize = 1 << 20
+
+const headerSize = 1 + 8 + 4
+
+// ErrInvalidCapture is returned for files which are not captures or contain corrupt records
+var ErrInvalidCapture = errors.New("invalid capture")
+
+// Record is a single read from or write to the device
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	Data      []byte
+}
+
+// Writer appends records to a capture
+type Writer struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	closed bool
+	// Set for capture files created with a maximum size
+	path    string
+	maxSize int64
+	size    int64
+}
+
+// Create opens a capture file for appending, the magic bytes are written if the file is new.
+// Once a record would grow the file beyond maxSize bytes, the file is moved to <path>.1, replacing the previous one,
+// and recording continues in a new file. A maxSize of 0 disables the limit.
+func Create(path string, maxSize int64) (*Writer, error) {
+	file, size, err := openFile(path, os.O_APPEND)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: file, path: path, maxSize: maxSize, size: size}, nil
+}
+
+// openFile opens the capture file at path with the additional flag and writes the magic bytes if it is empty
+func openFile(path string, flag int) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if info.Size() > 0 {
+		return file, info.Size(), nil
+	}
+	if _, err := io.WriteString(file, Magic); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, int64(len(Magic)), nil
+}
+
+// NewWriter writes the magic bytes to w and returns a Writer appending records to it
+// If w is an io.Closer, it is closed with the Writer.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := io.WriteString(w, Magic); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// Write appends a record with the current time
+func (w *Writer) Write(direction Direction, data []byte) error {
+	return w.WriteRecord(Record{Time: time.Now(), Direction: direction, Data: data})
+}
+
+// WriteRecord appends a record
+// Every record is written with a single write, so a capture cut off by a crash only loses its last record.
+func (w *Writer) WriteRecord(record Record) error {
+	buf := make([]byte, headerSize, headerSize+len(record.Data))
+	buf[0] = byte(record.Direction)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(record.Time.UnixNano()))
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(record.Data)))
+	buf = append(buf, record.Data...)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	// A file holding only the magic bytes is not rotated, so a single large record is still written
+	if w.maxSize > 0 && w.size > int64(len(Magic)) && w.size+int64(len(buf)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			// Recording stops rather than growing the file without limit
+			w.closed = true
+			return fmt.Errorf("failed to rotate capture file, recording stopped: %w", err)
+		}
+	}
+	n, err := w.w.Write(buf)
+	w.size += int64(n)
+	return err
+}
+
+// rotate moves the full capture file to <path>.1 and continues in a new one
+func (w *Writer) rotate() error {
+	if closer, ok := w.w.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	file, size, err := openFile(w.path, os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	slog.Info("Rotated capture file", "file", w.path, "previous", w.path+".1")
+	w.w = file
+	w.size = size
+	return nil
+}
+
+// Close stops recording and closes the underlying file
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if closer, ok := w.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Tee wraps the port to the device, so everything read from and written to it is recorded
+// Closing the returned port closes the device port, but not the capture.
+func (w *Writer) Tee(port io.ReadWriteCloser) io.ReadWriteCloser {
+	return &teePort{port: port, capture: w}
+}
+
+type teePort struct {
+	port    io.ReadWriteCloser
+	capture *Writer
+}
+
+func (t *teePort) Read(p []byte) (int, error) {
+	n, err := t.port.Read(p)
+	if n > 0 {
+		t.record(FromRadio, p[:n])
+	}
+	return n, err
+}
+
+func (t *teePort) Write(p []byte) (int, error) {
+	n, err := t.port.Write(p)
+	if n > 0 {
+		t.record(ToRadio, p[:n])
+	}
+	return n, err
+}
+
+func (t *teePort) Close() error {
+	return t.port.Close()
+}
+
+// record writes to the capture, failures are logged but do not affect the device connection
+func (t *teePort) record(direction Direction, data []byte) {
+	err := t.capture.Write(direction, data)
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		slog.Error("Failed to write capture record", "direction", direction, "err", err)
+	}
+}
+
+// Reader reads the records of a capture
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader checks the magic bytes and returns a Reader for the records of the capture
+func NewReader(r io.Reader) (*Reader, error) {
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != Magic {
+		return nil, fmt.Errorf("%w: missing magic bytes", ErrInvalidCapture)
+	}
+	return &Reader{r: r}, nil
+}
+
+// Next returns the next record, io.EOF at the end of the capture
+// A record cut off at the end, e.g. because the gateway crashed, gives io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Record, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return Record{}, err
+	}
+	direction := Direction(header[0])
+	if direction != FromRadio && direction != ToRadio {
+		return Record{}, fmt.Errorf("%w: unknown direction %q", ErrInvalidCapture, header[0])
+	}
+	length := binary.BigEndian.Uint32(header[9:13])
+	if length > maxRecordSize {
+		return Record{}, fmt.Errorf("%w: record of %d bytes", ErrInvalidCapture, length)
+	}
+	record := Record{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9]))),
+		Direction: direction,
+		Data:      make([]byte, length),
+	}
+	if _, err := io.ReadFull(r.r, record.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+	return record, nil
+}
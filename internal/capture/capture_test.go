@@ -0,0 +1,270 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Port which answers every read with the same data and remembers what was written
+type fakePort struct {
+	data    []byte
+	written bytes.Buffer
+	closed  bool
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	return copy(b, p.data), nil
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	return p.written.Write(b)
+}
+
+func (p *fakePort) Close() error {
+	p.closed = true
+	return nil
+}
+
+func readAll(t *testing.T, r io.Reader) []Record {
+	reader, err := NewReader(r)
+	require.NoError(t, err)
+	var records []Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records
+		}
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+}
+
+func TestWriterReader(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf)
+	require.NoError(t, err)
+	start := time.Unix(1700000000, 123456789)
+	expected := []Record{
+		{Time: start, Direction: FromRadio, Data: []byte("INFO  | booting\r\n")},
+		{Time: start.Add(time.Millisecond), Direction: ToRadio, Data: []byte{0x94, 0xc3, 0x00, 0x02, 0x3a, 0x00}},
+		{Time: start.Add(time.Second), Direction: FromRadio, Data: []byte{}},
+	}
+	for _, record := range expected {
+		require.NoError(t, writer.WriteRecord(record))
+	}
+	require.NoError(t, writer.Close())
+	assert.ErrorIs(t, writer.Write(FromRadio, []byte{1}), os.ErrClosed)
+
+	records := readAll(t, bytes.NewReader(buf.Bytes()))
+	require.Len(t, records, len(expected))
+	for i := range expected {
+		assert.True(t, expected[i].Time.Equal(records[i].Time))
+		assert.Equal(t, expected[i].Direction, records[i].Direction)
+		assert.Equal(t, expected[i].Data, records[i].Data)
+	}
+
+	// A record cut off at the end
+	reader, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = reader.Next()
+		require.NoError(t, err)
+	}
+	_, err = reader.Next()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReaderInvalid(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("not a capture")))
+	assert.ErrorIs(t, err, ErrInvalidCapture)
+
+	reader, err := NewReader(bytes.NewReader(append([]byte(Magic), 'x', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)))
+	require.NoError(t, err)
+	_, err = reader.Next()
+	assert.ErrorIs(t, err, ErrInvalidCapture)
+
+	reader, err = NewReader(bytes.NewReader(append([]byte(Magic), '<', 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff)))
+	require.NoError(t, err)
+	_, err = reader.Next()
+	assert.ErrorIs(t, err, ErrInvalidCapture)
+}
+
+func TestCreateAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device.kbcap")
+	for i := 0; i < 2; i++ {
+		writer, err := Create(path, 0)
+		require.NoError(t, err)
+		require.NoError(t, writer.Write(FromRadio, []byte{byte(i)}))
+		require.NoError(t, writer.Close())
+	}
+
+	// The magic bytes are only written once
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	records := readAll(t, file)
+	require.Len(t, records, 2)
+	assert.Equal(t, []byte{0}, records[0].Data)
+	assert.Equal(t, []byte{1}, records[1].Data)
+}
+
+func readFile(t *testing.T, path string) []Record {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	return readAll(t, file)
+}
+
+func TestCreateRotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "device.kbcap")
+	// Room for the magic bytes and two records of 10 bytes
+	writer, err := Create(path, int64(len(Magic)+2*(headerSize+10)))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, writer.Write(FromRadio, bytes.Repeat([]byte{byte(i)}, 10)))
+	}
+	require.NoError(t, writer.Close())
+
+	// The first file was replaced by the second rotation
+	data := func(records []Record) [][]byte {
+		var data [][]byte
+		for _, record := range records {
+			data = append(data, record.Data)
+		}
+		return data
+	}
+	assert.Equal(t, [][]byte{bytes.Repeat([]byte{2}, 10), bytes.Repeat([]byte{3}, 10)}, data(readFile(t, path+".1")))
+	assert.Equal(t, [][]byte{bytes.Repeat([]byte{4}, 10)}, data(readFile(t, path)))
+
+	// A record larger than the limit is still written to a new file
+	writer, err = Create(path, 16)
+	require.NoError(t, err)
+	require.NoError(t, writer.Write(ToRadio, bytes.Repeat([]byte{5}, 20)))
+	require.NoError(t, writer.Close())
+	assert.Equal(t, [][]byte{bytes.Repeat([]byte{5}, 20)}, data(readFile(t, path)))
+
+	// Recording stops if the file can not be rotated
+	writer, err = Create(path, 16)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, writer.Write(FromRadio, []byte{6}))
+	assert.ErrorIs(t, writer.Write(FromRadio, []byte{7}), os.ErrClosed)
+	require.NoError(t, writer.Close())
+}
+
+func TestTee(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf)
+	require.NoError(t, err)
+	port := &fakePort{data: []byte("abc")}
+	tee := writer.Tee(port)
+
+	read := make([]byte, 16)
+	n, err := tee.Read(read)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(read[:n]))
+	_, err = tee.Write([]byte{0x94, 0xc3, 0x00, 0x00})
+	require.NoError(t, err)
+	require.NoError(t, tee.Close())
+	assert.True(t, port.closed)
+
+	// Closing the port keeps the capture open, a closed capture does not affect the port
+	require.NoError(t, writer.Write(FromRadio, []byte("after close")))
+	require.NoError(t, writer.Close())
+	_, err = tee.Write([]byte{0x01})
+	assert.NoError(t, err)
+
+	records := readAll(t, &buf)
+	require.Len(t, records, 3)
+	assert.Equal(t, FromRadio, records[0].Direction)
+	assert.Equal(t, []byte("abc"), records[0].Data)
+	assert.Equal(t, ToRadio, records[1].Direction)
+	assert.Equal(t, []byte{0x94, 0xc3, 0x00, 0x00}, records[1].Data)
+	assert.Equal(t, []byte{0x94, 0xc3, 0x00, 0x00, 0x01}, port.written.Bytes())
+}
+
+func testCapture(t *testing.T, gap time.Duration) []byte {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf)
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, writer.WriteRecord(Record{Time: start, Direction: FromRadio, Data: []byte("one ")}))
+	require.NoError(t, writer.WriteRecord(Record{Time: start.Add(gap / 2), Direction: ToRadio, Data: []byte("ignored ")}))
+	require.NoError(t, writer.WriteRecord(Record{Time: start.Add(gap), Direction: FromRadio, Data: []byte("two")}))
+	return buf.Bytes()
+}
+
+func TestReplay(t *testing.T) {
+	testCases := []struct {
+		name     string
+		options  ReplayOptions
+		minDelay time.Duration
+		maxDelay time.Duration
+	}{
+		{"Original speed", ReplayOptions{Speed: 1}, 200 * time.Millisecond, 2 * time.Second},
+		{"Accelerated", ReplayOptions{Speed: 10}, 20 * time.Millisecond, 150 * time.Millisecond},
+		{"Max gap", ReplayOptions{Speed: 1, MaxGap: 10 * time.Millisecond}, 10 * time.Millisecond, 150 * time.Millisecond},
+		{"As fast as possible", ReplayOptions{}, 0, 150 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			reader, err := NewReader(bytes.NewReader(testCapture(t, 200*time.Millisecond)))
+			require.NoError(t, err)
+			var out bytes.Buffer
+			start := time.Now()
+			replayed, err := Replay(context.Background(), reader, &out, tc.options)
+			elapsed := time.Since(start)
+			require.NoError(t, err)
+			assert.Equal(t, 2, replayed)
+			assert.Equal(t, "one two", out.String())
+			assert.GreaterOrEqual(t, elapsed, tc.minDelay)
+			assert.Less(t, elapsed, tc.maxDelay)
+		})
+	}
+}
+
+func TestReplayCanceled(t *testing.T) {
+	reader, err := NewReader(bytes.NewReader(testCapture(t, time.Hour)))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	replayed, err := Replay(ctx, reader, io.Discard, ReplayOptions{Speed: 1})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, replayed)
+}
+
+func TestReplayPort(t *testing.T) {
+	reader, err := NewReader(bytes.NewReader(testCapture(t, time.Millisecond)))
+	require.NoError(t, err)
+	port := NewReplayPort(context.Background(), reader, ReplayOptions{Speed: 1})
+	n, err := port.Write([]byte("discarded"))
+	assert.NoError(t, err)
+	assert.Equal(t, 9, n)
+
+	data, err := io.ReadAll(port)
+	assert.NoError(t, err)
+	assert.Equal(t, "one two", string(data))
+	assert.NoError(t, port.Close())
+
+	// Closing the port stops a running replay
+	reader, err = NewReader(bytes.NewReader(testCapture(t, time.Hour)))
+	require.NoError(t, err)
+	port = NewReplayPort(context.Background(), reader, ReplayOptions{Speed: 1})
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(port, buf)
+	require.NoError(t, err)
+	assert.NoError(t, port.Close())
+	_, err = port.Read(buf)
+	assert.Error(t, err)
+}
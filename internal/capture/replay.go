@@ -0,0 +1,98 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// ReplayOptions controls the timing of a replay
+type ReplayOptions struct {
+	// Speed divides the time between the records, 1 keeps the original timing and 0 replays as fast as possible
+	Speed float64
+	// MaxGap limits the time waited between two records, e.g. across restarts of the gateway (0 for no limit)
+	MaxGap time.Duration
+}
+
+// Replay writes the data the device sent in a capture to w, keeping the timing of the records
+// Records written to the device are skipped. It returns the number of records replayed.
+func Replay(ctx context.Context, r *Reader, w io.Writer, options ReplayOptions) (int, error) {
+	var previous time.Time
+	replayed := 0
+	for {
+		record, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return replayed, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			slog.Warn("Capture ends with a truncated record", "replayed", replayed)
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+		if record.Direction != FromRadio {
+			continue
+		}
+
+		var delay time.Duration
+		if options.Speed > 0 && !previous.IsZero() {
+			delay = time.Duration(float64(record.Time.Sub(previous)) / options.Speed)
+			if options.MaxGap > 0 && delay > options.MaxGap {
+				delay = options.MaxGap
+			}
+		}
+		previous = record.Time
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return replayed, ctx.Err()
+			case <-time.After(delay):
+			}
+		} else if ctx.Err() != nil {
+			return replayed, ctx.Err()
+		}
+
+		if _, err := w.Write(record.Data); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+}
+
+// ReplayPort feeds a capture to the gateway in place of the port to the device (it satisfies meshtastic.SerialPort)
+// Data written by the gateway is discarded, reading returns io.EOF once the capture is replayed.
+type ReplayPort struct {
+	reader *io.PipeReader
+	cancel context.CancelFunc
+}
+
+// NewReplayPort starts replaying the capture in the background
+func NewReplayPort(ctx context.Context, r *Reader, options ReplayOptions) *ReplayPort {
+	ctx, cancel := context.WithCancel(ctx)
+	reader, writer := io.Pipe()
+	go func() {
+		replayed, err := Replay(ctx, r, writer, options)
+		slog.Info("Capture replayed", "records", replayed, "err", err)
+		writer.CloseWithError(err)
+	}()
+	return &ReplayPort{reader: reader, cancel: cancel}
+}
+
+// Read returns the replayed data of the device
+func (p *ReplayPort) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// Write discards the data written to the device
+func (p *ReplayPort) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Close stops the replay
+func (p *ReplayPort) Close() error {
+	p.cancel()
+	return p.reader.Close()
+}
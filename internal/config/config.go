@@ -14,16 +14,42 @@ type GatewayConfig struct {
 	SetTime       bool          `flag:"settime||Sets the RTC time of the device to the system time at service startup" default:"true"`
 	DbWriter      bool          `flag:"dbwriter||Enables the dbwriter routine, which forwards sensor datapoints from meshtastic to the influxdb" default:"true"`
 	DbRetry       bool          `flag:"dbretry||Enables the dbretry routine, which preiodically moves cached datapoints into the influxdb" default:"true"`
+	Sink          string        `flag:"sink||Storage backend for datapoints, either 'influxdb', 'bolt' for the embedded store or 'mqtt'" default:"influxdb"`
+	StorePath     string        `flag:"store_path||Database file of the embedded store" default:".kb-store.db"`
+	StoreMaxSize  int64         `flag:"store_max_size||Maximum size (in bytes) of the points in the embedded store, the oldest points are dropped first (0 for no limit)" default:"33554432"`
+	StoreMaxAge   time.Duration `flag:"store_max_age||Maximum age (as time.Duration) of the points in the embedded store (0 for no limit)" default:"8760h"`
 	DbUrl         string        `flag:"dburl||Full URL of the influxdb" env:"INFLUXDB_URL"`
 	DbToken       string        `flag:"dbtoken||API token for the influxdb" env:"INFLUXDB_TOKEN"`
 	DbOrg         string        `flag:"dborg||Organisation to use in the influxdb" env:"INFLUXDB_ORG"`
 	DbBucket      string        `flag:"dbbucket||Bucket to use in the influxdb" env:"INFLUXDB_BUCKET"`
+	MqttBroker    string        `flag:"mqtt_broker||URL of the MQTT broker for the mqtt sink, e.g. tcp://broker:1883" env:"MQTT_BROKER" optional:"true"`
+	MqttClientId  string        `flag:"mqtt_client_id||MQTT client id (defaults to kiezbox-gateway-<hostname>)" env:"MQTT_CLIENT_ID" optional:"true"`
+	MqttUsername  string        `flag:"mqtt_username||Username for the MQTT broker" env:"MQTT_USERNAME" optional:"true"`
+	MqttPassword  string        `flag:"mqtt_password||Password for the MQTT broker" env:"MQTT_PASSWORD" optional:"true"`
+	MqttPrefix    string        `flag:"mqtt_prefix||Prefix of all MQTT topics" default:"kiezbox"`
+	MqttProtobuf  bool          `flag:"mqtt_protobuf||Additionally publishes the raw protobuf messages to <topic>/pb" default:"false"`
+	MqttCommands  bool          `flag:"mqtt_commands||Enables receiving control values on the MQTT topics <prefix>/<dist_id>/<box_id>/set/<key>" default:"false"`
+	MqttCmdKeys   []string      `flag:"mqtt_command_keys||Control keys which may be set over MQTT, separated by ';'" default:"mode;router_power;status_interval"`
+	Transport     string        `flag:"transport||Connection to the meshtastic device, either 'serial' or 'tcp://host:4403'" default:"serial"`
 	SerialDevice  string        `flag:"serial_dev||The serial device connected to the meshtastic device" default:"/dev/ttyUSB0"`
 	SerialBaud    int           `flag:"serial_baud||Baud rate of the serial device" default:"115200"`
 	RetryInterval time.Duration `flag:"retry_interval||Time interval (as time.Duration) for the dbretry delay" default:"60s"`
 	CacheDir      string        `flag:"cache_dir||Directory for caching datapoints" default:".kb-dbcache"`
+	CacheMaxSize  int64         `flag:"cache_max_size||Maximum size (in bytes) of the datapoint cache, the oldest points are dropped first (0 for no limit)" default:"16777216"`
+	CacheMaxAge   time.Duration `flag:"cache_max_age||Maximum age (as time.Duration) of cached datapoints (0 for no limit)" default:"720h"`
+	CacheSegment  int64         `flag:"cache_segment_size||Size (in bytes) of a single datapoint cache file" default:"1048576"`
+	ReplayBatch   int           `flag:"replay_batch||Number of cached datapoints written to the influxdb in a single request" default:"100"`
+	ReplayRate    float64       `flag:"replay_rate||Maximum number of cached datapoints replayed per second (0 for no limit)" default:"50"`
 	DbTimeout     time.Duration `flag:"db_timeout||Database timeout (as time.Duration)" default:"5s"`
+	TxTimeout     time.Duration `flag:"tx_timeout||Time (as time.Duration) to wait for an ACK or response from the device per attempt" default:"10s"`
+	TxRetries     int           `flag:"tx_retries||Number of resends when the device does not answer a packet" default:"2"`
+	StopTimeout   time.Duration `flag:"shutdown_timeout||Time (as time.Duration) to drain the queues and stop all routines after SIGINT/SIGTERM (keep it below the term_timeout of procd)" default:"4s"`
 	ApiPort       string        `flag:"api_port||Port to use for the gateway service HTTP API" default:"9080"`
+	ApiListeners  []string      `flag:"api_listeners||API listeners as URL like https://0.0.0.0:9443?groups=public&cert=<file>&key=<file>, separated by ';' (defaults to http://localhost:<api_port> with all route groups)" uci:"api_listeners" env:"KB_API_LISTENERS" optional:"true"`
+	ApiAuth       bool          `flag:"api_auth||Requires an API key or Basic auth for all routes except the ones used by the box itself" uci:"api_auth" env:"KB_API_AUTH" default:"false"`
+	ApiKeys       []string      `flag:"api_keys||API keys as <name>:<role>:<key> with the role viewer, operator or admin, separated by ';'" uci:"api_keys" env:"KB_API_KEYS" optional:"true"`
+	ApiUsers      []string      `flag:"api_users||Basic auth users as <name>:<role>:<password or sha256:<hex>>, separated by ';'" uci:"api_users" env:"KB_API_USERS" optional:"true"`
+	AuditLog      string        `flag:"audit_log||File to which all admin actions are appended as JSON lines" uci:"audit_log" default:".kb-audit.log"`
 	SessionDir    string        `flag:"api_sessiondir||Directory for storing emergency call user sessions" default:".kb-session"`
 	LogLevel      int           `flag:"log_level||Loglevel (int) as defined by go slog" default:"0"` //slog logging levels constants are defined here. 0 is LevelInfo > https://pkg.go.dev/log/slog#LevelInfo
 	LogFile       string        `flag:"log_file||Log file for slog" default:".kb-gwlog"`
@@ -31,6 +57,9 @@ type GatewayConfig struct {
 	LogSource     bool          `flag:"log_source||Enables logging the filename with slog" default:"true"`
 	LogShortPath  bool          `flag:"log_shortpath||Enables short filename format (basename only) for slog" default:"true"`
 	LogSerial     bool          `flag:"log_serial||Enables logging the serial debug of the meshtastic device" default:"false"`
+	CaptureFile   string        `flag:"capture_file||File to which the raw stream from and to the meshtastic device is appended for kb-replay (empty disables recording)" uci:"capture_file" optional:"true"`
+	CaptureMax    int64         `flag:"capture_max_size||Maximum size (in bytes) of the capture file, a full file is moved to <capture_file>.1, replacing the previous one (0 for no limit)" uci:"capture_max_size" default:"8388608"`
+	DeviceLogSize int           `flag:"device_log_size||Number of log messages of the meshtastic device kept for /device/logs" default:"500"`
 	SipTrunkBase  string        `uci:"trunk_base" env:"SIP_TRUNK_BASE" default:"2"`
 	BoxLat        float32       `uci:"geo_lat" env:"BOX_LAT" default:"0"`
 	BoxLon        float32       `uci:"geo_lon" env:"BOX_LON" default:"0"`
@@ -71,12 +100,14 @@ func loadConfig(nofail bool) {
 		// 2. uci values
 		// 3. environment variables
 		// 4. default values
+		// 5. zero value for optional fields
 		configurator := configuration.New(
 			&Cfg,
 			configuration.NewFlagProvider(),
 			NewUciProvider("kb.main."),
 			configuration.NewEnvProvider(),
 			configuration.NewDefaultProvider(),
+			NewOptionalProvider(),
 		)
 		if nofail {
 			configurator.SetOptions(
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const (
+	OptionalProviderName = `OptionalProvider`
+	OptionalProviderTag  = `optional`
+)
+
+// NewOptionalProvider creates a provider which keeps the zero value of fields tagged with optional:"true",
+// so settings without a sensible default do not fail the configuration when they are not given
+func NewOptionalProvider() *OptionalProvider {
+	return &OptionalProvider{}
+}
+
+type OptionalProvider struct{}
+
+func (op *OptionalProvider) Name() string {
+	return OptionalProviderName
+}
+
+func (op *OptionalProvider) Init(_ any) error {
+	return nil
+}
+
+func (op *OptionalProvider) Provide(field reflect.StructField, v reflect.Value) error {
+	if field.Tag.Get(OptionalProviderTag) != "true" {
+		return fmt.Errorf("%s: field is not optional", OptionalProviderName)
+	}
+	v.Set(reflect.Zero(field.Type))
+	return nil
+}
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	influxdb_write "github.com/influxdata/influxdb-client-go/v2/api/write"
+	bolt "go.etcd.io/bbolt"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// StoredPoint is a datapoint as kept by the embedded store
+type StoredPoint struct {
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags"`
+	Fields      map[string]any    `json:"fields"`
+	Time        time.Time         `json:"time"`
+}
+
+// StoreOptions limits the size and age of the points in the embedded store
+type StoreOptions struct {
+	// Maximum total size of the stored keys and values in bytes, 0 disables the limit.
+	// The database file is larger by the page overhead of bbolt, it does not shrink but reuses freed pages.
+	MaxSize int64
+	// Maximum age of a point (by its timestamp), 0 disables the limit
+	MaxAge time.Duration
+}
+
+// BoltStore keeps the datapoints in a local bbolt database, one bucket per measurement
+// The keys are the big endian timestamp followed by a sequence number, so a bucket is ordered by time.
+// The limits are enforced whenever points are written, dropping the oldest points of all measurements first.
+type BoltStore struct {
+	db   *bolt.DB
+	opts StoreOptions
+	// Guards size from its read in a write transaction to its write-back after the commit
+	// (bbolt releases its writer lock before the commit handlers run)
+	sizeMu sync.Mutex
+	// Size of all keys and values
+	size int64
+}
+
+// OpenBoltStore opens (or creates) the embedded store at the given path
+func OpenBoltStore(path string, opts StoreOptions) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open embedded store %s: %w", path, err)
+	}
+	store := &BoltStore{db: db, opts: opts}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			return bucket.ForEach(func(key, value []byte) error {
+				store.size += int64(len(key) + len(value))
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read embedded store %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// Write stores a single KiezboxMessage
+func (store *BoltStore) Write(ctx context.Context, message *generated.KiezboxMessage) error {
+	return store.WriteBatch(ctx, []*generated.KiezboxMessage{message})
+}
+
+// WriteBatch stores several KiezboxMessages in a single transaction
+func (store *BoltStore) WriteBatch(ctx context.Context, messages []*generated.KiezboxMessage) error {
+	points := make([]*influxdb_write.Point, 0, len(messages))
+	for _, message := range messages {
+		point, err := KiezboxMessageToPoint(message)
+		if err != nil {
+			slog.Error("Failed to convert message to point", "err", err)
+			continue // Skip this point and move to the next
+		}
+		points = append(points, point)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	var size int64
+	store.sizeMu.Lock()
+	defer store.sizeMu.Unlock()
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		size = store.size
+		for _, point := range points {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(point.Name()))
+			if err != nil {
+				return fmt.Errorf("failed to create bucket %s: %w", point.Name(), err)
+			}
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(toStoredPoint(point))
+			if err != nil {
+				return fmt.Errorf("failed to encode point: %w", err)
+			}
+			key := pointKey(point.Time(), seq)
+			if err := bucket.Put(key, value); err != nil {
+				return fmt.Errorf("failed to store point: %w", err)
+			}
+			size += int64(len(key) + len(value))
+		}
+		return store.prune(tx, &size)
+	})
+	if err == nil {
+		store.size = size
+	}
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		err = fmt.Errorf("%w: %w", ErrNoConnection, err)
+	}
+	ObserveWrite(start, err)
+	return err
+}
+
+// Health checks whether the store is still open
+func (store *BoltStore) Health(ctx context.Context) error {
+	if err := store.db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		return fmt.Errorf("%w: %w", ErrNoConnection, err)
+	}
+	return nil
+}
+
+// Close closes the database file
+func (store *BoltStore) Close() error {
+	return store.db.Close()
+}
+
+// Query calls fn for every point of a measurement in the time range [start, stop), oldest first
+// Iteration ends early when fn returns false.
+func (store *BoltStore) Query(measurement string, start, stop time.Time, fn func(StoredPoint) bool) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(measurement))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		end := pointKey(stop, 0)
+		for key, value := cursor.Seek(pointKey(start, 0)); key != nil; key, value = cursor.Next() {
+			if string(key) >= string(end) {
+				break
+			}
+			var point StoredPoint
+			if err := json.Unmarshal(value, &point); err != nil {
+				return fmt.Errorf("failed to decode stored point: %w", err)
+			}
+			if !fn(point) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// prune deletes the points exceeding the limits, oldest first, and updates size accordingly
+func (store *BoltStore) prune(tx *bolt.Tx, size *int64) error {
+	if store.opts.MaxSize <= 0 && store.opts.MaxAge <= 0 {
+		return nil
+	}
+	var cutoff []byte
+	if store.opts.MaxAge > 0 {
+		cutoff = pointKey(time.Now().Add(-store.opts.MaxAge), 0)
+	}
+	var cursors []*bolt.Cursor
+	err := tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		cursors = append(cursors, bucket.Cursor())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	for {
+		// The oldest point of all measurements
+		var oldest *bolt.Cursor
+		var oldestKey, oldestValue []byte
+		for _, cursor := range cursors {
+			key, value := cursor.First()
+			if key != nil && (oldestKey == nil || bytes.Compare(key, oldestKey) < 0) {
+				oldest, oldestKey, oldestValue = cursor, key, value
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		tooBig := store.opts.MaxSize > 0 && *size > store.opts.MaxSize
+		tooOld := cutoff != nil && bytes.Compare(oldestKey, cutoff) < 0
+		if !tooBig && !tooOld {
+			break
+		}
+		*size -= int64(len(oldestKey) + len(oldestValue))
+		if err := oldest.Delete(); err != nil {
+			return fmt.Errorf("failed to drop point: %w", err)
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		slog.Info("Embedded store limit reached, dropped oldest points", "points", dropped, "size", *size)
+	}
+	return nil
+}
+
+// pointKey builds the time ordered key of a point
+func pointKey(timestamp time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[0:8], uint64(timestamp.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:16], seq)
+	return key
+}
+
+// toStoredPoint copies an InfluxDB point, so both sinks store the same data
+func toStoredPoint(point *influxdb_write.Point) StoredPoint {
+	stored := StoredPoint{
+		Measurement: point.Name(),
+		Tags:        make(map[string]string),
+		Fields:      make(map[string]any),
+		Time:        point.Time(),
+	}
+	for _, tag := range point.TagList() {
+		stored.Tags[tag.Key] = tag.Value
+	}
+	for _, field := range point.FieldList() {
+		stored.Fields[field.Key] = field.Value
+	}
+	return stored
+}
+
+var _ Sink = (*BoltStore)(nil)
+var _ Sink = (*InfluxDB)(nil)
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/testutils"
+)
+
+func TestBoltStore(t *testing.T) {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "store.db"), StoreOptions{})
+	require.NoError(t, err)
+
+	var messages []*generated.KiezboxMessage
+	for _, timestamp := range []int64{1672531300, 1672531200, 1672531400} {
+		message := testutils.CreateKiezboxMessage(timestamp)
+		message.Update.ArrivalTime = proto.Int64(timestamp)
+		messages = append(messages, message)
+	}
+	require.NoError(t, store.WriteBatch(context.Background(), messages))
+	require.NoError(t, store.Write(context.Background(), testutils.CreateDistressMessage(1672531200)))
+	assert.NoError(t, store.Health(context.Background()))
+
+	// Points are returned in time order and limited to the range
+	var times []int64
+	err = store.Query("core_values", time.Unix(1672531200, 0), time.Unix(1672531400, 0), func(point StoredPoint) bool {
+		times = append(times, point.Time.Unix())
+		assert.Equal(t, "1", point.Tags["box_id"])
+		return true
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1672531200, 1672531300}, times)
+
+	var distress []StoredPoint
+	require.NoError(t, store.Query("distress_events", time.Unix(0, 0), time.Now(), func(point StoredPoint) bool {
+		distress = append(distress, point)
+		return true
+	}))
+	require.Len(t, distress, 1)
+	assert.Equal(t, "smoke in the staircase", distress[0].Fields["message"])
+
+	// A closed store asks for the points to be cached
+	require.NoError(t, store.Close())
+	assert.True(t, errors.Is(store.Health(context.Background()), ErrNoConnection))
+	assert.True(t, errors.Is(store.Write(context.Background(), messages[0]), ErrNoConnection))
+}
+
+// Create a core update as received at the given time
+func arrivedMessage(timestamp int64) *generated.KiezboxMessage {
+	message := testutils.CreateKiezboxMessage(timestamp)
+	message.Update.ArrivalTime = proto.Int64(timestamp)
+	return message
+}
+
+// Count the points of a measurement in the store and return the timestamp of the oldest one
+func countPoints(t *testing.T, store *BoltStore, measurement string) (int, int64) {
+	count, oldest := 0, int64(0)
+	require.NoError(t, store.Query(measurement, time.Unix(0, 0), time.Now().Add(time.Hour), func(point StoredPoint) bool {
+		if count == 0 {
+			oldest = point.Time.Unix()
+		}
+		count++
+		return true
+	}))
+	return count, oldest
+}
+
+func TestBoltStoreRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	now := time.Now().Unix()
+	store, err := OpenBoltStore(path, StoreOptions{MaxAge: time.Hour})
+	require.NoError(t, err)
+
+	// Points older than the maximum age are dropped with the next write, of every measurement
+	require.NoError(t, store.Write(context.Background(), testutils.CreateDistressMessage(now-7200)))
+	require.NoError(t, store.WriteBatch(context.Background(), []*generated.KiezboxMessage{
+		arrivedMessage(now - 5400),
+		arrivedMessage(now - 1800),
+		arrivedMessage(now),
+	}))
+	count, oldest := countPoints(t, store, "core_values")
+	assert.Equal(t, 2, count)
+	assert.Equal(t, now-1800, oldest)
+	count, _ = countPoints(t, store, "distress_events")
+	assert.Equal(t, 0, count)
+	size := store.size
+	require.NoError(t, store.Close())
+
+	// The size is restored when the store is opened again, and the size limit drops the oldest points
+	store, err = OpenBoltStore(path, StoreOptions{MaxSize: size})
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, size, store.size)
+	for i := int64(1); i <= 10; i++ {
+		require.NoError(t, store.Write(context.Background(), arrivedMessage(now+i)))
+		assert.LessOrEqual(t, store.size, size)
+	}
+	count, oldest = countPoints(t, store, "core_values")
+	assert.Equal(t, 2, count)
+	assert.Equal(t, now+9, oldest)
+}
+
+func TestBoltStoreConcurrentWrites(t *testing.T) {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "store.db"), StoreOptions{})
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Concurrent writers (like DBWriter and DBRetry) must not lose size updates
+	var wg sync.WaitGroup
+	for writer := int64(0); writer < 8; writer++ {
+		wg.Add(1)
+		go func(writer int64) {
+			defer wg.Done()
+			for i := int64(0); i < 20; i++ {
+				assert.NoError(t, store.Write(context.Background(), arrivedMessage(1672531200+writer*100+i)))
+			}
+		}(writer)
+	}
+	wg.Wait()
+
+	var size int64
+	require.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			return bucket.ForEach(func(key, value []byte) error {
+				size += int64(len(key) + len(value))
+				return nil
+			})
+		})
+	}))
+	assert.Equal(t, size, store.size)
+}
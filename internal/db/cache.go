@@ -0,0 +1,658 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/marshal"
+)
+
+// The offline cache is an append-only log split into numbered segment files.
+// Each record is a marshalled KiezboxMessage, prefixed by its length and a CRC32 checksum (both big endian).
+// A cursor file stores up to which record the log was replayed into the database.
+const (
+	cacheSegmentPrefix = "segment-"
+	cacheSegmentSuffix = ".log"
+	cacheCursorFile    = "cursor"
+	recordHeaderSize   = 8
+	// Records larger than this are considered corrupted, KiezboxMessages are much smaller
+	maxRecordSize = 64 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CacheOptions limits the size and age of the offline cache
+type CacheOptions struct {
+	// Maximum total size of all segments in bytes, 0 disables the limit
+	MaxSize int64
+	// Maximum age of a segment (by its last write), 0 disables the limit
+	MaxAge time.Duration
+	// Size at which a new segment is started, DefaultSegmentSize if not positive
+	// It is at most MaxSize, as the active segment is never evicted.
+	SegmentSize int64
+}
+
+// DefaultSegmentSize is used if CacheOptions.SegmentSize is not set
+const DefaultSegmentSize = 1 << 20
+
+// Cursor is a position in the log
+type Cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// segment is a single log file
+type segment struct {
+	seq     uint64
+	size    int64
+	records int
+	modTime time.Time
+}
+
+// Batch is a number of records read from the replay cursor, which are consumed by committing the batch
+type Batch struct {
+	Messages []*generated.KiezboxMessage
+	// Cursor and number of consumed records of the end segment after this batch
+	end      Cursor
+	consumed int
+}
+
+// CacheStatus reports the fill level of the offline cache and the progress of replaying it
+type CacheStatus struct {
+	Pending        int        `json:"pending"`
+	Size           int64      `json:"size"`
+	Segments       int        `json:"segments"`
+	Replayed       int        `json:"replayed"`
+	Dropped        int        `json:"dropped"`
+	LastSuccess    *time.Time `json:"last_success,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorTime  *time.Time `json:"last_error_time,omitempty"`
+	ReplayFailures int        `json:"replay_failures"`
+}
+
+// Cache is the offline cache for KiezboxMessages which could not be written to the database
+type Cache struct {
+	mutex    sync.Mutex
+	dir      string
+	opts     CacheOptions
+	segments []*segment
+	active   *os.File
+	cursor   Cursor
+	// Number of records of the cursor segment in front of the cursor
+	consumed int
+	status   CacheStatus
+}
+
+// OpenCache opens (or creates) the offline cache in the given directory
+// Cached points from older versions of the gateway (one .pb file per point) are imported into the log.
+func OpenCache(dir string, opts CacheOptions) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if opts.SegmentSize <= 0 {
+		// Otherwise every record would start a new segment
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.MaxSize > 0 && opts.SegmentSize > opts.MaxSize {
+		// Otherwise the active segment alone could exceed the limit
+		opts.SegmentSize = opts.MaxSize
+	}
+	c := &Cache{dir: dir, opts: opts}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, cacheSegmentPrefix) || !strings.HasSuffix(name, cacheSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, cacheSegmentPrefix), cacheSegmentSuffix), 10, 64)
+		if err != nil {
+			slog.Warn("Ignoring unexpected file in cache directory", "file", name)
+			continue
+		}
+		records, size, err := scanSegment(c.segmentPath(seq), -1)
+		if err != nil {
+			return nil, err
+		}
+		if records == 0 {
+			os.Remove(c.segmentPath(seq))
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat cache segment: %w", err)
+		}
+		c.segments = append(c.segments, &segment{seq: seq, size: size, records: records, modTime: info.ModTime()})
+	}
+	sort.Slice(c.segments, func(i, j int) bool { return c.segments[i].seq < c.segments[j].seq })
+
+	if err := c.loadCursor(); err != nil {
+		return nil, err
+	}
+	// Always append to a fresh segment, so a torn write at the end of an old segment is never extended
+	if err := c.rotate(); err != nil {
+		return nil, err
+	}
+
+	imported, err := c.migrate()
+	if err != nil {
+		slog.Error("Failed to import legacy cache files", "dir", dir, "imported", imported, "err", err)
+	} else if imported > 0 {
+		slog.Info("Imported legacy cache files", "dir", dir, "points", imported)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// Close closes the active segment
+func (c *Cache) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.active == nil {
+		return nil
+	}
+	err := c.active.Close()
+	c.active = nil
+	return err
+}
+
+func (c *Cache) segmentPath(seq uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s%020d%s", cacheSegmentPrefix, seq, cacheSegmentSuffix))
+}
+
+// Append writes a message to the end of the log and syncs it to disk
+func (c *Cache) Append(message *generated.KiezboxMessage) error {
+	payload, err := marshal.MarshalKiezboxMessage(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message when caching: %w", err)
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.active == nil {
+		return fmt.Errorf("cache is closed")
+	}
+	current := c.segments[len(c.segments)-1]
+	if current.size > 0 && current.size+int64(len(record)) > c.opts.SegmentSize {
+		if err := c.rotateLocked(); err != nil {
+			return err
+		}
+		current = c.segments[len(c.segments)-1]
+	}
+	if _, err := c.active.Write(record); err != nil {
+		return fmt.Errorf("failed to write to cache segment: %w", err)
+	}
+	if err := c.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync cache segment: %w", err)
+	}
+	current.size += int64(len(record))
+	current.records++
+	current.modTime = time.Now()
+	c.evict()
+	return nil
+}
+
+// Next reads up to n records from the replay cursor without consuming them
+// Records which can not be unmarshalled are skipped.
+func (c *Cache) Next(n int) (*Batch, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	batch := &Batch{end: c.cursor, consumed: c.consumed}
+
+	for i := 0; i < len(c.segments) && len(batch.Messages) < n; i++ {
+		seg := c.segments[i]
+		if seg.seq < batch.end.Segment {
+			continue
+		}
+		if seg.seq > batch.end.Segment {
+			batch.end = Cursor{Segment: seg.seq}
+			batch.consumed = 0
+		}
+		if batch.end.Offset >= seg.size {
+			continue
+		}
+		file, err := os.Open(c.segmentPath(seg.seq))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cache segment: %w", err)
+		}
+		_, err = file.Seek(batch.end.Offset, io.SeekStart)
+		reader := bufio.NewReader(file)
+		for err == nil && batch.end.Offset < seg.size && len(batch.Messages) < n {
+			var payload []byte
+			payload, err = readRecord(reader)
+			if err != nil {
+				break
+			}
+			batch.end.Offset += int64(recordHeaderSize + len(payload))
+			batch.consumed++
+			message, unmarshalErr := marshal.UnmarshalKiezboxMessage(payload)
+			if unmarshalErr != nil {
+				slog.Error("Skipping unreadable cached point", "segment", seg.seq, "err", unmarshalErr)
+				continue
+			}
+			batch.Messages = append(batch.Messages, message)
+		}
+		file.Close()
+		if err != nil {
+			// The segment changed on disk since it was scanned, skip its remainder
+			slog.Error("Failed to read cache segment, skipping the rest of it", "segment", seg.seq, "err", err)
+			batch.end.Offset = seg.size
+			batch.consumed = seg.records
+		}
+	}
+	return batch, nil
+}
+
+// Commit consumes the records of a batch and removes segments which were replayed completely
+func (c *Cache) Commit(batch *Batch) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if batch.end.Segment < c.segments[0].seq {
+		// The segments of this batch were evicted in the meantime
+		return nil
+	}
+	c.cursor = batch.end
+	c.consumed = batch.consumed
+	for len(c.segments) > 1 {
+		if c.segments[0].seq < c.cursor.Segment {
+			c.removeOldest()
+			continue
+		}
+		if c.cursor.Offset < c.segments[0].size {
+			break
+		}
+		// The cursor segment was replayed completely, continue with the next one
+		c.cursor = Cursor{Segment: c.segments[1].seq}
+		c.consumed = 0
+	}
+	return c.saveCursor()
+}
+
+// Pending returns the number of records which were not replayed yet
+func (c *Cache) Pending() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pending := 0
+	for _, seg := range c.segments {
+		if seg.seq >= c.cursor.Segment {
+			pending += seg.records
+		}
+		if seg.seq == c.cursor.Segment {
+			pending -= c.consumed
+		}
+	}
+	return pending
+}
+
+// Status returns the current fill level and replay progress
+func (c *Cache) Status() CacheStatus {
+	pending := c.Pending()
+	size := c.Size()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := c.status
+	status.Pending = pending
+	status.Size = size
+	status.Segments = len(c.segments)
+	return status
+}
+
+// replayed records a successfully replayed batch
+func (c *Cache) replayed(points int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.Replayed += points
+	now := time.Now()
+	c.status.LastSuccess = &now
+}
+
+// replayFailed records a failed replay attempt
+func (c *Cache) replayFailed(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.LastError = err.Error()
+	now := time.Now()
+	c.status.LastErrorTime = &now
+	c.status.ReplayFailures++
+}
+
+// Size returns the total size of all segments in bytes
+func (c *Cache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var size int64
+	for _, seg := range c.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// rotate safely starts a new active segment
+func (c *Cache) rotate() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.rotateLocked()
+}
+
+// rotateLocked starts a new active segment. The caller has to hold the lock.
+func (c *Cache) rotateLocked() error {
+	seq := uint64(1)
+	if len(c.segments) > 0 {
+		seq = c.segments[len(c.segments)-1].seq + 1
+	}
+	file, err := os.OpenFile(c.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create cache segment: %w", err)
+	}
+	if c.active != nil {
+		c.active.Close()
+	}
+	c.active = file
+	c.segments = append(c.segments, &segment{seq: seq, modTime: time.Now()})
+	if len(c.segments) == 1 || c.segments[0].seq > c.cursor.Segment {
+		c.cursor = Cursor{Segment: c.segments[0].seq}
+		c.consumed = 0
+	}
+	return nil
+}
+
+// evict drops the oldest segments while the cache exceeds its size or age limit
+// The active segment is never dropped. The caller has to hold the lock.
+func (c *Cache) evict() {
+	for len(c.segments) > 1 {
+		oldest := c.segments[0]
+		var size int64
+		for _, seg := range c.segments {
+			size += seg.size
+		}
+		tooBig := c.opts.MaxSize > 0 && size > c.opts.MaxSize
+		tooOld := c.opts.MaxAge > 0 && time.Since(oldest.modTime) > c.opts.MaxAge
+		if !tooBig && !tooOld {
+			return
+		}
+		dropped := oldest.records
+		if oldest.seq == c.cursor.Segment {
+			dropped -= c.consumed
+		}
+		if oldest.seq < c.cursor.Segment {
+			dropped = 0
+		}
+		slog.Warn("Offline cache limit reached, dropping oldest points", "segment", oldest.seq, "points", dropped, "size", size, "too_old", tooOld)
+		c.status.Dropped += dropped
+		c.removeOldest()
+		if err := c.saveCursor(); err != nil {
+			slog.Error("Failed to save cache cursor", "err", err)
+		}
+	}
+}
+
+// removeOldest deletes the oldest segment and moves the cursor behind it. The caller has to hold the lock.
+func (c *Cache) removeOldest() {
+	oldest := c.segments[0]
+	if err := os.Remove(c.segmentPath(oldest.seq)); err != nil {
+		slog.Error("Failed to delete cache segment", "segment", oldest.seq, "err", err)
+	}
+	c.segments = c.segments[1:]
+	if c.cursor.Segment <= oldest.seq {
+		c.cursor = Cursor{Segment: c.segments[0].seq}
+		c.consumed = 0
+	}
+}
+
+// loadCursor reads the replay cursor and counts the records in front of it
+func (c *Cache) loadCursor() error {
+	content, err := os.ReadFile(filepath.Join(c.dir, cacheCursorFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read cache cursor: %w", err)
+	}
+	if err == nil {
+		if _, err := fmt.Sscanf(string(content), "%d %d", &c.cursor.Segment, &c.cursor.Offset); err != nil {
+			slog.Error("Invalid cache cursor, replaying the whole cache", "err", err)
+			c.cursor = Cursor{}
+		}
+	}
+	for _, seg := range c.segments {
+		if seg.seq < c.cursor.Segment {
+			continue
+		}
+		if seg.seq > c.cursor.Segment {
+			// The cursor segment does not exist anymore
+			c.cursor = Cursor{Segment: seg.seq}
+			c.consumed = 0
+			return nil
+		}
+		if c.cursor.Offset > seg.size {
+			c.cursor.Offset = seg.size
+		}
+		c.consumed, c.cursor.Offset, err = scanSegment(c.segmentPath(seg.seq), c.cursor.Offset)
+		return err
+	}
+	// The cursor is behind all segments, so they were replayed completely
+	for _, seg := range c.segments {
+		os.Remove(c.segmentPath(seg.seq))
+	}
+	c.segments = nil
+	c.cursor = Cursor{}
+	return nil
+}
+
+// saveCursor atomically persists the replay cursor. The caller has to hold the lock.
+func (c *Cache) saveCursor() error {
+	path := filepath.Join(c.dir, cacheCursorFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write cache cursor: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%d %d\n", c.cursor.Segment, c.cursor.Offset)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write cache cursor: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// migrate imports the points cached by older versions of the gateway as one .pb file each
+// The points are appended in the order they were recorded and the files are deleted afterwards.
+func (c *Cache) migrate() (int, error) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*.pb"))
+	if err != nil || len(paths) == 0 {
+		return 0, err
+	}
+	type legacyPoint struct {
+		path    string
+		message *generated.KiezboxMessage
+	}
+	var points []legacyPoint
+	for _, path := range paths {
+		message, err := ReadPointFromFile(path)
+		if err != nil {
+			slog.Error("Failed to read legacy cache file", "file", path, "err", err)
+			continue
+		}
+		points = append(points, legacyPoint{path: path, message: message})
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return MessageTime(points[i].message) < MessageTime(points[j].message)
+	})
+	for i, point := range points {
+		if err := c.Append(point.message); err != nil {
+			return i, err
+		}
+		// Delete every file as soon as it is imported, so it is not imported again if a later one fails
+		if err := os.Remove(point.path); err != nil {
+			slog.Error("Failed to delete legacy cache file", "file", point.path, "err", err)
+		}
+	}
+	return len(points), nil
+}
+
+// CachedMessage is a message read from the offline cache by ScanCache
+type CachedMessage struct {
+	// File of the segment or legacy cache file
+	File string
+	// Offset of the record in the segment
+	Offset int64
+	// Replayed is set for records in front of the replay cursor, which are already written to the database
+	Replayed bool
+	Message  *generated.KiezboxMessage
+}
+
+// ScanCache reads all messages of the offline cache in dir without changing it, e.g. for inspecting it
+// Legacy .pb files which were not imported yet are read after the log. Scanning stops at the first error of fn.
+func ScanCache(dir string, fn func(CachedMessage) error) error {
+	var cursor Cursor
+	if content, err := os.ReadFile(filepath.Join(dir, cacheCursorFile)); err == nil {
+		if _, err := fmt.Sscanf(string(content), "%d %d", &cursor.Segment, &cursor.Offset); err != nil {
+			slog.Error("Invalid cache cursor, showing all records as not replayed", "err", err)
+			cursor = Cursor{}
+		}
+	}
+	// The sequence numbers are zero padded, so the names sort in the order of the log
+	segments, err := filepath.Glob(filepath.Join(dir, cacheSegmentPrefix+"*"+cacheSegmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(segments)
+	for _, path := range segments {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), cacheSegmentPrefix), cacheSegmentSuffix), 10, 64)
+		if err != nil {
+			slog.Warn("Ignoring unexpected file in cache directory", "file", path)
+			continue
+		}
+		if err := scanMessages(path, func(offset int64, message *generated.KiezboxMessage) error {
+			replayed := seq < cursor.Segment || (seq == cursor.Segment && offset < cursor.Offset)
+			return fn(CachedMessage{File: path, Offset: offset, Replayed: replayed, Message: message})
+		}); err != nil {
+			return err
+		}
+	}
+
+	legacy, err := filepath.Glob(filepath.Join(dir, "*.pb"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(legacy)
+	for _, path := range legacy {
+		message, err := ReadPointFromFile(path)
+		if err != nil {
+			slog.Warn("Skipping unreadable legacy cache file", "file", path, "err", err)
+			continue
+		}
+		if err := fn(CachedMessage{File: path, Message: message}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanMessages calls fn with every message of a segment and its offset
+// Records which can not be unmarshalled are skipped, the segment ends at a torn or corrupted record.
+func scanMessages(path string, fn func(int64, *generated.KiezboxMessage) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open cache segment: %w", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		payload, err := readRecord(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("Ignoring corrupted end of cache segment", "file", path, "offset", offset, "err", err)
+			}
+			return nil
+		}
+		message, err := marshal.UnmarshalKiezboxMessage(payload)
+		if err != nil {
+			slog.Warn("Skipping cache record which can not be unmarshalled", "file", path, "offset", offset, "err", err)
+		} else if err := fn(offset, message); err != nil {
+			return err
+		}
+		offset += int64(recordHeaderSize + len(payload))
+	}
+}
+
+// MessageTime returns the time a KiezboxMessage was recorded as unix timestamp
+func MessageTime(message *generated.KiezboxMessage) int64 {
+	if message.GetUpdate() != nil {
+		if message.GetUpdate().ArrivalTime != nil {
+			return message.GetUpdate().GetArrivalTime()
+		}
+		return message.GetUpdate().GetUnixTime()
+	}
+	return message.GetDistress().GetUnixTime()
+}
+
+// readRecord reads and verifies a single record
+func readRecord(reader io.Reader) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("record length %d exceeds maximum", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+// scanSegment counts the valid records of a segment up to the given offset (-1 for the whole segment)
+// It returns the number of records and the offset after the last valid one.
+// Everything after a torn or corrupted record is ignored.
+func scanSegment(path string, until int64) (int, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open cache segment: %w", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	records := 0
+	var offset int64
+	for until < 0 || offset < until {
+		payload, err := readRecord(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("Ignoring corrupted end of cache segment", "file", path, "offset", offset, "err", err)
+			}
+			break
+		}
+		records++
+		offset += int64(recordHeaderSize + len(payload))
+	}
+	return records, offset, nil
+}
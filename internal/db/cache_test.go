@@ -0,0 +1,209 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kiezbox/internal/marshal"
+	"kiezbox/testutils"
+)
+
+func appendMessages(t *testing.T, cache *Cache, timestamps ...int64) {
+	for _, timestamp := range timestamps {
+		require.NoError(t, cache.Append(testutils.CreateKiezboxMessage(timestamp)))
+	}
+}
+
+func nextTimestamps(t *testing.T, cache *Cache, n int) ([]int64, *Batch) {
+	batch, err := cache.Next(n)
+	require.NoError(t, err)
+	var timestamps []int64
+	for _, message := range batch.Messages {
+		timestamps = append(timestamps, message.Update.UnixTime)
+	}
+	return timestamps, batch
+}
+
+func TestCacheReplayOrder(t *testing.T) {
+	dir := t.TempDir()
+	// Small segments, so the records are spread over several files
+	cache, err := OpenCache(dir, CacheOptions{SegmentSize: 100})
+	require.NoError(t, err)
+	appendMessages(t, cache, 1, 2, 3, 4, 5)
+	assert.Equal(t, 5, cache.Pending())
+
+	timestamps, batch := nextTimestamps(t, cache, 2)
+	assert.Equal(t, []int64{1, 2}, timestamps)
+	// Reading without committing does not consume
+	timestamps, _ = nextTimestamps(t, cache, 2)
+	assert.Equal(t, []int64{1, 2}, timestamps)
+	require.NoError(t, cache.Commit(batch))
+	assert.Equal(t, 3, cache.Pending())
+	require.NoError(t, cache.Close())
+
+	// The cursor survives a restart
+	cache, err = OpenCache(dir, CacheOptions{SegmentSize: 100})
+	require.NoError(t, err)
+	defer cache.Close()
+	assert.Equal(t, 3, cache.Pending())
+	appendMessages(t, cache, 6)
+	timestamps, batch = nextTimestamps(t, cache, 10)
+	assert.Equal(t, []int64{3, 4, 5, 6}, timestamps)
+	require.NoError(t, cache.Commit(batch))
+	assert.Equal(t, 0, cache.Pending())
+
+	// Replayed segments are removed
+	segments, _ := filepath.Glob(filepath.Join(dir, cacheSegmentPrefix+"*"))
+	assert.Len(t, segments, 1)
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache, err := OpenCache(t.TempDir(), CacheOptions{SegmentSize: 60, MaxSize: 150})
+	require.NoError(t, err)
+	defer cache.Close()
+	appendMessages(t, cache, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	assert.LessOrEqual(t, cache.Size(), int64(150))
+	timestamps, _ := nextTimestamps(t, cache, 10)
+	// The oldest points were dropped, the newest are kept in order
+	assert.Less(t, len(timestamps), 10)
+	assert.Equal(t, int64(10), timestamps[len(timestamps)-1])
+	assert.Equal(t, len(timestamps), cache.Pending())
+	for i := 1; i < len(timestamps); i++ {
+		assert.Equal(t, timestamps[i-1]+1, timestamps[i])
+	}
+}
+
+func TestCacheSegmentLargerThanMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenCache(dir, CacheOptions{SegmentSize: 1 << 20, MaxSize: 150})
+	require.NoError(t, err)
+	defer cache.Close()
+	appendMessages(t, cache, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	// The segments are limited to the maximum size, so the oldest ones are still evicted
+	assert.LessOrEqual(t, cache.Size(), int64(150))
+	timestamps, _ := nextTimestamps(t, cache, 10)
+	assert.Less(t, len(timestamps), 10)
+	assert.Equal(t, int64(10), timestamps[len(timestamps)-1])
+}
+
+func TestCacheTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenCache(dir, CacheOptions{SegmentSize: 1024})
+	require.NoError(t, err)
+	appendMessages(t, cache, 1, 2)
+	require.NoError(t, cache.Close())
+
+	// Simulate a crash in the middle of writing a record
+	segments, _ := filepath.Glob(filepath.Join(dir, cacheSegmentPrefix+"*"))
+	require.Len(t, segments, 1)
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 42, 1, 2, 3})
+	require.NoError(t, err)
+	file.Close()
+
+	cache, err = OpenCache(dir, CacheOptions{SegmentSize: 1024})
+	require.NoError(t, err)
+	defer cache.Close()
+	appendMessages(t, cache, 3)
+	assert.Equal(t, 3, cache.Pending())
+	timestamps, _ := nextTimestamps(t, cache, 10)
+	assert.Equal(t, []int64{1, 2, 3}, timestamps)
+}
+
+func TestScanCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenCache(dir, CacheOptions{SegmentSize: 100})
+	require.NoError(t, err)
+	appendMessages(t, cache, 1, 2, 3, 4)
+	_, batch := nextTimestamps(t, cache, 3)
+	require.NoError(t, cache.Commit(batch))
+	require.NoError(t, cache.Close())
+	// A legacy file which was not imported yet
+	legacy, err := marshal.MarshalKiezboxMessage(testutils.CreateKiezboxMessage(5))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "5.pb"), legacy, 0644))
+	before, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var timestamps []int64
+	var replayed []bool
+	err = ScanCache(dir, func(cached CachedMessage) error {
+		timestamps = append(timestamps, cached.Message.Update.UnixTime)
+		replayed = append(replayed, cached.Replayed)
+		return nil
+	})
+	require.NoError(t, err)
+	// Replayed segments may already be gone, the pending records and the legacy file are always read
+	assert.Equal(t, []int64{4, 5}, timestamps[len(timestamps)-2:])
+	assert.Equal(t, []bool{false, false}, replayed[len(replayed)-2:])
+	for i := range timestamps[:len(timestamps)-2] {
+		assert.True(t, replayed[i])
+	}
+
+	// The cache is left unchanged
+	after, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = ScanCache(dir, func(CachedMessage) error {
+		calls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+
+	// An unreadable cursor is logged and every record is shown as not replayed
+	require.NoError(t, os.WriteFile(filepath.Join(dir, cacheCursorFile), []byte("99 garbage"), 0644))
+	err = ScanCache(dir, func(cached CachedMessage) error {
+		assert.False(t, cached.Replayed)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCacheDefaultSegmentSize(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenCache(dir, CacheOptions{})
+	require.NoError(t, err)
+	defer cache.Close()
+	appendMessages(t, cache, 1, 2, 3, 4, 5)
+
+	// Without a segment size every record used to start a new segment
+	segments, _ := filepath.Glob(filepath.Join(dir, cacheSegmentPrefix+"*"))
+	assert.Len(t, segments, 1)
+	assert.Equal(t, 5, cache.Pending())
+}
+
+func TestCacheRegisterMetrics(t *testing.T) {
+	cache, err := OpenCache(t.TempDir(), CacheOptions{SegmentSize: 100})
+	require.NoError(t, err)
+	defer cache.Close()
+	appendMessages(t, cache, 1, 2, 3)
+
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, cache.RegisterMetrics(registry))
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP kiezbox_cache_pending_points Points in the offline cache waiting to be replayed
+# TYPE kiezbox_cache_pending_points gauge
+kiezbox_cache_pending_points 3
+`), "kiezbox_cache_pending_points"))
+
+	// A second cache can not silently replace the metrics of the first one
+	other, err := OpenCache(t.TempDir(), CacheOptions{})
+	require.NoError(t, err)
+	defer other.Close()
+	assert.Error(t, other.RegisterMetrics(registry))
+}
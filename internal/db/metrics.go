@@ -0,0 +1,287 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Measurements which can be read back through the metrics API
+var MetricMeasurements = []string{"core_values", "sensor_values"}
+
+// Aggregations which can be used for downsampling
+var MetricAggregates = []string{"mean", "min", "max", "last"}
+
+// ErrInvalidQuery is returned when a metrics query does not pass validation
+var ErrInvalidQuery = errors.New("invalid query")
+
+// MetricsQuery describes a read of sensor history
+// Queries are never built from raw strings, every value is validated before it ends up in Flux.
+type MetricsQuery struct {
+	Measurement string
+	// Filters on the KiezboxMessage_Meta tags (box_id, dist_id, sens_id, dev_type)
+	Tags  map[string]string
+	Start time.Time
+	Stop  time.Time
+	// Downsampling window, 0 returns the raw points
+	Window    time.Duration
+	Aggregate string
+}
+
+// MetricRow holds all values of one series at one point in time
+type MetricRow struct {
+	Time   time.Time          `json:"time"`
+	Tags   map[string]string  `json:"tags"`
+	Values map[string]float64 `json:"values"`
+}
+
+// Querier is implemented by sinks which can read back their history
+type Querier interface {
+	QueryMetrics(ctx context.Context, query MetricsQuery) ([]MetricRow, error)
+}
+
+// MetaTags returns the names of the tags written for KiezboxMessage_Meta
+func MetaTags() []string {
+	var names []string
+	fields := (&generated.KiezboxMessage_Meta{}).ProtoReflect().Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		names = append(names, string(fields.Get(i).Name()))
+	}
+	return names
+}
+
+// Validate checks the query and normalizes its tag values to the form they are stored in
+// Enum tags (dev_type) may be given by name or number.
+func (query *MetricsQuery) Validate() error {
+	if !contains(MetricMeasurements, query.Measurement) {
+		return fmt.Errorf("%w: unknown measurement %q", ErrInvalidQuery, query.Measurement)
+	}
+	if !query.Stop.After(query.Start) {
+		return fmt.Errorf("%w: stop has to be after start", ErrInvalidQuery)
+	}
+
+	fields := (&generated.KiezboxMessage_Meta{}).ProtoReflect().Descriptor().Fields()
+	for name, value := range query.Tags {
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			return fmt.Errorf("%w: unknown tag %q", ErrInvalidQuery, name)
+		}
+		if fd.Kind() == protoreflect.EnumKind {
+			if enumValue := fd.Enum().Values().ByName(protoreflect.Name(value)); enumValue != nil {
+				value = strconv.Itoa(int(enumValue.Number()))
+			}
+		}
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return fmt.Errorf("%w: invalid value %q for tag %s", ErrInvalidQuery, value, name)
+		}
+		query.Tags[name] = value
+	}
+
+	if query.Window < 0 || query.Window%time.Second != 0 {
+		return fmt.Errorf("%w: window has to be a positive number of seconds", ErrInvalidQuery)
+	}
+	if query.Aggregate != "" && !contains(MetricAggregates, query.Aggregate) {
+		return fmt.Errorf("%w: unknown aggregate %q, expected one of %s", ErrInvalidQuery, query.Aggregate, strings.Join(MetricAggregates, ", "))
+	}
+	if query.Window > 0 && query.Aggregate == "" {
+		query.Aggregate = "mean"
+	}
+	// Aggregating without a window aggregates the whole time range
+	if query.Window == 0 && query.Aggregate != "" {
+		query.Window = query.Stop.Sub(query.Start).Truncate(time.Second)
+		if query.Window < time.Second {
+			query.Window = time.Second
+		}
+	}
+	return nil
+}
+
+// Flux builds the Flux query for a validated MetricsQuery
+func (query MetricsQuery) Flux(bucket string) string {
+	var flux strings.Builder
+	fmt.Fprintf(&flux, "from(bucket: %s)\n", strconv.Quote(bucket))
+	fmt.Fprintf(&flux, "  |> range(start: %s, stop: %s)\n", query.Start.UTC().Format(time.RFC3339Nano), query.Stop.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&flux, "  |> filter(fn: (r) => r._measurement == %s)\n", strconv.Quote(query.Measurement))
+	flux.WriteString("  |> filter(fn: (r) => r._field != \"time_arrival\")\n")
+	for _, name := range sortedKeys(query.Tags) {
+		fmt.Fprintf(&flux, "  |> filter(fn: (r) => r[%s] == %s)\n", strconv.Quote(name), strconv.Quote(query.Tags[name]))
+	}
+	if query.Aggregate != "" {
+		// Windows are aligned to the start of the range
+		offset := query.Start.UnixNano() % int64(query.Window)
+		fmt.Fprintf(&flux, "  |> aggregateWindow(every: %ds, offset: %dns, fn: %s, createEmpty: false, timeSrc: \"_start\")\n", int64(query.Window/time.Second), offset, query.Aggregate)
+	}
+	flux.WriteString("  |> pivot(rowKey: [\"_time\"], columnKey: [\"_field\"], valueColumn: \"_value\")\n")
+	return flux.String()
+}
+
+// QueryMetrics reads sensor history from the InfluxDB bucket
+func (db *InfluxDB) QueryMetrics(ctx context.Context, query MetricsQuery) ([]MetricRow, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	result, err := db.QueryAPI.Query(ctx, query.Flux(db.Bucket))
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %w", err)
+	}
+	defer result.Close()
+
+	tags := MetaTags()
+	var rows []MetricRow
+	for result.Next() {
+		row := MetricRow{
+			Time:   result.Record().Time(),
+			Tags:   make(map[string]string),
+			Values: make(map[string]float64),
+		}
+		for column, value := range result.Record().Values() {
+			if contains(tags, column) {
+				if tag, ok := value.(string); ok {
+					row.Tags[column] = tag
+				}
+				continue
+			}
+			if strings.HasPrefix(column, "_") || column == "result" || column == "table" {
+				continue
+			}
+			if number, ok := value.(float64); ok {
+				row.Values[column] = number
+			}
+		}
+		rows = append(rows, row)
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("error reading query result: %w", result.Err())
+	}
+	sortRows(rows)
+	return rows, nil
+}
+
+// QueryMetrics reads sensor history from the embedded store, downsampling like aggregateWindow in Flux
+func (store *BoltStore) QueryMetrics(ctx context.Context, query MetricsQuery) ([]MetricRow, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	type aggregate struct {
+		sum, min, max, last float64
+		count               int
+	}
+	type window struct {
+		row        MetricRow
+		aggregates map[string]*aggregate
+	}
+	windows := make(map[string]*window)
+	var rows []MetricRow
+
+	err := store.Query(query.Measurement, query.Start, query.Stop, func(point StoredPoint) bool {
+		for name, value := range query.Tags {
+			if point.Tags[name] != value {
+				return true
+			}
+		}
+		values := make(map[string]float64)
+		for name, value := range point.Fields {
+			if number, ok := value.(float64); ok {
+				values[name] = number
+			}
+		}
+		if query.Aggregate == "" {
+			rows = append(rows, MetricRow{Time: point.Time, Tags: point.Tags, Values: values})
+			return true
+		}
+
+		// Windows are aligned to the start of the range
+		start := query.Start.Add(point.Time.Sub(query.Start) / query.Window * query.Window)
+		key := start.String() + seriesKey(point.Tags)
+		w, ok := windows[key]
+		if !ok {
+			w = &window{row: MetricRow{Time: start, Tags: point.Tags}, aggregates: make(map[string]*aggregate)}
+			windows[key] = w
+		}
+		for name, value := range values {
+			agg, ok := w.aggregates[name]
+			if !ok {
+				agg = &aggregate{min: math.Inf(1), max: math.Inf(-1)}
+				w.aggregates[name] = agg
+			}
+			agg.sum += value
+			agg.count++
+			agg.min = math.Min(agg.min, value)
+			agg.max = math.Max(agg.max, value)
+			agg.last = value
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, w := range windows {
+		w.row.Values = make(map[string]float64)
+		for name, agg := range w.aggregates {
+			switch query.Aggregate {
+			case "mean":
+				w.row.Values[name] = agg.sum / float64(agg.count)
+			case "min":
+				w.row.Values[name] = agg.min
+			case "max":
+				w.row.Values[name] = agg.max
+			case "last":
+				w.row.Values[name] = agg.last
+			}
+		}
+		rows = append(rows, w.row)
+	}
+	sortRows(rows)
+	return rows, nil
+}
+
+// sortRows orders rows by time and series
+func sortRows(rows []MetricRow) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if !rows[i].Time.Equal(rows[j].Time) {
+			return rows[i].Time.Before(rows[j].Time)
+		}
+		return seriesKey(rows[i].Tags) < seriesKey(rows[j].Tags)
+	})
+}
+
+// seriesKey identifies a series by its tags
+func seriesKey(tags map[string]string) string {
+	var key strings.Builder
+	for _, name := range sortedKeys(tags) {
+		fmt.Fprintf(&key, ",%s=%s", name, tags[name])
+	}
+	return key.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+var _ Querier = (*InfluxDB)(nil)
+var _ Querier = (*BoltStore)(nil)
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/testutils"
+)
+
+func TestMetricsQueryValidate(t *testing.T) {
+	start := time.Unix(1672531200, 0)
+	tests := []struct {
+		name        string
+		query       MetricsQuery
+		expectedErr bool
+		expectedTag string
+	}{
+		{
+			name:  "Valid raw query",
+			query: MetricsQuery{Measurement: "core_values", Tags: map[string]string{"box_id": "1"}},
+		},
+		{
+			name:        "Device type by name",
+			query:       MetricsQuery{Measurement: "sensor_values", Tags: map[string]string{"dev_type": "sensor"}},
+			expectedTag: "1",
+		},
+		{
+			name:        "Unknown measurement",
+			query:       MetricsQuery{Measurement: "distress_events"},
+			expectedErr: true,
+		},
+		{
+			name:        "Unknown tag",
+			query:       MetricsQuery{Measurement: "core_values", Tags: map[string]string{"_measurement": "x"}},
+			expectedErr: true,
+		},
+		{
+			name:        "Injected tag value",
+			query:       MetricsQuery{Measurement: "core_values", Tags: map[string]string{"box_id": `1") or (r._value > 0`}},
+			expectedErr: true,
+		},
+		{
+			name:        "Unknown aggregate",
+			query:       MetricsQuery{Measurement: "core_values", Aggregate: "median"},
+			expectedErr: true,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.query.Start = start
+			testCase.query.Stop = start.Add(time.Hour)
+			err := testCase.query.Validate()
+			if testCase.expectedErr {
+				assert.True(t, errors.Is(err, ErrInvalidQuery), "expected ErrInvalidQuery, got %v", err)
+				return
+			}
+			assert.NoError(t, err)
+			if testCase.expectedTag != "" {
+				assert.Equal(t, testCase.expectedTag, testCase.query.Tags["dev_type"])
+			}
+		})
+	}
+}
+
+func TestMetricsQueryFlux(t *testing.T) {
+	query := MetricsQuery{
+		Measurement: "core_values",
+		Tags:        map[string]string{"dist_id": "2", "box_id": "1"},
+		Start:       time.Unix(1672531200, 0),
+		Stop:        time.Unix(1672534800, 0),
+		Window:      5 * time.Minute,
+	}
+	require.NoError(t, query.Validate())
+	assert.Equal(t, `from(bucket: "test-bucket")
+  |> range(start: 2023-01-01T00:00:00Z, stop: 2023-01-01T01:00:00Z)
+  |> filter(fn: (r) => r._measurement == "core_values")
+  |> filter(fn: (r) => r._field != "time_arrival")
+  |> filter(fn: (r) => r["box_id"] == "1")
+  |> filter(fn: (r) => r["dist_id"] == "2")
+  |> aggregateWindow(every: 300s, offset: 0ns, fn: mean, createEmpty: false, timeSrc: "_start")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+`, query.Flux("test-bucket"))
+}
+
+func TestInfluxDBQueryMetrics(t *testing.T) {
+	response := `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,string,string,string,double,double
+#group,false,false,true,true,false,true,true,true,false,false
+#default,_result,,,,,,,,,
+,result,table,_start,_stop,_time,_measurement,box_id,dist_id,temp_in,temp_out
+,,0,2023-01-01T00:00:00Z,2023-01-01T01:00:00Z,2023-01-01T00:05:00Z,core_values,1,2,21.5,12.25
+,,0,2023-01-01T00:00:00Z,2023-01-01T01:00:00Z,2023-01-01T00:00:00Z,core_values,1,2,21,12
+
+`
+	mockQueryAPI := new(MockQueryAPI)
+	mockQueryAPI.On("Query", mock.Anything, mock.Anything).Return(api.NewQueryTableResult(io.NopCloser(strings.NewReader(response))), nil)
+	db := &InfluxDB{QueryAPI: mockQueryAPI, Bucket: "test-bucket"}
+
+	rows, err := db.QueryMetrics(context.Background(), MetricsQuery{
+		Measurement: "core_values",
+		Tags:        map[string]string{"box_id": "1"},
+		Start:       time.Unix(1672531200, 0),
+		Stop:        time.Unix(1672534800, 0),
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, time.Unix(1672531200, 0).UTC(), rows[0].Time)
+	assert.Equal(t, map[string]string{"box_id": "1", "dist_id": "2"}, rows[0].Tags)
+	assert.Equal(t, map[string]float64{"temp_in": 21, "temp_out": 12}, rows[0].Values)
+	assert.Equal(t, 21.5, rows[1].Values["temp_in"])
+	mockQueryAPI.AssertCalled(t, "Query", mock.Anything, mock.MatchedBy(func(query string) bool {
+		return strings.Contains(query, `r["box_id"] == "1"`)
+	}))
+}
+
+func TestBoltStoreQueryMetrics(t *testing.T) {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "store.db"), StoreOptions{})
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Three minutes with a reading every 30 seconds
+	var messages []*generated.KiezboxMessage
+	for i := int64(0); i < 6; i++ {
+		message := testutils.CreateKiezboxMessage(1672531200 + i*30)
+		message.Update.ArrivalTime = proto.Int64(1672531200 + i*30)
+		message.Update.Core.Values.TempIn = proto.Int32(int32(20000 + i*1000))
+		messages = append(messages, message)
+	}
+	other := testutils.CreateKiezboxMessage(1672531200)
+	other.Update.ArrivalTime = proto.Int64(1672531200)
+	other.Update.Meta.BoxId = proto.Uint32(7)
+	messages = append(messages, other)
+	require.NoError(t, store.WriteBatch(context.Background(), messages))
+
+	query := MetricsQuery{
+		Measurement: "core_values",
+		Tags:        map[string]string{"box_id": "1"},
+		Start:       time.Unix(1672531200, 0),
+		Stop:        time.Unix(1672531380, 0),
+	}
+	rows, err := store.QueryMetrics(context.Background(), query)
+	require.NoError(t, err)
+	require.Len(t, rows, 6)
+	assert.Equal(t, 20.0, rows[0].Values["temp_in"])
+
+	query.Window = time.Minute
+	query.Aggregate = "max"
+	rows, err = store.QueryMetrics(context.Background(), query)
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, time.Unix(1672531260, 0).UTC(), rows[1].Time.UTC())
+	assert.Equal(t, []float64{21, 23, 25}, []float64{rows[0].Values["temp_in"], rows[1].Values["temp_in"], rows[2].Values["temp_in"]})
+
+	query.Window = 0
+	query.Aggregate = "mean"
+	rows, err = store.QueryMetrics(context.Background(), query)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, 22.5, rows[0].Values["temp_in"])
+}
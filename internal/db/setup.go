@@ -45,6 +45,7 @@ func CreateClient() *InfluxDB {
 }
 
 // Close the InfluxDB client when no longer needed
-func (db *InfluxDB) Close() {
+func (db *InfluxDB) Close() error {
 	db.Client.Close()
+	return nil
 }
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cfg "kiezbox/internal/config"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Sink is a storage backend for KiezboxMessages
+// Errors wrapping ErrNoConnection mean the message could not be stored right now and should be cached,
+// any other error means the message was rejected and retrying it is pointless.
+type Sink interface {
+	// Write stores a single message
+	Write(ctx context.Context, message *generated.KiezboxMessage) error
+	// WriteBatch stores several messages at once, messages which can not be converted are skipped
+	WriteBatch(ctx context.Context, messages []*generated.KiezboxMessage) error
+	// Health returns nil if the sink is able to store messages
+	Health(ctx context.Context) error
+	// Close releases the resources of the sink
+	Close() error
+}
+
+// SinkFactory creates a storage sink from the config
+type SinkFactory func() (Sink, error)
+
+// Sinks selectable with the sink option, packages outside of db add theirs with RegisterSink
+var sinkFactories = map[string]SinkFactory{
+	"influxdb": func() (Sink, error) { return CreateClient(), nil },
+	"bolt": func() (Sink, error) {
+		return OpenBoltStore(cfg.Cfg.StorePath, StoreOptions{MaxSize: cfg.Cfg.StoreMaxSize, MaxAge: cfg.Cfg.StoreMaxAge})
+	},
+}
+
+// RegisterSink makes a sink selectable by name in the config
+func RegisterSink(name string, factory SinkFactory) {
+	sinkFactories[name] = factory
+}
+
+// OpenSink creates the storage backend selected in the config
+func OpenSink() (Sink, error) {
+	name := cfg.Cfg.Sink
+	if name == "" {
+		name = "influxdb"
+	}
+	factory, ok := sinkFactories[name]
+	if !ok {
+		names := sortedKeys(sinkFactories)
+		return nil, fmt.Errorf("unknown sink %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return factory()
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"kiezbox/internal/metrics"
+)
+
+// Database internals exported for Prometheus
+var (
+	writeDuration = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kiezbox_db_write_duration_seconds",
+		Help:    "Duration of writes to the storage sink",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
+	writeErrors = metrics.Factory.NewCounterVec(prometheus.CounterOpts{Name: "kiezbox_db_write_errors_total", Help: "Failed writes to the storage sink"}, []string{"reason"})
+)
+
+// ObserveWrite records the duration and outcome of a write to a sink
+func ObserveWrite(start time.Time, err error) {
+	writeDuration.Observe(time.Since(start).Seconds())
+	if errors.Is(err, ErrNoConnection) {
+		writeErrors.WithLabelValues("connection").Inc()
+	} else if err != nil {
+		writeErrors.WithLabelValues("rejected").Inc()
+	}
+}
+
+// RegisterMetrics exports the fill level of the offline cache to the registerer
+func (c *Cache) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "kiezbox_cache_pending_points", Help: "Points in the offline cache waiting to be replayed"}, func() float64 {
+			return float64(c.Pending())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "kiezbox_cache_segments", Help: "Segment files of the offline cache"}, func() float64 {
+			return float64(c.Status().Segments)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "kiezbox_cache_size_bytes", Help: "Size of the offline cache on disk"}, func() float64 {
+			return float64(c.Size())
+		}),
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,11 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strconv"
 	"time"
 
-	"github.com/google/uuid"
 	influxdb "github.com/influxdata/influxdb-client-go/v2"
+	influxdb_http "github.com/influxdata/influxdb-client-go/v2/api/http"
 	influxdb_write "github.com/influxdata/influxdb-client-go/v2/api/write"
 	"google.golang.org/protobuf/reflect/protoreflect"
 
@@ -18,50 +18,6 @@ import (
 	"log/slog"
 )
 
-// WritePointToDatabase writes an InfluxDB point to the InfluxDB bucket
-func (db *InfluxDB) WritePointToDatabase(point *influxdb_write.Point) error {
-	// Set a timeout
-	ctx, cancel := context.WithTimeout(context.Background(), db.Timeout)
-	defer cancel()
-
-	// Try writing in the database with context
-	err := db.WriteAPI.WritePoint(ctx, point)
-	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			slog.Error("Database connection timed out")
-			return fmt.Errorf("database connection timed out: %w", ctx.Err())
-		} else {
-			slog.Error("Data error", "err", err)
-		}
-	}
-	return nil
-}
-
-// WritePointToFile writes a point as Protobuf message to a file in the given directory
-func WritePointToFile(message *generated.KiezboxMessage, dir string) error {
-	// Create a filename
-	filename := fmt.Sprintf("%s.pb", uuid.New().String())
-
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory when caching: %w", err)
-	}
-
-	// Marshal the message
-	marshalledMessage, err := marshal.MarshalKiezboxMessage(message)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message when caching: %w", err)
-	}
-
-	// Write to file
-	filePath := filepath.Join(dir, filename)
-	if err := os.WriteFile(filePath, marshalledMessage, 0666); err != nil {
-		return fmt.Errorf("failed to save cached message to file: %w", err)
-	}
-
-	return nil
-}
-
 // ReadPointFromFile reads a marshalled Protobuf message from a file and unmarshals it.
 func ReadPointFromFile(filepath string) (*generated.KiezboxMessage, error) {
 	// Read the file content
@@ -79,50 +35,136 @@ func ReadPointFromFile(filepath string) (*generated.KiezboxMessage, error) {
 	return message, nil
 }
 
-// RetryCachedPoints reads cached points from a directory and retries writing them to the database
-func (db *InfluxDB) RetryCachedPoints(dir string) {
-	// Read the directory
-	files, err := os.ReadDir(dir)
+// ErrNoConnection is returned when a write failed because the database could not be reached
+var ErrNoConnection = errors.New("no connection to database")
+
+// WritePointsToDatabase writes a batch of InfluxDB points with a single request
+// Points rejected by the database are logged and dropped, only connection failures are returned.
+func (db *InfluxDB) WritePointsToDatabase(ctx context.Context, points ...*influxdb_write.Point) error {
+	ctx, cancel := context.WithTimeout(ctx, db.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := db.WriteAPI.WritePoint(ctx, points...)
+	if err == nil {
+		ObserveWrite(start, nil)
+		return nil
+	}
+	if isConnectionError(err) {
+		err = fmt.Errorf("%w: %w", ErrNoConnection, err)
+		ObserveWrite(start, err)
+		return err
+	}
+	ObserveWrite(start, err)
+	slog.Error("Data error", "points", len(points), "err", err)
+	return nil
+}
+
+// isConnectionError tells apart connection failures from points rejected by the database
+func isConnectionError(err error) bool {
+	var httpErr *influxdb_http.Error
+	if errors.As(err, &httpErr) && httpErr.StatusCode != 0 {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == 429
+	}
+	// Anything else (including timeouts) failed before the database answered
+	return true
+}
+
+// Write converts a KiezboxMessage and writes it to the InfluxDB bucket
+func (db *InfluxDB) Write(ctx context.Context, message *generated.KiezboxMessage) error {
+	point, err := KiezboxMessageToPoint(message)
 	if err != nil {
-		slog.Error("Failed to read caching directory", "dir", dir, "err", err)
-		return
+		return fmt.Errorf("failed to convert message to point: %w", err)
 	}
+	return db.WritePointsToDatabase(ctx, point)
+}
 
-	// Iterate over the files and read the points
-	for _, file := range files {
-		filePath := filepath.Join(dir, file.Name())
-		message, err := ReadPointFromFile(filePath) // Read and unmarshal Protobuf message
+// WriteBatch converts several KiezboxMessages and writes them to the InfluxDB bucket with a single request
+func (db *InfluxDB) WriteBatch(ctx context.Context, messages []*generated.KiezboxMessage) error {
+	points := make([]*influxdb_write.Point, 0, len(messages))
+	for _, message := range messages {
+		point, err := KiezboxMessageToPoint(message)
 		if err != nil {
-			slog.Error("Failed to read file", "file", filePath, "err", err)
-			continue
+			slog.Error("Failed to convert message to point", "err", err)
+			continue // Skip this point and move to the next
 		}
+		points = append(points, point)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	return db.WritePointsToDatabase(ctx, points...)
+}
 
-		// Convert the Protobuf message to an InfluxDB point
-		point, err := KiezboxMessageToPoint(message)
+// Health checks whether the InfluxDB instance is reachable
+func (db *InfluxDB) Health(ctx context.Context) error {
+	connected, err := db.Client.Ping(ctx)
+	if !connected {
+		if err == nil {
+			return ErrNoConnection
+		}
+		return fmt.Errorf("%w: %w", ErrNoConnection, err)
+	}
+	return nil
+}
+
+// RetryCachedPoints replays the offline cache into the sink in batches, oldest points first
+// rate limits the replay to that many points per second (0 for no limit).
+// Replaying stops at the first connection failure, so the remaining points stay cached.
+func RetryCachedPoints(ctx context.Context, sink Sink, cache *Cache, batchSize int, rate float64) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	for ctx.Err() == nil {
+		batch, err := cache.Next(batchSize)
 		if err != nil {
-			slog.Error("Failed to convert message to point", "err", err)
-			continue // Skip this file and move to the next
+			slog.Error("Failed to read offline cache", "err", err)
+			cache.replayFailed(err)
+			return
+		}
+		if len(batch.Messages) == 0 {
+			return
 		}
 
-		// Write the message to the database
-		err = db.WritePointToDatabase(point)
+		// Keep the batch cached if the connection to the sink failed
+		err = sink.WriteBatch(ctx, batch.Messages)
+		if errors.Is(err, ErrNoConnection) {
+			slog.Warn("Replaying cached points failed, retrying later", "err", err)
+			cache.replayFailed(err)
+			return
+		} else if err != nil {
+			slog.Error("Cached points were rejected, dropping them", "err", err)
+		}
 
-		// Cache message if connection to database failed
-		if err == nil || !errors.Is(err, context.DeadlineExceeded) {
-			// Delete the file
-			if err := os.Remove(filePath); err != nil {
-				slog.Error("Failed to delete cached point", "file", filePath, "err", err)
-			} else {
-				slog.Info("Successfully deleted cached point", "file", filePath)
+		if err := cache.Commit(batch); err != nil {
+			slog.Error("Failed to update offline cache cursor", "err", err)
+			cache.replayFailed(err)
+			return
+		}
+		cache.replayed(len(batch.Messages))
+		slog.Info("Replayed cached points", "points", len(batch.Messages), "remaining", cache.Pending())
+
+		// Wait before the next batch to not flood the uplink
+		if rate > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(float64(len(batch.Messages)) / rate * float64(time.Second))):
 			}
 		}
 	}
 }
 
+// KiezboxMessageToPoint converts an Update or Distress KiezboxMessage into an InfluxDB point
 func KiezboxMessageToPoint(message *generated.KiezboxMessage) (*influxdb_write.Point, error) {
+	if message.Update == nil {
+		if message.Distress != nil {
+			return distressToPoint(message.Distress), nil
+		}
+		return nil, fmt.Errorf("KiezboxMessage contains neither Update nor Distress")
+	}
 	tags := make(map[string]string)
 	fields := make(map[string]any)
-	var measurement string
+	measurement := Measurement(message)
 
 	// Iterate over the meta data and add them to the tags
 	meta_reflect := message.Update.Meta.ProtoReflect()
@@ -134,7 +176,6 @@ func KiezboxMessageToPoint(message *generated.KiezboxMessage) (*influxdb_write.P
 
 	// Iterate over the values and add them to the fields
 	if message.Update.Core != nil {
-		measurement = "core_values"
 		core_reflect := message.Update.Core.Values.ProtoReflect()
 		core_reflect.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
 			if intVal, ok := v.Interface().(int32); ok {
@@ -145,7 +186,6 @@ func KiezboxMessageToPoint(message *generated.KiezboxMessage) (*influxdb_write.P
 			return true // Continue iteration
 		})
 	} else if message.Update.Sensor != nil {
-		measurement = "sensor_values"
 		sensor_reflect := message.Update.Sensor.Values.ProtoReflect()
 		sensor_reflect.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
 			if intVal, ok := v.Interface().(int32); ok {
@@ -174,3 +214,36 @@ func KiezboxMessageToPoint(message *generated.KiezboxMessage) (*influxdb_write.P
 
 	return point, nil
 }
+
+// Measurement returns the measurement a KiezboxMessage is written to, or "" for messages which are not stored
+func Measurement(message *generated.KiezboxMessage) string {
+	switch {
+	case message.GetUpdate().GetCore() != nil:
+		return "core_values"
+	case message.GetUpdate().GetSensor() != nil:
+		return "sensor_values"
+	case message.GetDistress() != nil:
+		return "distress_events"
+	}
+	return ""
+}
+
+// distressToPoint converts an emergency event into an InfluxDB point of the distress_events measurement
+func distressToPoint(distress *generated.KiezboxMessage_Emergency) *influxdb_write.Point {
+	tags := map[string]string{
+		"type":      distress.GetType().String(),
+		"button_id": strconv.Itoa(int(distress.GetButtonId())),
+	}
+	fields := map[string]any{
+		"button_id": int64(distress.GetButtonId()),
+		"message":   distress.GetMessage(),
+	}
+
+	// Fall back to the current time if the button did not send a timestamp
+	timestamp := time.Unix(distress.GetUnixTime(), 0)
+	if distress.GetUnixTime() == 0 {
+		timestamp = time.Now()
+	}
+
+	return influxdb.NewPoint("distress_events", tags, fields, timestamp)
+}
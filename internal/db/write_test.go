@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	influxdb_http "github.com/influxdata/influxdb-client-go/v2/api/http"
 	influxdb_write "github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -68,123 +69,53 @@ func (m *MockMarshal) MarshalKiezboxMessage(message *generated.KiezboxMessage) (
 	return proto.Marshal(message)
 }
 
-// InfluxDB Mocks
-type MockInfluxDB struct {
-	mock.Mock
-}
+func TestKiezboxMessageToPoint(t *testing.T) {
+	updateMessage := testutils.CreateKiezboxMessage(1672531200)
+	updateMessage.Update.ArrivalTime = proto.Int64(1672531260)
 
-func (m *MockInfluxDB) WritePointToDatabase(point *influxdb_write.Point) error {
-	args := m.Called(point)
-	// Simulate a real delay to trigger context timeout
-	if args.Error(0) == context.DeadlineExceeded {
-		time.Sleep(testTimeout)
-	}
-	// Return the mocked error (or nil if successful)
-	return args.Error(0)
-}
-
-func TestWritePointToDatabase(t *testing.T) {
-	// Define test cases
-	testCases := []struct {
-		name          string
-		mockReturnErr error
-		expectedErr   string
-		expectedLog   string
+	tests := []struct {
+		name                string
+		message             *generated.KiezboxMessage
+		expectedMeasurement string
+		expectedTags        map[string]string
+		expectedErr         bool
 	}{
 		{
-			name:          "Success",
-			mockReturnErr: nil,
-			expectedErr:   "",
-			expectedLog:   "",
+			name:                "Core update",
+			message:             updateMessage,
+			expectedMeasurement: "core_values",
+			expectedTags:        map[string]string{"box_id": "1", "dist_id": "2"},
 		},
 		{
-			name:          "Database timeout",
-			mockReturnErr: context.DeadlineExceeded,
-			expectedErr:   "database connection timed out: context deadline exceeded",
-			expectedLog:   "database connection timed out: context deadline exceeded",
+			name:                "Distress event",
+			message:             testutils.CreateDistressMessage(1672531200),
+			expectedMeasurement: "distress_events",
+			expectedTags:        map[string]string{"type": "fire", "button_id": "3"},
 		},
-		// TODO: Write a test for non valid data
-	}
-
-	for _, testCase := range testCases {
-		t.Run(testCase.name, func(t *testing.T) {
-			// Initialize and set behavior of WriteAPI mock
-			mockWriteAPI := new(MockWriteAPI)
-			mockWriteAPI.On("WritePoint", mock.Anything, mock.Anything).Return(testCase.mockReturnErr)
-
-			// Initialize InfluxDB instance mock
-			db := &InfluxDB{
-				Client:   nil,
-				WriteAPI: mockWriteAPI,
-				QueryAPI: nil,
-				Org:      "test-org",
-				Bucket:   "test-bucket",
-				Timeout:  testTimeout,
-			}
-
-			// Prepare the InfluxDB point
-			point := testutils.CreateTestPoint()
-
-			// Call WritePointToDatabase
-			err := db.WritePointToDatabase(point)
-
-			// Verify results based on the test cases
-			if testCase.expectedErr == "" {
-				assert.NoError(t, err) // No error expected
-			} else {
-				assert.Error(t, err)                               // Error expected
-				assert.Equal(t, testCase.expectedErr, err.Error()) // Verify error message
-			}
-
-			// Assert expectations on the mock
-			mockWriteAPI.AssertExpectations(t)
-		})
-	}
-}
-
-func TestWritePointToFile(t *testing.T) {
-	// Create a kiezbox message to use throughout the test
-	testMessage := testutils.CreateKiezboxMessage(time.Now().Unix())
-
-	tests := []struct {
-		name          string
-		message       *generated.KiezboxMessage
-		dir           string
-		mockReturnErr error
-		expectedErr   error
-	}{
 		{
-			name:          "Successful write",
-			message:       testMessage,
-			mockReturnErr: nil,
-			expectedErr:   nil,
+			name:        "Neither update nor distress",
+			message:     &generated.KiezboxMessage{},
+			expectedErr: true,
 		},
-		// TODO: Add test cases for the different failure scenarios
 	}
 
 	for _, testCase := range tests {
 		t.Run(testCase.name, func(t *testing.T) {
-			// Use a temporary directory
-			dir := t.TempDir()
-
-			// Initialize the MockMarshal object and set its behavior
-			mockMarshal := new(MockMarshal)
-			mockMarshal.On("MarshalKiezboxMessage", mock.Anything).Return(nil, testCase.mockReturnErr)
-
-			// Call the function
-			err := WritePointToFile(testCase.message, dir)
+			point, err := KiezboxMessageToPoint(testCase.message)
 
-			// Check the results
-			if testCase.expectedErr != nil {
-				assert.EqualError(t, err, testCase.expectedErr.Error())
-			} else {
-				assert.NoError(t, err)
-
-				// Retrieve the actual filename generated by WritePointToFile
-				files, err := os.ReadDir(dir)
-				assert.NoError(t, err)
-				assert.Len(t, files, 1, "Expected exactly one file to be created")
+			if testCase.expectedErr {
+				assert.Error(t, err)
+				assert.Nil(t, point)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedMeasurement, point.Name())
+			tags := make(map[string]string)
+			for _, tag := range point.TagList() {
+				tags[tag.Key] = tag.Value
 			}
+			assert.Equal(t, testCase.expectedTags, tags)
+			assert.Equal(t, time.Unix(1672531200, 0), point.Time())
 		})
 	}
 }
@@ -221,32 +152,48 @@ func TestRetryCachedPoints(t *testing.T) {
 	// Define the directory containing the fixtures
 	originalDir := "fixtures/cached"
 
-	// Temporary directory to copy the fixture files
-	tempDir := t.TempDir()
-
 	// Define the test cases
 	tests := []struct {
-		name                string
-		mockReturnErr       error
-		expectedFileDeleted bool
+		name            string
+		mockReturnErr   error
+		expectedPending int
 	}{
 		{
-			name:                "Success: Files should be deleted after successful write",
-			mockReturnErr:       nil,
-			expectedFileDeleted: true,
+			name:            "Success: Points should be consumed after successful write",
+			mockReturnErr:   nil,
+			expectedPending: 0,
+		},
+		{
+			name:            "Timeout: Points should stay cached on DeadlineExceeded error",
+			mockReturnErr:   context.DeadlineExceeded,
+			expectedPending: 2,
 		},
 		{
-			name:                "Timeout: Files should not be deleted on DeadlineExceeded error",
-			mockReturnErr:       context.DeadlineExceeded,
-			expectedFileDeleted: false,
+			name:            "Server error: Points should stay cached while the database is unavailable",
+			mockReturnErr:   &influxdb_http.Error{StatusCode: 503},
+			expectedPending: 2,
+		},
+		{
+			name:            "Rejected: Points rejected by the database should be consumed",
+			mockReturnErr:   &influxdb_http.Error{StatusCode: 400},
+			expectedPending: 0,
 		},
 	}
 
 	// Iterate over test cases
 	for _, testCase := range tests {
 		t.Run(testCase.name, func(t *testing.T) {
-			// Always copy fixture files into the temporary directory before each test
+			// Copy the legacy fixture files into a temporary directory, opening the cache imports them
+			tempDir := t.TempDir()
 			copyFixtureFiles(t, originalDir, tempDir)
+			cache, err := OpenCache(tempDir, CacheOptions{SegmentSize: 1024})
+			if err != nil {
+				t.Fatalf("Failed to open cache: %v", err)
+			}
+			defer cache.Close()
+			assert.Equal(t, 2, cache.Pending())
+			legacyFiles, _ := filepath.Glob(filepath.Join(tempDir, "*.pb"))
+			assert.Empty(t, legacyFiles, "Legacy files should be removed after importing them")
 
 			// Mock the behavior of mocks
 			mockWriteAPI := new(MockWriteAPI)
@@ -262,31 +209,21 @@ func TestRetryCachedPoints(t *testing.T) {
 				Timeout:  testTimeout,
 			}
 
-			// Get the filenames from the directory
-			files, err := os.ReadDir(tempDir)
-			if err != nil {
-				t.Fatalf("Failed to read tempDir %s: %v", tempDir, err)
-			}
-
-			// Ensure that the files exist before the test
-			for _, file := range files {
-				assert.FileExists(t, filepath.Join(tempDir, file.Name()))
-			}
-
 			// Run RetryCachedPoints
-			db.RetryCachedPoints(tempDir)
+			RetryCachedPoints(context.Background(), db, cache, 10, 0)
 
-			// Verify the files' existence based on the result of WritePointToDatabase
-			for _, file := range files {
-				filePath := filepath.Join(tempDir, file.Name())
+			// Both points are sent in a single batch
+			mockWriteAPI.AssertNumberOfCalls(t, "WritePoint", 1)
 
-				if testCase.expectedFileDeleted {
-					// If the write was successful, the files should be deleted
-					assert.NoFileExists(t, filePath)
-				} else {
-					// If there was a timeout, the files should still exist
-					assert.FileExists(t, filePath)
-				}
+			// Verify the remaining points based on the result of WritePointsToDatabase
+			status := cache.Status()
+			assert.Equal(t, testCase.expectedPending, status.Pending)
+			if testCase.expectedPending == 0 {
+				assert.Equal(t, 2, status.Replayed)
+				assert.NotNil(t, status.LastSuccess)
+			} else {
+				assert.Equal(t, 1, status.ReplayFailures)
+				assert.NotEmpty(t, status.LastError)
 			}
 		})
 	}
@@ -0,0 +1,271 @@
+// Package inspect decodes the protobufs the gateway caches and exchanges with the device into prototext or JSON
+package inspect
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"kiezbox/internal/db"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Message types which can be decoded from raw bytes, by the names used on the command line
+var messageTypes = map[string]func() proto.Message{
+	"fromradio":  func() proto.Message { return &generated.FromRadio{} },
+	"toradio":    func() proto.Message { return &generated.ToRadio{} },
+	"meshpacket": func() proto.Message { return &generated.MeshPacket{} },
+	"data":       func() proto.Message { return &generated.Data{} },
+	"envelope":   func() proto.Message { return &generated.ServiceEnvelope{} },
+	"kiezbox":    func() proto.Message { return &generated.KiezboxMessage{} },
+	"admin":      func() proto.Message { return &generated.AdminMessage{} },
+	"telemetry":  func() proto.Message { return &generated.Telemetry{} },
+}
+
+// Message types of the Data.Payload by portnum, text payloads are shown as string
+var payloadTypes = map[generated.PortNum]func() proto.Message{
+	generated.PortNum_TEXT_MESSAGE_APP:     func() proto.Message { return &wrapperspb.StringValue{} },
+	generated.PortNum_DETECTION_SENSOR_APP: func() proto.Message { return &wrapperspb.StringValue{} },
+	generated.PortNum_ALERT_APP:            func() proto.Message { return &wrapperspb.StringValue{} },
+	generated.PortNum_RANGE_TEST_APP:       func() proto.Message { return &wrapperspb.StringValue{} },
+	generated.PortNum_POSITION_APP:         func() proto.Message { return &generated.Position{} },
+	generated.PortNum_NODEINFO_APP:         func() proto.Message { return &generated.User{} },
+	generated.PortNum_ROUTING_APP:          func() proto.Message { return &generated.Routing{} },
+	generated.PortNum_ADMIN_APP:            func() proto.Message { return &generated.AdminMessage{} },
+	generated.PortNum_WAYPOINT_APP:         func() proto.Message { return &generated.Waypoint{} },
+	generated.PortNum_PAXCOUNTER_APP:       func() proto.Message { return &generated.Paxcount{} },
+	generated.PortNum_STORE_FORWARD_APP:    func() proto.Message { return &generated.StoreAndForward{} },
+	generated.PortNum_TELEMETRY_APP:        func() proto.Message { return &generated.Telemetry{} },
+	generated.PortNum_TRACEROUTE_APP:       func() proto.Message { return &generated.RouteDiscovery{} },
+	generated.PortNum_NEIGHBORINFO_APP:     func() proto.Message { return &generated.NeighborInfo{} },
+	generated.PortNum_KIEZBOX_CONTROL_APP:  func() proto.Message { return &generated.KiezboxMessage{} },
+}
+
+// MessageTypes returns the names of the message types accepted by Unmarshal
+func MessageTypes() []string {
+	names := make([]string, 0, len(messageTypes))
+	for name := range messageTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Unmarshal decodes data as the message type with the given name
+func Unmarshal(name string, data []byte) (proto.Message, error) {
+	newMessage, err := lookupType(name)
+	if err != nil {
+		return nil, err
+	}
+	message := newMessage()
+	if err := proto.Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func lookupType(name string) (func() proto.Message, error) {
+	newMessage, ok := messageTypes[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q, expected one of %s", name, strings.Join(MessageTypes(), ", "))
+	}
+	return newMessage, nil
+}
+
+// ParseBytes decodes a hex string, e.g. from the `ToRadio Marshalled` log, or a base64 payload.
+// The encoding is "hex", "base64" or "" to try hex first. Hex may contain whitespace or colons and a 0x prefix.
+// A leading stream protocol header is removed.
+func ParseBytes(value string, encoding string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	var data []byte
+	var err error
+	switch encoding {
+	case "hex":
+		data, err = parseHex(value)
+	case "base64":
+		data, err = parseBase64(value)
+	case "":
+		if data, err = parseHex(value); err != nil {
+			if data, err = parseBase64(value); err != nil {
+				return nil, errors.New("neither hex nor base64")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stripFrame(data), nil
+}
+
+func parseHex(value string) ([]byte, error) {
+	return hex.DecodeString(strings.NewReplacer(" ", "", "\n", "", "\t", "", ":", "").Replace(strings.TrimPrefix(value, "0x")))
+}
+
+// parseBase64 accepts the standard and URL alphabet, with or without padding
+func parseBase64(value string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if data, err := encoding.DecodeString(value); err == nil {
+			return data, nil
+		}
+	}
+	return nil, base64.CorruptInputError(0)
+}
+
+// stripFrame removes the header of a single frame of the stream protocol, like in the `Sending packet` log
+func stripFrame(data []byte) []byte {
+	if len(data) >= 4 && data[0] == 0x94 && data[1] == 0xc3 && int(data[2])<<8|int(data[3]) == len(data)-4 {
+		return data[4:]
+	}
+	return data
+}
+
+// Payload is a decoded Data.Payload found inside a message
+type Payload struct {
+	// Path is the field path of the Data message, e.g. packet.decoded
+	Path    string
+	Portnum generated.PortNum
+	// Message is nil if the portnum is not known or the payload could not be unmarshalled
+	Message proto.Message
+	Err     error
+}
+
+// Item is a decoded message together with where it was found
+type Item struct {
+	// Source is the file, cache record or argument the message was read from
+	Source string
+	// Time is when the message was recorded, zero if it is not known
+	Time time.Time
+	// Direction is "<" for data from the device and ">" for data to the device, empty if it is not known
+	Direction string
+	Message   proto.Message
+	Payloads  []Payload
+}
+
+// NewItem creates an Item, decoding the payloads of all Data messages contained in message
+func NewItem(source string, recorded time.Time, direction string, message proto.Message) Item {
+	item := Item{Source: source, Time: recorded, Direction: direction, Message: message}
+	item.Payloads = DecodePayloads(message)
+	return item
+}
+
+// DecodePayloads searches message for Data messages and unmarshals their payloads by portnum.
+// Payloads are searched recursively, so Data inside a decoded payload is decoded as well.
+func DecodePayloads(message proto.Message) []Payload {
+	var payloads []Payload
+	walkData(message.ProtoReflect(), "", &payloads)
+	return payloads
+}
+
+// walkData visits all set message fields of m and decodes the payload of every Data message
+func walkData(m protoreflect.Message, path string, payloads *[]Payload) {
+	if data, ok := m.Interface().(*generated.Data); ok {
+		payload := Payload{Path: path, Portnum: data.GetPortnum()}
+		if newMessage, ok := payloadTypes[data.GetPortnum()]; ok {
+			message := newMessage()
+			if value, ok := message.(*wrapperspb.StringValue); ok {
+				value.Value = string(data.GetPayload())
+				payload.Message = value
+			} else if err := proto.Unmarshal(data.GetPayload(), message); err != nil {
+				payload.Err = err
+			} else {
+				payload.Message = message
+			}
+		}
+		*payloads = append(*payloads, payload)
+		if payload.Message != nil {
+			walkData(payload.Message.ProtoReflect(), join(path, "payload"), payloads)
+		}
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				walkData(list.Get(i).Message(), fmt.Sprintf("%s[%d]", join(path, string(fd.Name())), i), payloads)
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				walkData(value.Message(), fmt.Sprintf("%s[%v]", join(path, string(fd.Name())), key.Interface()), payloads)
+				return true
+			})
+		case fd.Message() != nil && !fd.IsList() && !fd.IsMap():
+			walkData(v.Message(), join(path, string(fd.Name())), payloads)
+		}
+		return true
+	})
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// Kiezbox returns the KiezboxMessage of the item, either the message itself or a decoded payload
+func (item Item) Kiezbox() *generated.KiezboxMessage {
+	if message, ok := item.Message.(*generated.KiezboxMessage); ok {
+		return message
+	}
+	for _, payload := range item.Payloads {
+		if message, ok := payload.Message.(*generated.KiezboxMessage); ok {
+			return message
+		}
+	}
+	return nil
+}
+
+// Filter selects items by the measurement and box id of their KiezboxMessage and by time
+type Filter struct {
+	// Measurement as written to the database: core_values, sensor_values or distress_events
+	Measurement string
+	BoxId       *uint32
+	// Start and Stop limit the time range, zero values leave it open
+	Start time.Time
+	Stop  time.Time
+}
+
+// Match reports whether the item passes the filter.
+// Items without KiezboxMessage only pass if neither measurement nor box id is filtered.
+// The time of the item is used if known, otherwise the time of its KiezboxMessage.
+func (f Filter) Match(item Item) bool {
+	kiezbox := item.Kiezbox()
+	if f.Measurement != "" && (kiezbox == nil || db.Measurement(kiezbox) != f.Measurement) {
+		return false
+	}
+	if f.BoxId != nil && (boxId(kiezbox) == nil || *boxId(kiezbox) != *f.BoxId) {
+		return false
+	}
+	if f.Start.IsZero() && f.Stop.IsZero() {
+		return true
+	}
+	recorded := item.Time
+	if recorded.IsZero() && kiezbox != nil && db.MessageTime(kiezbox) != 0 {
+		recorded = time.Unix(db.MessageTime(kiezbox), 0)
+	}
+	if recorded.IsZero() {
+		return false
+	}
+	return (f.Start.IsZero() || !recorded.Before(f.Start)) && (f.Stop.IsZero() || recorded.Before(f.Stop))
+}
+
+// boxId returns the box id from the meta of an Update or Control, distress events carry none
+func boxId(message *generated.KiezboxMessage) *uint32 {
+	if meta := message.GetUpdate().GetMeta(); meta != nil && meta.BoxId != nil {
+		return meta.BoxId
+	}
+	if meta := message.GetControl().GetMeta(); meta != nil && meta.BoxId != nil {
+		return meta.BoxId
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"kiezbox/internal/capture"
+	"kiezbox/internal/db"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/meshtastic"
+	"kiezbox/testutils"
+)
+
+// packet wraps a payload into a FromRadio packet
+func packet(portnum generated.PortNum, payload []byte) *generated.FromRadio {
+	return &generated.FromRadio{PayloadVariant: &generated.FromRadio_Packet{Packet: &generated.MeshPacket{
+		From: 42,
+		PayloadVariant: &generated.MeshPacket_Decoded{Decoded: &generated.Data{
+			Portnum: portnum,
+			Payload: payload,
+		}},
+	}}}
+}
+
+func kiezboxPacket(t *testing.T, message *generated.KiezboxMessage) *generated.FromRadio {
+	payload, err := proto.Marshal(message)
+	require.NoError(t, err)
+	return packet(generated.PortNum_KIEZBOX_CONTROL_APP, payload)
+}
+
+func marshal(t *testing.T, message proto.Message) []byte {
+	data, err := proto.Marshal(message)
+	require.NoError(t, err)
+	return data
+}
+
+func TestParseBytes(t *testing.T) {
+	data := marshal(t, &generated.ToRadio{PayloadVariant: &generated.ToRadio_WantConfigId{WantConfigId: 7}})
+	testCases := []struct {
+		name     string
+		value    string
+		encoding string
+	}{
+		{"Hex", hex.EncodeToString(data), ""},
+		{"Hex with prefix and separators", "0x" + hex.EncodeToString(data[:1]) + " " + hex.EncodeToString(data[1:]), ""},
+		{"Framed hex", hex.EncodeToString(meshtastic.EncodeFrame(data)), "hex"},
+		{"Base64", base64.StdEncoding.EncodeToString(data), ""},
+		{"Raw URL base64", base64.RawURLEncoding.EncodeToString(data), "base64"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, err := ParseBytes(tc.value, tc.encoding)
+			require.NoError(t, err)
+			assert.Equal(t, data, parsed)
+		})
+	}
+
+	_, err := ParseBytes("not hex!", "")
+	assert.Error(t, err)
+	_, err = ParseBytes("zz", "hex")
+	assert.Error(t, err)
+	_, err = ParseBytes("00", "binary")
+	assert.Error(t, err)
+}
+
+func TestUnmarshal(t *testing.T) {
+	message, err := Unmarshal("ToRadio", marshal(t, &generated.ToRadio{PayloadVariant: &generated.ToRadio_WantConfigId{WantConfigId: 7}}))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), message.(*generated.ToRadio).GetWantConfigId())
+
+	_, err = Unmarshal("nodeinfo", nil)
+	assert.ErrorContains(t, err, "unknown message type")
+	_, err = Unmarshal("kiezbox", []byte{0xff})
+	assert.Error(t, err)
+}
+
+func TestDecodePayloads(t *testing.T) {
+	kiezbox := testutils.CreateKiezboxMessage(1700000000)
+	payloads := DecodePayloads(kiezboxPacket(t, kiezbox))
+	require.Len(t, payloads, 1)
+	assert.Equal(t, "packet.decoded", payloads[0].Path)
+	assert.Equal(t, generated.PortNum_KIEZBOX_CONTROL_APP, payloads[0].Portnum)
+	assert.True(t, proto.Equal(kiezbox, payloads[0].Message))
+
+	payloads = DecodePayloads(packet(generated.PortNum_TEXT_MESSAGE_APP, []byte("hello")))
+	require.Len(t, payloads, 1)
+	assert.Equal(t, "hello", payloads[0].Message.(*wrapperspb.StringValue).GetValue())
+
+	// Unknown portnums are listed, but not decoded
+	payloads = DecodePayloads(packet(generated.PortNum_PRIVATE_APP, []byte{1, 2}))
+	require.Len(t, payloads, 1)
+	assert.Nil(t, payloads[0].Message)
+	assert.NoError(t, payloads[0].Err)
+
+	payloads = DecodePayloads(packet(generated.PortNum_ADMIN_APP, []byte{0xff}))
+	require.Len(t, payloads, 1)
+	assert.Nil(t, payloads[0].Message)
+	assert.Error(t, payloads[0].Err)
+
+	// Data inside other messages, like the MQTT service envelope
+	envelope := &generated.ServiceEnvelope{Packet: kiezboxPacket(t, kiezbox).GetPacket()}
+	payloads = DecodePayloads(envelope)
+	require.Len(t, payloads, 1)
+	assert.Equal(t, "packet.decoded", payloads[0].Path)
+
+	assert.Empty(t, DecodePayloads(kiezbox))
+}
+
+func TestFilter(t *testing.T) {
+	core := NewItem("core", time.Time{}, "", kiezboxPacket(t, testutils.CreateKiezboxMessage(1700000000)))
+	distress := NewItem("distress", time.Unix(1700000100, 0), "<", kiezboxPacket(t, testutils.CreateDistressMessage(1700000000)))
+	other := NewItem("other", time.Unix(1700000000, 0), "<", &generated.FromRadio{PayloadVariant: &generated.FromRadio_ConfigCompleteId{ConfigCompleteId: 1}})
+
+	testCases := []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{"No filter", Filter{}, []string{"core", "distress", "other"}},
+		{"Measurement", Filter{Measurement: "core_values"}, []string{"core"}},
+		{"Distress", Filter{Measurement: "distress_events"}, []string{"distress"}},
+		{"Box id", Filter{BoxId: proto.Uint32(1)}, []string{"core"}},
+		{"Other box id", Filter{BoxId: proto.Uint32(2)}, nil},
+		{"Start", Filter{Start: time.Unix(1700000050, 0)}, []string{"distress"}},
+		{"Stop", Filter{Stop: time.Unix(1700000050, 0)}, []string{"core", "other"}},
+		{"Stop is exclusive", Filter{Stop: time.Unix(1700000000, 0)}, nil},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var matched []string
+			for _, item := range []Item{core, distress, other} {
+				if tc.filter.Match(item) {
+					matched = append(matched, item.Source)
+				}
+			}
+			assert.Equal(t, tc.expected, matched)
+		})
+	}
+}
+
+func collect(items *[]Item) func(Item) error {
+	return func(item Item) error {
+		*items = append(*items, item)
+		return nil
+	}
+}
+
+func TestScanStream(t *testing.T) {
+	first := marshal(t, kiezboxPacket(t, testutils.CreateKiezboxMessage(1700000000)))
+	second := marshal(t, &generated.FromRadio{PayloadVariant: &generated.FromRadio_ConfigCompleteId{ConfigCompleteId: 1}})
+	var stream []byte
+	stream = append(stream, "INFO  | booting\r\n"...)
+	stream = append(stream, meshtastic.EncodeFrame(first)...)
+	stream = append(stream, meshtastic.EncodeFrame([]byte{0xff, 0xff})...)
+	stream = append(stream, meshtastic.EncodeFrame(second)...)
+
+	var items []Item
+	require.NoError(t, ScanStream(bytes.NewReader(stream), "stream", "fromradio", collect(&items)))
+	require.Len(t, items, 2)
+	assert.Equal(t, "stream:0", items[0].Source)
+	require.Len(t, items[0].Payloads, 1)
+	assert.Equal(t, uint32(1), items[1].Message.(*generated.FromRadio).GetConfigCompleteId())
+
+	assert.Error(t, ScanStream(bytes.NewReader(stream), "stream", "unknown", collect(&items)))
+}
+
+func TestScanCapture(t *testing.T) {
+	fromRadio := meshtastic.EncodeFrame(marshal(t, kiezboxPacket(t, testutils.CreateKiezboxMessage(1700000000))))
+	toRadio := meshtastic.EncodeFrame(marshal(t, &generated.ToRadio{PayloadVariant: &generated.ToRadio_WantConfigId{WantConfigId: 7}}))
+	start := time.Unix(1700000000, 0)
+
+	var buf bytes.Buffer
+	writer, err := capture.NewWriter(&buf)
+	require.NoError(t, err)
+	// The frame from the device is split across two reads, with a write to the device in between
+	require.NoError(t, writer.WriteRecord(capture.Record{Time: start, Direction: capture.FromRadio, Data: fromRadio[:5]}))
+	require.NoError(t, writer.WriteRecord(capture.Record{Time: start.Add(time.Second), Direction: capture.ToRadio, Data: toRadio}))
+	require.NoError(t, writer.WriteRecord(capture.Record{Time: start.Add(2 * time.Second), Direction: capture.FromRadio, Data: append(fromRadio[5:], "DEBUG | idle\n"...)}))
+
+	var items []Item
+	require.NoError(t, ScanCapture(&buf, "device.kbcap", collect(&items)))
+	require.Len(t, items, 2)
+	assert.Equal(t, ">", items[0].Direction)
+	assert.Equal(t, uint32(7), items[0].Message.(*generated.ToRadio).GetWantConfigId())
+	assert.Equal(t, "<", items[1].Direction)
+	assert.True(t, start.Add(2*time.Second).Equal(items[1].Time))
+	assert.Equal(t, "device.kbcap:0", items[1].Source)
+	assert.NotNil(t, items[1].Kiezbox())
+
+	assert.ErrorIs(t, ScanCapture(bytes.NewReader([]byte("no capture")), "file", collect(&items)), capture.ErrInvalidCapture)
+}
+
+func TestScanCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := db.OpenCache(dir, db.CacheOptions{})
+	require.NoError(t, err)
+	require.NoError(t, cache.Append(testutils.CreateKiezboxMessage(1700000000)))
+	require.NoError(t, cache.Append(testutils.CreateDistressMessage(1700000100)))
+	require.NoError(t, cache.Close())
+
+	var items []Item
+	require.NoError(t, ScanCache(dir, collect(&items)))
+	require.Len(t, items, 2)
+	assert.True(t, time.Unix(1700000000, 0).Equal(items[0].Time))
+	assert.Contains(t, items[0].Source, "segment-")
+	assert.NotNil(t, items[1].Kiezbox().GetDistress())
+}
+
+func TestPrinter(t *testing.T) {
+	item := NewItem("device.kbcap:0", time.Unix(1700000000, 0), "<", kiezboxPacket(t, testutils.CreateKiezboxMessage(1700000000)))
+
+	var text bytes.Buffer
+	printer, err := NewPrinter(&text, FormatText)
+	require.NoError(t, err)
+	require.NoError(t, printer.Print(item))
+	assert.Contains(t, text.String(), "# device.kbcap:0 2023-11-14T22:13:20Z < meshtastic.FromRadio\n")
+	assert.Contains(t, text.String(), "# payload packet.decoded KIEZBOX_CONTROL_APP meshtastic.KiezboxMessage\n")
+	// prototext randomly varies the spacing
+	assert.Regexp(t, `unix_time: +1700000000`, text.String())
+
+	var out bytes.Buffer
+	printer, err = NewPrinter(&out, FormatJSON)
+	require.NoError(t, err)
+	require.NoError(t, printer.Print(item))
+	require.NoError(t, printer.Print(NewItem("arg", time.Time{}, "", testutils.CreateDistressMessage(1700000000))))
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var decoded struct {
+		Source    string     `json:"source"`
+		Time      *time.Time `json:"time"`
+		Direction string     `json:"direction"`
+		Type      string     `json:"type"`
+		Payloads  []struct {
+			Portnum string         `json:"portnum"`
+			Type    string         `json:"type"`
+			Message map[string]any `json:"message"`
+		} `json:"payloads"`
+	}
+	require.NoError(t, json.Unmarshal(lines[0], &decoded))
+	assert.Equal(t, "<", decoded.Direction)
+	assert.Equal(t, "meshtastic.FromRadio", decoded.Type)
+	require.Len(t, decoded.Payloads, 1)
+	assert.Equal(t, "KIEZBOX_CONTROL_APP", decoded.Payloads[0].Portnum)
+	assert.Contains(t, decoded.Payloads[0].Message, "update")
+
+	decoded.Time = nil
+	require.NoError(t, json.Unmarshal(lines[1], &decoded))
+	assert.Nil(t, decoded.Time)
+	assert.Equal(t, "meshtastic.KiezboxMessage", decoded.Type)
+
+	_, err = NewPrinter(&out, "yaml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// Output formats of a Printer
+const (
+	FormatText = "text" // prototext with a comment line per message and payload
+	FormatJSON = "json" // one JSON object per line
+)
+
+// Printer writes items in one of the output formats
+type Printer struct {
+	w      io.Writer
+	format string
+}
+
+// NewPrinter creates a Printer writing to w in the given format
+func NewPrinter(w io.Writer, format string) (*Printer, error) {
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("unknown format %q, expected %s or %s", format, FormatText, FormatJSON)
+	}
+	return &Printer{w: w, format: format}, nil
+}
+
+// Print writes a single item
+func (p *Printer) Print(item Item) error {
+	if p.format == FormatJSON {
+		return p.printJSON(item)
+	}
+	return p.printText(item)
+}
+
+// printText writes the item as prototext, each message is preceded by a comment line describing it
+func (p *Printer) printText(item Item) error {
+	header := []string{"#", item.Source}
+	if !item.Time.IsZero() {
+		header = append(header, item.Time.UTC().Format(time.RFC3339Nano))
+	}
+	if item.Direction != "" {
+		header = append(header, item.Direction)
+	}
+	header = append(header, messageName(item.Message))
+	var b strings.Builder
+	b.WriteString(strings.Join(header, " ") + "\n")
+	if err := writePrototext(&b, item.Message); err != nil {
+		return err
+	}
+	for _, payload := range item.Payloads {
+		fmt.Fprintf(&b, "# payload %s %s", payload.Path, payload.Portnum)
+		switch {
+		case payload.Err != nil:
+			fmt.Fprintf(&b, " failed to unmarshal: %v\n", payload.Err)
+		case payload.Message == nil:
+			b.WriteString(" not decoded\n")
+		default:
+			b.WriteString(" " + messageName(payload.Message) + "\n")
+			if err := writePrototext(&b, payload.Message); err != nil {
+				return err
+			}
+		}
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(p.w, b.String())
+	return err
+}
+
+func writePrototext(b *strings.Builder, message proto.Message) error {
+	text, err := prototext.MarshalOptions{Multiline: true}.Marshal(message)
+	if err != nil {
+		return err
+	}
+	b.Write(text)
+	return nil
+}
+
+type jsonPayload struct {
+	Path    string          `json:"path"`
+	Portnum string          `json:"portnum"`
+	Type    string          `json:"type,omitempty"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type jsonItem struct {
+	Source    string          `json:"source"`
+	Time      *time.Time      `json:"time,omitempty"`
+	Direction string          `json:"direction,omitempty"`
+	Type      string          `json:"type"`
+	Message   json.RawMessage `json:"message"`
+	Payloads  []jsonPayload   `json:"payloads,omitempty"`
+}
+
+// printJSON writes the item as a single line of JSON, the messages are encoded with protojson
+func (p *Printer) printJSON(item Item) error {
+	message, err := protojson.Marshal(item.Message)
+	if err != nil {
+		return err
+	}
+	out := jsonItem{
+		Source:    item.Source,
+		Direction: item.Direction,
+		Type:      messageName(item.Message),
+		Message:   message,
+	}
+	if !item.Time.IsZero() {
+		recorded := item.Time.UTC()
+		out.Time = &recorded
+	}
+	for _, payload := range item.Payloads {
+		decoded := jsonPayload{Path: payload.Path, Portnum: payload.Portnum.String()}
+		if payload.Err != nil {
+			decoded.Error = payload.Err.Error()
+		}
+		if payload.Message != nil {
+			decoded.Type = messageName(payload.Message)
+			if decoded.Message, err = protojson.Marshal(payload.Message); err != nil {
+				return err
+			}
+		}
+		out.Payloads = append(out.Payloads, decoded)
+	}
+	// Keep the direction readable, the output is not embedded in HTML
+	encoder := json.NewEncoder(p.w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(out)
+}
+
+func messageName(message proto.Message) string {
+	return string(message.ProtoReflect().Descriptor().FullName())
+}
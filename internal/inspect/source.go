@@ -0,0 +1,152 @@
+package inspect
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/capture"
+	"kiezbox/internal/db"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/meshtastic"
+)
+
+// ScanCache calls fn with every KiezboxMessage of the offline cache in dir.
+// The source of a log record is its segment and offset, records which are already replayed are marked as such.
+func ScanCache(dir string, fn func(Item) error) error {
+	return db.ScanCache(dir, func(cached db.CachedMessage) error {
+		source := cached.File
+		if !strings.HasSuffix(cached.File, ".pb") {
+			source = fmt.Sprintf("%s:%d", cached.File, cached.Offset)
+		}
+		if cached.Replayed {
+			source += " (replayed)"
+		}
+		return fn(NewItem(source, messageTime(cached.Message), "", cached.Message))
+	})
+}
+
+// ScanStream splits a raw byte stream of the meshtastic stream protocol into frames and decodes them as messageType.
+// Frames which do not unmarshal are rejected, so the decoder resyncs on the next start bytes.
+func ScanStream(r io.Reader, source string, messageType string, fn func(Item) error) error {
+	newMessage, err := lookupType(messageType)
+	if err != nil {
+		return err
+	}
+	decoder := meshtastic.NewFrameDecoder(r)
+	for index := 0; ; {
+		payload, err := decoder.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		message := newMessage()
+		if err := proto.Unmarshal(payload, message); err != nil {
+			slog.Warn("Skipping frame which does not unmarshal", "source", source, "type", messageType, "err", err)
+			decoder.Reject()
+			continue
+		}
+		if err := fn(NewItem(fmt.Sprintf("%s:%d", source, index), time.Time{}, "", message)); err != nil {
+			return err
+		}
+		index++
+	}
+}
+
+// ScanCapture decodes the frames of a capture file written by the gateway.
+// Data from the device is decoded as FromRadio, data to it as ToRadio, each with its own decoder,
+// so frames split across records are put together again. The time of an item is the one of the record completing the frame.
+func ScanCapture(r io.Reader, source string, fn func(Item) error) error {
+	reader, err := capture.NewReader(r)
+	if err != nil {
+		return err
+	}
+	streams := map[capture.Direction]*captureStream{
+		capture.FromRadio: newCaptureStream(func() proto.Message { return &generated.FromRadio{} }),
+		capture.ToRadio:   newCaptureStream(func() proto.Message { return &generated.ToRadio{} }),
+	}
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		stream, ok := streams[record.Direction]
+		if !ok {
+			continue
+		}
+		stream.pending = record.Data
+		for {
+			payload, err := stream.decoder.Next()
+			if err != nil {
+				// The record is used up, continue with the next one
+				break
+			}
+			message := stream.newMessage()
+			if err := proto.Unmarshal(payload, message); err != nil {
+				slog.Warn("Skipping frame which does not unmarshal", "source", source, "direction", string(record.Direction), "err", err)
+				stream.decoder.Reject()
+				continue
+			}
+			item := NewItem(fmt.Sprintf("%s:%d", source, stream.frames), record.Time, string(record.Direction), message)
+			stream.frames++
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// captureStream feeds the records of one direction into a FrameDecoder
+type captureStream struct {
+	decoder    *meshtastic.FrameDecoder
+	pending    []byte
+	frames     int
+	newMessage func() proto.Message
+}
+
+func newCaptureStream(newMessage func() proto.Message) *captureStream {
+	stream := &captureStream{newMessage: newMessage}
+	stream.decoder = meshtastic.NewFrameDecoder(stream)
+	return stream
+}
+
+// Read hands the data of the current record to the decoder and reports io.EOF once it is used up
+func (s *captureStream) Read(b []byte) (int, error) {
+	if len(s.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// ReadMessage decodes a single message, e.g. a legacy .pb cache file or a payload given on the command line
+func ReadMessage(data []byte, source string, messageType string) (Item, error) {
+	message, err := Unmarshal(messageType, data)
+	if err != nil {
+		return Item{}, err
+	}
+	recorded := time.Time{}
+	if kiezbox, ok := message.(*generated.KiezboxMessage); ok {
+		recorded = messageTime(kiezbox)
+	}
+	return NewItem(source, recorded, "", message), nil
+}
+
+// messageTime returns the time of a KiezboxMessage, zero if it has none
+func messageTime(message *generated.KiezboxMessage) time.Time {
+	if timestamp := db.MessageTime(message); timestamp != 0 {
+		return time.Unix(timestamp, 0)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,268 @@
+package meshtastic
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Types of the gateway events
+const (
+	// The serial connection to the device was opened or closed
+	EventSerial = "serial"
+	// The mode of the kiezbox changed
+	EventMode = "mode"
+)
+
+// GatewayEvent is a change of the gateway state, which is distributed on the bus without a packet
+type GatewayEvent struct {
+	Type string
+	Data any
+}
+
+// Envelope is a decoded MeshPacket or a gateway event as it is distributed on the bus
+// Kiezbox, Admin and Routing are only set if the packet carried the according portnum and could be unmarshalled
+type Envelope struct {
+	Packet  *generated.MeshPacket
+	Kiezbox *generated.KiezboxMessage
+	Admin   *generated.AdminMessage
+	Routing *generated.Routing
+	Event   *GatewayEvent
+}
+
+// Portnum returns the portnum of the decoded packet
+func (e *Envelope) Portnum() generated.PortNum {
+	return e.Packet.GetDecoded().GetPortnum()
+}
+
+// KiezboxVariant identifies which part of the KiezboxMessage oneof is set
+type KiezboxVariant int
+
+const (
+	VariantNone KiezboxVariant = iota
+	VariantUpdate
+	VariantControl
+	VariantDistress
+)
+
+// kiezboxVariant returns the variant of a KiezboxMessage
+func kiezboxVariant(message *generated.KiezboxMessage) KiezboxVariant {
+	switch {
+	case message.GetUpdate() != nil:
+		return VariantUpdate
+	case message.GetControl() != nil:
+		return VariantControl
+	case message.GetDistress() != nil:
+		return VariantDistress
+	}
+	return VariantNone
+}
+
+// kiezboxMeta returns the Meta of a KiezboxMessage, if the variant carries one
+func kiezboxMeta(message *generated.KiezboxMessage) *generated.KiezboxMessage_Meta {
+	switch {
+	case message.GetUpdate() != nil:
+		return message.GetUpdate().GetMeta()
+	case message.GetControl() != nil:
+		return message.GetControl().GetMeta()
+	}
+	return nil
+}
+
+// Filter selects the envelopes a subscriber is interested in
+// Empty or nil fields match every packet, set fields all have to match
+type Filter struct {
+	Portnums []generated.PortNum
+	Variants []KiezboxVariant
+	BoxId    *uint32
+	DistId   *uint32
+	// Gateway events are only delivered if set, regardless of the other fields
+	Events bool
+}
+
+// Match reports whether an envelope passes the filter
+func (f *Filter) Match(envelope *Envelope) bool {
+	if envelope.Event != nil {
+		return f.Events
+	}
+	if len(f.Portnums) > 0 && !contains(f.Portnums, envelope.Portnum()) {
+		return false
+	}
+	if len(f.Variants) > 0 || f.BoxId != nil || f.DistId != nil {
+		if envelope.Kiezbox == nil {
+			return false
+		}
+	}
+	if len(f.Variants) > 0 && !contains(f.Variants, kiezboxVariant(envelope.Kiezbox)) {
+		return false
+	}
+	if f.BoxId != nil || f.DistId != nil {
+		meta := kiezboxMeta(envelope.Kiezbox)
+		if meta == nil {
+			return false
+		}
+		if f.BoxId != nil && (meta.BoxId == nil || *meta.BoxId != *f.BoxId) {
+			return false
+		}
+		if f.DistId != nil && (meta.DistId == nil || *meta.DistId != *f.DistId) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains[T comparable](list []T, value T) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy defines what happens when a subscriber's queue is full
+type Policy int
+
+const (
+	// PolicyDrop discards the new envelope for this subscriber and counts it as dropped
+	PolicyDrop Policy = iota
+	// PolicyBlock blocks the publisher until the subscriber has room again
+	PolicyBlock
+)
+
+// Subscription is a registered bus subscriber with its own bounded queue
+type Subscription struct {
+	Name      string
+	C         <-chan *Envelope
+	queue     chan *Envelope
+	done      chan struct{}
+	filter    Filter
+	policy    Policy
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// Done is closed when the subscription is removed from the bus
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// SubscriptionStats is a snapshot of the counters of a subscription
+type SubscriptionStats struct {
+	Name      string `json:"name"`
+	Queued    int    `json:"queued"`
+	Capacity  int    `json:"capacity"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// Bus distributes decoded packets from the MessageHandler to any number of subscribers
+type Bus struct {
+	mutex         sync.RWMutex
+	subscriptions []*Subscription
+}
+
+// NewBus creates an empty message bus
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers a new subscriber, which receives all envelopes matching the filter
+// on a queue of the given size. The policy decides what happens when the queue is full.
+func (b *Bus) Subscribe(name string, filter Filter, size int, policy Policy) *Subscription {
+	queue := make(chan *Envelope, size)
+	subscription := &Subscription{
+		Name:   name,
+		C:      queue,
+		queue:  queue,
+		done:   make(chan struct{}),
+		filter: filter,
+		policy: policy,
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscriptions = append(b.subscriptions, subscription)
+	return subscription
+}
+
+// Unsubscribe removes a subscriber from the bus. Publishers blocked on it are released.
+func (b *Bus) Unsubscribe(subscription *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, s := range b.subscriptions {
+		if s == subscription {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			close(subscription.done)
+			return
+		}
+	}
+}
+
+// UnsubscribeAll removes all subscribers with the given name from the bus
+func (b *Bus) UnsubscribeAll(name string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	subscriptions := b.subscriptions[:0]
+	for _, s := range b.subscriptions {
+		if s.Name == name {
+			close(s.done)
+			continue
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	b.subscriptions = subscriptions
+}
+
+// Publish delivers an envelope to every matching subscriber according to its policy
+// Blocking subscribers only block until the context is canceled.
+func (b *Bus) Publish(ctx context.Context, envelope *Envelope) {
+	// Work on a snapshot, so blocking subscribers do not hold the lock
+	b.mutex.RLock()
+	subscriptions := make([]*Subscription, len(b.subscriptions))
+	copy(subscriptions, b.subscriptions)
+	b.mutex.RUnlock()
+
+	for _, subscription := range subscriptions {
+		if !subscription.filter.Match(envelope) {
+			continue
+		}
+		switch subscription.policy {
+		case PolicyBlock:
+			select {
+			case subscription.queue <- envelope:
+				subscription.delivered.Add(1)
+			case <-subscription.done:
+			case <-ctx.Done():
+				subscription.dropped.Add(1)
+			}
+		default:
+			select {
+			case subscription.queue <- envelope:
+				subscription.delivered.Add(1)
+			default:
+				subscription.dropped.Add(1)
+				slog.Warn("Bus subscriber queue full, dropping message", "subscriber", subscription.Name, "portnum", envelope.Portnum())
+			}
+		}
+	}
+}
+
+// Stats returns the counters of all current subscriptions
+func (b *Bus) Stats() []SubscriptionStats {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	stats := make([]SubscriptionStats, 0, len(b.subscriptions))
+	for _, s := range b.subscriptions {
+		stats = append(stats, SubscriptionStats{
+			Name:      s.Name,
+			Queued:    len(s.queue),
+			Capacity:  cap(s.queue),
+			Delivered: s.delivered.Load(),
+			Dropped:   s.dropped.Load(),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,137 @@
+package meshtastic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/testutils"
+)
+
+// Wrap a KiezboxMessage into an envelope as the MessageHandler would
+func kiezboxEnvelope(message *generated.KiezboxMessage) *Envelope {
+	return &Envelope{
+		Packet: &generated.MeshPacket{
+			PayloadVariant: &generated.MeshPacket_Decoded{
+				Decoded: &generated.Data{Portnum: generated.PortNum_KIEZBOX_CONTROL_APP},
+			},
+		},
+		Kiezbox: message,
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	update := kiezboxEnvelope(testutils.CreateKiezboxMessage(time.Now().Unix()))
+	distress := kiezboxEnvelope(testutils.CreateDistressMessage(time.Now().Unix()))
+	admin := &Envelope{
+		Packet: &generated.MeshPacket{
+			PayloadVariant: &generated.MeshPacket_Decoded{
+				Decoded: &generated.Data{Portnum: generated.PortNum_ADMIN_APP},
+			},
+		},
+		Admin: &generated.AdminMessage{},
+	}
+	event := &Envelope{Event: &GatewayEvent{Type: EventMode, Data: map[string]any{"mode": 1}}}
+
+	testCases := []struct {
+		name     string
+		filter   Filter
+		envelope *Envelope
+		expected bool
+	}{
+		{"Empty filter matches everything", Filter{}, admin, true},
+		{"Portnum match", Filter{Portnums: []generated.PortNum{generated.PortNum_ADMIN_APP}}, admin, true},
+		{"Portnum mismatch", Filter{Portnums: []generated.PortNum{generated.PortNum_ADMIN_APP}}, update, false},
+		{"Variant match", Filter{Variants: []KiezboxVariant{VariantUpdate, VariantDistress}}, distress, true},
+		{"Variant mismatch", Filter{Variants: []KiezboxVariant{VariantControl}}, update, false},
+		{"Variant on non kiezbox packet", Filter{Variants: []KiezboxVariant{VariantUpdate}}, admin, false},
+		{"Box and district match", Filter{BoxId: proto.Uint32(1), DistId: proto.Uint32(2)}, update, true},
+		{"Box mismatch", Filter{BoxId: proto.Uint32(5)}, update, false},
+		{"Box filter on message without meta", Filter{BoxId: proto.Uint32(1)}, distress, false},
+		{"Gateway event without events", Filter{}, event, false},
+		{"Gateway event with events", Filter{Variants: []KiezboxVariant{VariantUpdate}, Events: true}, event, true},
+		{"Packet with events", Filter{Variants: []KiezboxVariant{VariantUpdate}, Events: true}, update, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.filter.Match(tc.envelope))
+		})
+	}
+}
+
+func TestBusPublish(t *testing.T) {
+	bus := NewBus()
+	ctx := context.Background()
+	dropping := bus.Subscribe("dropping", Filter{}, 1, PolicyDrop)
+	blocking := bus.Subscribe("blocking", Filter{}, 1, PolicyBlock)
+	distressOnly := bus.Subscribe("distress", Filter{Variants: []KiezboxVariant{VariantDistress}}, 5, PolicyDrop)
+
+	bus.Publish(ctx, kiezboxEnvelope(testutils.CreateKiezboxMessage(time.Now().Unix())))
+
+	// The second publish blocks on the full blocking queue until it is read
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(ctx, kiezboxEnvelope(testutils.CreateDistressMessage(time.Now().Unix())))
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("Publish should block on a full PolicyBlock subscriber")
+	case <-time.After(10 * time.Millisecond):
+	}
+	<-blocking.C
+	<-published
+
+	stats := bus.Stats()
+	assert.Equal(t, []SubscriptionStats{
+		{Name: "dropping", Queued: 1, Capacity: 1, Delivered: 1, Dropped: 1},
+		{Name: "blocking", Queued: 1, Capacity: 1, Delivered: 2, Dropped: 0},
+		{Name: "distress", Queued: 1, Capacity: 5, Delivered: 1, Dropped: 0},
+	}, stats)
+	assert.Equal(t, VariantDistress, kiezboxVariant((<-distressOnly.C).Kiezbox))
+	<-dropping.C
+
+	// Unsubscribing releases a publisher blocked on that subscriber
+	published = make(chan struct{})
+	go func() {
+		bus.Publish(ctx, kiezboxEnvelope(testutils.CreateKiezboxMessage(time.Now().Unix())))
+		close(published)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	bus.Unsubscribe(blocking)
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Unsubscribe did not release the blocked publisher")
+	}
+	assert.Len(t, bus.Stats(), 2)
+}
+
+func TestBusUnsubscribeAll(t *testing.T) {
+	bus := NewBus()
+	first := bus.Subscribe("events", Filter{Events: true}, 1, PolicyDrop)
+	second := bus.Subscribe("events", Filter{Events: true}, 1, PolicyDrop)
+	other := bus.Subscribe("dbwriter", Filter{}, 1, PolicyDrop)
+
+	bus.UnsubscribeAll("events")
+
+	// The streams of all removed subscribers end, the others are kept
+	for _, subscription := range []*Subscription{first, second} {
+		select {
+		case <-subscription.Done():
+		default:
+			t.Fatal("Subscription was not removed")
+		}
+	}
+	select {
+	case <-other.Done():
+		t.Fatal("Subscription of another name was removed")
+	default:
+	}
+	assert.Len(t, bus.Stats(), 1)
+}
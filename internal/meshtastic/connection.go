@@ -0,0 +1,156 @@
+package meshtastic
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ConnState is the state of the connection to the meshtastic device
+type ConnState int
+
+const (
+	// StateDisconnected means the port is closed or could not be opened
+	StateDisconnected ConnState = iota
+	// StateOpening means the port is being opened
+	StateOpening
+	// StateAwaitingConfig means the config was requested and the device is streaming it
+	StateAwaitingConfig
+	// StateReady means the config handshake completed and the device accepts packets
+	StateReady
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateOpening:
+		return "opening"
+	case StateAwaitingConfig:
+		return "awaiting_config"
+	case StateReady:
+		return "ready"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// MarshalText encodes the state by name, e.g. for JSON API responses
+func (s ConnState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Transition is a single state change of the connection
+type Transition struct {
+	From   ConnState `json:"from"`
+	To     ConnState `json:"to"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// ConnStatus is a snapshot of the connection state machine
+type ConnStatus struct {
+	State    ConnState    `json:"state"`
+	ConfigId uint32       `json:"config_id"`
+	History  []Transition `json:"history"`
+}
+
+// Number of transitions kept in the history
+const maxConnHistory = 50
+
+// connection is the state machine tracking the config handshake with the device
+// The zero value is a disconnected connection
+type connection struct {
+	mutex    sync.Mutex
+	state    ConnState
+	configId uint32
+	history  []Transition
+	// changed is closed and replaced on every transition to wake up waiters
+	changed chan struct{}
+}
+
+// changedChan returns the channel closed on the next transition. The caller has to hold the lock.
+func (c *connection) changedChan() chan struct{} {
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.changed
+}
+
+// set moves the connection into a new state. The caller has to hold the lock.
+func (c *connection) set(state ConnState, reason string) {
+	if state == c.state {
+		return
+	}
+	slog.Info("Device connection state changed", "from", c.state, "to", state, "reason", reason)
+	c.history = append(c.history, Transition{From: c.state, To: state, Time: time.Now(), Reason: reason})
+	if len(c.history) > maxConnHistory {
+		c.history = c.history[len(c.history)-maxConnHistory:]
+	}
+	c.state = state
+	close(c.changedChan())
+	c.changed = make(chan struct{})
+}
+
+// transition safely moves the connection into a new state
+func (c *connection) transition(state ConnState, reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(state, reason)
+}
+
+// requestConfig generates a new config id for a handshake and moves to StateAwaitingConfig
+func (c *connection) requestConfig(reason string) uint32 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// A fresh id per handshake makes stale completions of an earlier handshake detectable
+	c.configId = rand.Uint32()
+	c.set(StateAwaitingConfig, reason)
+	return c.configId
+}
+
+// configComplete finishes the handshake if the id matches the requested one
+// It returns false for completions of unknown or stale handshakes
+func (c *connection) configComplete(configId uint32) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state != StateAwaitingConfig || configId != c.configId {
+		slog.Warn("Ignoring unexpected config completion", "config_id", configId, "expected", c.configId, "state", c.state)
+		return false
+	}
+	c.set(StateReady, "config complete")
+	return true
+}
+
+// ConnectionStatus returns the current state of the device connection and its recent transitions
+func (mts *MTSerial) ConnectionStatus() ConnStatus {
+	mts.conn.mutex.Lock()
+	defer mts.conn.mutex.Unlock()
+	history := make([]Transition, len(mts.conn.history))
+	copy(history, mts.conn.history)
+	return ConnStatus{
+		State:    mts.conn.state,
+		ConfigId: mts.conn.configId,
+		History:  history,
+	}
+}
+
+// WaitReady blocks until the config handshake with the device completed or the context is done
+func (mts *MTSerial) WaitReady(ctx context.Context) error {
+	for {
+		mts.conn.mutex.Lock()
+		state := mts.conn.state
+		changed := mts.conn.changedChan()
+		mts.conn.mutex.Unlock()
+		if state == StateReady {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package meshtastic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionHandshake(t *testing.T) {
+	mts := &MTSerial{}
+
+	// Nobody is ready before the handshake
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, mts.WaitReady(ctx), context.DeadlineExceeded)
+
+	mts.conn.transition(StateOpening, "opening port")
+	staleId := mts.conn.requestConfig("port opened")
+	// The device reboots mid handshake, the first handshake becomes stale
+	configId := mts.conn.requestConfig("device rebooted")
+	assert.NotEqual(t, staleId, configId)
+
+	ready := make(chan error)
+	go func() {
+		ready <- mts.WaitReady(context.Background())
+	}()
+
+	assert.False(t, mts.conn.configComplete(staleId))
+	assert.Equal(t, StateAwaitingConfig, mts.ConnectionStatus().State)
+	assert.True(t, mts.conn.configComplete(configId))
+	// A duplicated completion does not change anything
+	assert.False(t, mts.conn.configComplete(configId))
+
+	select {
+	case err := <-ready:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WaitReady did not return after the handshake completed")
+	}
+
+	status := mts.ConnectionStatus()
+	assert.Equal(t, StateReady, status.State)
+	assert.Equal(t, configId, status.ConfigId)
+	var states []ConnState
+	for _, transition := range status.History {
+		states = append(states, transition.To)
+	}
+	assert.Equal(t, []ConnState{StateOpening, StateAwaitingConfig, StateReady}, states)
+
+	// Closing the port makes the device unavailable again
+	mts.conn.transition(StateDisconnected, "port closed")
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, mts.WaitReady(ctx), context.DeadlineExceeded)
+}
+
+func TestConnectionHistoryBounded(t *testing.T) {
+	var conn connection
+	for i := 0; i < maxConnHistory; i++ {
+		conn.transition(StateOpening, "opening port")
+		conn.transition(StateDisconnected, "failed")
+	}
+	assert.Len(t, conn.history, maxConnHistory)
+	assert.Equal(t, StateDisconnected, conn.history[maxConnHistory-1].To)
+}
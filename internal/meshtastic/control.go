@@ -0,0 +1,204 @@
+package meshtastic
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// ErrInvalidControl is returned for control keys, values or filters which can not be put into a Control message
+var ErrInvalidControl = errors.New("invalid control value")
+
+// metaFilterKeys are the Meta fields addressed by the filter of BuildKiezboxControlMessage, in order
+var metaFilterKeys = []string{"box_id", "dist_id", "sens_id", "dev_type"}
+
+// ControlField describes a key which can be set with a Control message or used to address its receivers
+type ControlField struct {
+	Key    string   `json:"key"`
+	Type   string   `json:"type"`
+	Values []string `json:"values,omitempty"`
+}
+
+// ControlSchema lists the settable control keys and the meta keys to filter the receivers,
+// both taken from the protobuf descriptors, so new fields are available without code changes
+type ControlSchema struct {
+	Keys   []ControlField `json:"keys"`
+	Filter []ControlField `json:"filter"`
+}
+
+// GetControlSchema returns the schema of all keys accepted by BuildKiezboxControlMessage
+func GetControlSchema() ControlSchema {
+	schema := ControlSchema{}
+	fields := controlSetFields()
+	for i := 0; i < fields.Len(); i++ {
+		if field, ok := describeField(fields.Get(i)); ok {
+			schema.Keys = append(schema.Keys, field)
+		}
+	}
+	meta := (&generated.KiezboxMessage_Meta{}).ProtoReflect().Descriptor().Fields()
+	for _, key := range metaFilterKeys {
+		if field, ok := describeField(meta.ByName(protoreflect.Name(key))); ok {
+			schema.Filter = append(schema.Filter, field)
+		}
+	}
+	return schema
+}
+
+// BuildKiezboxControlMessage creates a Control message with only one field set, based on key and value.
+// The filter holds box_id, dist_id, sens_id and dev_type of the receivers, empty strings match every box.
+// It returns nil if the key, value or filter is invalid.
+func BuildKiezboxControlMessage(key string, value string, filter []string) *generated.KiezboxMessage_Control {
+	message, err := kiezboxControlMessage(key, value, filter)
+	if err != nil {
+		slog.Warn("Failed to build Kiezbox control message", "key", key, "value", value, "filter", filter, "err", err)
+		return nil
+	}
+	return message
+}
+
+// kiezboxControlMessage builds the Control message of BuildKiezboxControlMessage from the protobuf descriptor
+// Invalid keys, values or filters are reported as ErrInvalidControl.
+func kiezboxControlMessage(key string, value string, filter []string) (*generated.KiezboxMessage_Control, error) {
+	message := &generated.KiezboxMessage_Control{Meta: &generated.KiezboxMessage_Meta{}}
+	if err := SetControlValue(message, key, value); err != nil {
+		return nil, err
+	}
+	if len(filter) > len(metaFilterKeys) {
+		return nil, fmt.Errorf("%w: filter has %d elements, expected at most %d", ErrInvalidControl, len(filter), len(metaFilterKeys))
+	}
+	for i, value := range filter {
+		if value == "" {
+			continue
+		}
+		if err := SetMetaValue(message.Meta, metaFilterKeys[i], value); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// SetControlValue parses value according to the type of the Control field named key and sets it,
+// replacing any value which was set before
+func SetControlValue(message *generated.KiezboxMessage_Control, key string, value string) error {
+	field := controlSetFields().ByName(protoreflect.Name(key))
+	if field == nil {
+		return fmt.Errorf("%w: unknown key %q", ErrInvalidControl, key)
+	}
+	v, err := parseFieldValue(field, value)
+	if err != nil {
+		return err
+	}
+	message.ProtoReflect().Set(field, v)
+	return nil
+}
+
+// SetMetaValue parses value according to the type of the Meta field named key and sets it
+func SetMetaValue(meta *generated.KiezboxMessage_Meta, key string, value string) error {
+	field := meta.ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(key))
+	if field == nil {
+		return fmt.Errorf("%w: unknown filter %q", ErrInvalidControl, key)
+	}
+	v, err := parseFieldValue(field, value)
+	if err != nil {
+		return err
+	}
+	meta.ProtoReflect().Set(field, v)
+	return nil
+}
+
+// controlSetFields returns the fields of the "set" oneof, of which a Control message carries exactly one
+func controlSetFields() protoreflect.FieldDescriptors {
+	return (&generated.KiezboxMessage_Control{}).ProtoReflect().Descriptor().Oneofs().ByName("set").Fields()
+}
+
+// describeField returns the schema entry for a scalar field, message and bytes fields can not be set from a string
+func describeField(field protoreflect.FieldDescriptor) (ControlField, bool) {
+	if field == nil {
+		return ControlField{}, false
+	}
+	desc := ControlField{Key: string(field.Name()), Type: field.Kind().String()}
+	switch field.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind, protoreflect.BytesKind:
+		return ControlField{}, false
+	case protoreflect.EnumKind:
+		values := field.Enum().Values()
+		for i := 0; i < values.Len(); i++ {
+			desc.Values = append(desc.Values, string(values.Get(i).Name()))
+		}
+	}
+	return desc, true
+}
+
+// parseFieldValue converts the string value into the type of field.
+// Enums are accepted by name or number, as long as the number is a defined value.
+func parseFieldValue(field protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+	invalid := func(err error) (protoreflect.Value, error) {
+		return protoreflect.Value{}, fmt.Errorf("%w: %s=%q is not a valid %s: %w", ErrInvalidControl, field.Name(), value, field.Kind(), err)
+	}
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return invalid(err)
+		}
+		return protoreflect.ValueOfBool(v), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return invalid(err)
+		}
+		return protoreflect.ValueOfInt32(int32(v)), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return invalid(err)
+		}
+		return protoreflect.ValueOfInt64(v), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return invalid(err)
+		}
+		return protoreflect.ValueOfUint32(uint32(v)), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return invalid(err)
+		}
+		return protoreflect.ValueOfUint64(v), nil
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return invalid(err)
+		}
+		return protoreflect.ValueOfFloat32(float32(v)), nil
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return invalid(err)
+		}
+		return protoreflect.ValueOfFloat64(v), nil
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.EnumKind:
+		values := field.Enum().Values()
+		if v := values.ByName(protoreflect.Name(value)); v != nil {
+			return protoreflect.ValueOfEnum(v.Number()), nil
+		}
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return invalid(fmt.Errorf("unknown %s", field.Enum().Name()))
+		}
+		if v := values.ByNumber(protoreflect.EnumNumber(n)); v != nil {
+			return protoreflect.ValueOfEnum(v.Number()), nil
+		}
+		return invalid(fmt.Errorf("undefined %s %d", field.Enum().Name(), n))
+	default:
+		return protoreflect.Value{}, fmt.Errorf("%w: %s has unsupported type %s", ErrInvalidControl, field.Name(), field.Kind())
+	}
+}
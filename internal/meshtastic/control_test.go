@@ -0,0 +1,96 @@
+package meshtastic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+func TestBuildKiezboxControlMessage(t *testing.T) {
+	devType := func(t generated.KiezboxMessage_DeviceType) *generated.KiezboxMessage_DeviceType { return &t }
+	testCases := []struct {
+		name     string
+		key      string
+		value    string
+		filter   []string
+		expected *generated.KiezboxMessage_Control
+	}{
+		{"mode by name", "mode", "emergency", nil, &generated.KiezboxMessage_Control{
+			Set: &generated.KiezboxMessage_Control_Mode{Mode: generated.KiezboxMessage_emergency},
+		}},
+		{"mode by number", "mode", "1", nil, &generated.KiezboxMessage_Control{
+			Set: &generated.KiezboxMessage_Control_Mode{Mode: generated.KiezboxMessage_normal},
+		}},
+		{"int64", "unix_time", "1700000000", nil, &generated.KiezboxMessage_Control{
+			Set: &generated.KiezboxMessage_Control_UnixTime{UnixTime: 1700000000},
+		}},
+		{"bool", "enabled", "false", nil, &generated.KiezboxMessage_Control{
+			Set: &generated.KiezboxMessage_Control_Enabled{Enabled: false},
+		}},
+		{"int32", "sds_warmup_time", "-30", nil, &generated.KiezboxMessage_Control{
+			Set: &generated.KiezboxMessage_Control_SdsWarmupTime{SdsWarmupTime: -30},
+		}},
+		{"enum dev_type", "dev_type", "button", nil, &generated.KiezboxMessage_Control{
+			Set: &generated.KiezboxMessage_Control_DevType{DevType: generated.KiezboxMessage_button},
+		}},
+		{"filter", "button_id", "7", []string{"1", "", "3", "sensor"}, &generated.KiezboxMessage_Control{
+			Meta: &generated.KiezboxMessage_Meta{BoxId: proto.Uint32(1), SensId: proto.Uint32(3), DevType: devType(generated.KiezboxMessage_sensor)},
+			Set:  &generated.KiezboxMessage_Control_ButtonId{ButtonId: 7},
+		}},
+		{"numeric dev_type filter", "router_power", "true", []string{"", "2", "", "2"}, &generated.KiezboxMessage_Control{
+			Meta: &generated.KiezboxMessage_Meta{DistId: proto.Uint32(2), DevType: devType(generated.KiezboxMessage_display)},
+			Set:  &generated.KiezboxMessage_Control_RouterPower{RouterPower: true},
+		}},
+		{"unknown key", "meta", "1", nil, nil},
+		{"unknown enum name", "mode", "panic", nil, nil},
+		{"undefined enum number", "mode", "9", nil, nil},
+		{"uint32 overflow", "box_id", "4294967296", nil, nil},
+		{"negative uint32", "dist_id", "-1", nil, nil},
+		{"invalid bool", "router_power", "maybe", nil, nil},
+		{"invalid filter", "mode", "normal", []string{"x"}, nil},
+		{"invalid dev_type filter", "mode", "normal", []string{"", "", "", "lamp"}, nil},
+		{"too many filters", "mode", "normal", []string{"", "", "", "", ""}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			message, err := kiezboxControlMessage(tc.key, tc.value, tc.filter)
+			if tc.expected == nil {
+				assert.ErrorIs(t, err, ErrInvalidControl)
+				assert.Nil(t, message)
+				assert.Nil(t, BuildKiezboxControlMessage(tc.key, tc.value, tc.filter))
+				return
+			}
+			assert.NoError(t, err)
+			if tc.expected.Meta == nil {
+				tc.expected.Meta = &generated.KiezboxMessage_Meta{}
+			}
+			assert.True(t, proto.Equal(tc.expected, message), "got %v", message)
+			assert.True(t, proto.Equal(tc.expected, BuildKiezboxControlMessage(tc.key, tc.value, tc.filter)))
+		})
+	}
+}
+
+func TestGetControlSchema(t *testing.T) {
+	schema := GetControlSchema()
+
+	keys := map[string]ControlField{}
+	for _, field := range schema.Keys {
+		keys[field.Key] = field
+	}
+	// Every field of the set oneof is listed, also the ones added after the hand written builder
+	assert.Len(t, schema.Keys, controlSetFields().Len())
+	assert.Equal(t, ControlField{Key: "mode", Type: "enum", Values: []string{"maintenance", "normal", "emergency"}}, keys["mode"])
+	assert.Equal(t, ControlField{Key: "status_interval", Type: "int32"}, keys["status_interval"])
+	assert.Equal(t, ControlField{Key: "enabled", Type: "bool"}, keys["enabled"])
+	assert.Equal(t, ControlField{Key: "box_id", Type: "uint32"}, keys["box_id"])
+
+	assert.Equal(t, []ControlField{
+		{Key: "box_id", Type: "uint32"},
+		{Key: "dist_id", Type: "uint32"},
+		{Key: "sens_id", Type: "uint32"},
+		{Key: "dev_type", Type: "enum", Values: []string{"core", "sensor", "display", "button"}},
+	}, schema.Filter)
+}
@@ -0,0 +1,213 @@
+package meshtastic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Classes of framing errors counted by the FrameDecoder
+const (
+	FrameErrorBadStart = "bad_start" // start1 not followed by start2
+	FrameErrorOversize = "oversize"  // length header exceeds maxProtoSize
+	FrameErrorRejected = "rejected"  // frame rejected by the consumer, e.g. because it does not unmarshal
+)
+
+const (
+	// decoderChunkSize is the number of bytes requested from the stream per read
+	decoderChunkSize = 1024
+	// maxDebugLine is the length after which debug text without newline is emitted anyway
+	maxDebugLine = 1024
+	// maxEmptyReads is the number of reads without data and error after which the stream is considered broken
+	maxEmptyReads = 100
+)
+
+// DecoderStats counts what a FrameDecoder found in the stream
+type DecoderStats struct {
+	Frames       uint64            `json:"frames"`
+	DebugLines   uint64            `json:"debug_lines"`
+	SkippedBytes uint64            `json:"skipped_bytes"` // bytes of bad headers and rejected frames which were rescanned
+	Errors       map[string]uint64 `json:"errors"`
+}
+
+// FrameDecoder splits the byte stream of a meshtastic device into protobuf frames and debug text.
+// It reads the stream in chunks and searches the start bytes inside the buffered data.
+// After a bad header or a rejected frame it rescans from the byte after the start byte,
+// so a valid frame starting inside the bad one is not lost.
+type FrameDecoder struct {
+	r     io.Reader
+	buf   []byte
+	pos   int // start of the unprocessed data in buf
+	frame int // start of the last returned frame in buf, -1 if there is none
+	noise int // end of the rescanned bytes in buf, which are not debug text
+	debug []byte
+	stats DecoderStats
+	// DebugLine is called with every line of text the device printed between the frames
+	DebugLine func(line string)
+	// Error is called for every framing error, with one of the FrameError classes
+	Error func(class string)
+}
+
+// NewFrameDecoder creates a FrameDecoder reading from r
+func NewFrameDecoder(r io.Reader) *FrameDecoder {
+	return &FrameDecoder{
+		r:     r,
+		buf:   make([]byte, 0, 2*decoderChunkSize),
+		frame: -1,
+		stats: DecoderStats{Errors: make(map[string]uint64)},
+	}
+}
+
+// Next returns the payload of the next frame in the stream.
+// The payload is only valid until the next call of Next or Reject.
+// Errors of the underlying reader are returned as they are, data buffered until then is kept.
+func (d *FrameDecoder) Next() ([]byte, error) {
+	d.frame = -1
+	for {
+		if payload, ok := d.scan(); ok {
+			return payload, nil
+		}
+		if err := d.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reject marks the frame last returned by Next as invalid.
+// The next call of Next rescans the stream from the byte after its start byte.
+func (d *FrameDecoder) Reject() {
+	if d.frame < 0 {
+		return
+	}
+	d.stats.SkippedBytes += uint64(d.pos - d.frame)
+	d.noise = d.pos
+	d.pos = d.frame + 1
+	d.frame = -1
+	d.fail(FrameErrorRejected)
+}
+
+// Stats returns a copy of the counters of the decoder
+func (d *FrameDecoder) Stats() DecoderStats {
+	stats := d.stats
+	stats.Errors = make(map[string]uint64, len(d.stats.Errors))
+	for class, count := range d.stats.Errors {
+		stats.Errors[class] = count
+	}
+	return stats
+}
+
+// scan looks for a complete frame in the buffered data.
+// Bytes in front of a frame are handled as debug text.
+func (d *FrameDecoder) scan() ([]byte, bool) {
+	for {
+		i := bytes.IndexByte(d.buf[d.pos:], start1)
+		if i < 0 {
+			d.skip(len(d.buf) - d.pos)
+			return nil, false
+		}
+		d.skip(i)
+		data := d.buf[d.pos:]
+
+		if len(data) < 2 {
+			return nil, false
+		}
+		if data[1] != start2 {
+			// A stray start1, it stays part of the debug text
+			d.fail(FrameErrorBadStart)
+			d.skip(1)
+			continue
+		}
+		if len(data) < 4 {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length > maxProtoSize {
+			// Resync on the byte after the bad header
+			d.fail(FrameErrorOversize)
+			d.stats.SkippedBytes++
+			d.noise = max(d.noise, d.pos+4)
+			d.pos++
+			continue
+		}
+		if len(data) < 4+length {
+			return nil, false
+		}
+		d.flushText()
+		d.frame = d.pos
+		d.pos += 4 + length
+		d.stats.Frames++
+		return data[4 : 4+length], true
+	}
+}
+
+// fill reads the next chunk from the stream, dropping the data which is already processed
+func (d *FrameDecoder) fill() error {
+	if d.pos > 0 {
+		n := copy(d.buf, d.buf[d.pos:])
+		d.buf = d.buf[:n]
+		d.noise = max(d.noise-d.pos, 0)
+		d.pos = 0
+	}
+	if cap(d.buf)-len(d.buf) < decoderChunkSize {
+		grown := make([]byte, len(d.buf), len(d.buf)+2*decoderChunkSize)
+		copy(grown, d.buf)
+		d.buf = grown
+	}
+	// Like bufio, a few empty reads are tolerated before giving up
+	for i := 0; i < maxEmptyReads; i++ {
+		n, err := d.r.Read(d.buf[len(d.buf) : len(d.buf)+decoderChunkSize])
+		d.buf = d.buf[:len(d.buf)+n]
+		if n > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return io.ErrNoProgress
+}
+
+// skip passes n bytes in front of the next start byte, the ones which were not rescanned are debug text
+func (d *FrameDecoder) skip(n int) {
+	if end := d.pos + n; end > d.noise {
+		d.text(d.buf[max(d.pos, d.noise):end])
+	}
+	d.pos += n
+}
+
+// text collects debug text and emits it line by line
+func (d *FrameDecoder) text(data []byte) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			d.debug = append(d.debug, data...)
+			if len(d.debug) >= maxDebugLine {
+				d.flushText()
+			}
+			return
+		}
+		d.debug = append(d.debug, data[:i]...)
+		d.flushText()
+		data = data[i+1:]
+	}
+}
+
+// flushText emits the collected debug text as line, a frame also ends the line
+func (d *FrameDecoder) flushText() {
+	line := bytes.TrimRight(d.debug, "\r")
+	d.debug = d.debug[:0]
+	if len(line) == 0 {
+		return
+	}
+	d.stats.DebugLines++
+	if d.DebugLine != nil {
+		d.DebugLine(string(line))
+	}
+}
+
+func (d *FrameDecoder) fail(class string) {
+	d.stats.Errors[class]++
+	if d.Error != nil {
+		d.Error(class)
+	}
+}
@@ -0,0 +1,165 @@
+package meshtastic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chunkReader returns the stream in reads of at most size bytes, like a serial port delivering what has arrived
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.size)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// decodeAll decodes the whole stream and rejects every frame which is not the next expected payload
+func decodeAll(t *testing.T, r io.Reader, expected [][]byte) ([][]byte, []string, DecoderStats) {
+	decoder := NewFrameDecoder(r)
+	var lines []string
+	decoder.DebugLine = func(line string) {
+		lines = append(lines, line)
+	}
+	var frames [][]byte
+	for {
+		payload, err := decoder.Next()
+		if err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			return frames, lines, decoder.Stats()
+		}
+		if len(frames) < len(expected) && bytes.Equal(payload, expected[len(frames)]) {
+			frames = append(frames, bytes.Clone(payload))
+		} else {
+			decoder.Reject()
+		}
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestFrameDecoder(t *testing.T) {
+	first := []byte{0x08, 0x01, 0x10, 0x02}
+	second := []byte("second frame with \x94\xc3 inside")
+
+	testCases := []struct {
+		name     string
+		stream   []byte
+		expected [][]byte
+		lines    []string
+		errors   map[string]uint64
+	}{
+		{
+			name:     "Frames only",
+			stream:   concat(EncodeFrame(first), EncodeFrame(second)),
+			expected: [][]byte{first, second},
+			errors:   map[string]uint64{},
+		},
+		{
+			name:     "Empty frame",
+			stream:   EncodeFrame([]byte{}),
+			expected: [][]byte{{}},
+			errors:   map[string]uint64{},
+		},
+		{
+			name:     "Debug text between frames",
+			stream:   concat([]byte("INFO  | booting\r\n"), EncodeFrame(first), []byte("DEBUG | hello\n\n"), EncodeFrame(second), []byte("trailing\n")),
+			expected: [][]byte{first, second},
+			lines:    []string{"INFO  | booting", "DEBUG | hello", "trailing"},
+			errors:   map[string]uint64{},
+		},
+		{
+			name:     "Stray start byte in text",
+			stream:   concat([]byte("a\x94b\n"), EncodeFrame(first)),
+			expected: [][]byte{first},
+			lines:    []string{"a\x94b"},
+			errors:   map[string]uint64{FrameErrorBadStart: 1},
+		},
+		{
+			name:     "Oversize header",
+			stream:   concat([]byte{start1, start2, 0xFF, 0xFF}, EncodeFrame(first)),
+			expected: [][]byte{first},
+			errors:   map[string]uint64{FrameErrorOversize: 1},
+		},
+		{
+			name:     "Frame inside a rejected frame",
+			stream:   concat([]byte{start1, start2, 0x00, 0x08}, EncodeFrame(first), EncodeFrame(second)),
+			expected: [][]byte{first, second},
+			errors:   map[string]uint64{FrameErrorRejected: 1},
+		},
+		{
+			name:     "Truncated frame",
+			stream:   concat(EncodeFrame(first), EncodeFrame(second)[:10]),
+			expected: [][]byte{first},
+			errors:   map[string]uint64{},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			readers := map[string]io.Reader{
+				"chunk":    bytes.NewReader(tc.stream),
+				"one byte": iotest.OneByteReader(bytes.NewReader(tc.stream)),
+			}
+			for name, r := range readers {
+				frames, lines, stats := decodeAll(t, r, tc.expected)
+				assert.Equal(t, tc.expected, frames, name)
+				assert.Equal(t, tc.lines, lines, name)
+				assert.Equal(t, tc.errors, stats.Errors, name)
+			}
+		})
+	}
+}
+
+func TestFrameDecoderReadError(t *testing.T) {
+	decoder := NewFrameDecoder(iotest.ErrReader(io.ErrClosedPipe))
+	_, err := decoder.Next()
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// Reads without data and without error do not block forever
+	decoder = NewFrameDecoder(&chunkReader{data: []byte("x"), size: 0})
+	_, err = decoder.Next()
+	assert.ErrorIs(t, err, io.ErrNoProgress)
+}
+
+func FuzzFrameDecoder(f *testing.F) {
+	f.Add([]byte{}, uint8(0))
+	f.Add([]byte("INFO  | random text without newline"), uint8(3))
+	f.Add([]byte{start1, start2, 0x00, 0x10, start1, start1, start2, 0x02, 0x00, 0x94}, uint8(1))
+	f.Add([]byte{start1, start2, 0x01, 0xFF, 0x00, start1, start2, 0x00, 0x00, '\n'}, uint8(16))
+	f.Add(bytes.Repeat([]byte{start1, start2, 0x00, 0x30}, 40), uint8(7))
+
+	f.Fuzz(func(t *testing.T, garbage []byte, chunk uint8) {
+		// Valid frames are interleaved with debug text and the garbage of the fuzzer
+		const parts = 6
+		var stream []byte
+		var expected [][]byte
+		for i := 0; i < parts; i++ {
+			stream = append(stream, garbage[i*len(garbage)/parts:(i+1)*len(garbage)/parts]...)
+			stream = append(stream, fmt.Sprintf("DEBUG | line %d\n", i)...)
+			payload := []byte(fmt.Sprintf("frame %d \x94\xc3\x00\x01", i))
+			stream = append(stream, EncodeFrame(payload)...)
+			expected = append(expected, payload)
+		}
+		// Padding completes frames claimed by garbage headers, so the decoder rescans them
+		stream = append(stream, bytes.Repeat([]byte{'\n'}, maxProtoSize+4)...)
+
+		frames, _, stats := decodeAll(t, &chunkReader{data: stream, size: int(chunk)%64 + 1}, expected)
+		assert.Equal(t, expected, frames)
+		assert.GreaterOrEqual(t, stats.Frames, uint64(parts))
+	})
+}
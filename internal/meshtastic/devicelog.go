@@ -0,0 +1,195 @@
+package meshtastic
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "kiezbox/internal/config"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Levels of the firmware log, ordered like the slog levels they are forwarded with
+var deviceLogLevels = map[string]slog.Level{
+	"TRACE":    slog.LevelDebug - 4,
+	"DEBUG":    slog.LevelDebug,
+	"INFO":     slog.LevelInfo,
+	"WARN":     slog.LevelWarn,
+	"ERROR":    slog.LevelError,
+	"CRITICAL": slog.LevelError + 4,
+}
+
+// Aliases of the level names used by the text log and the LogRecord protobuf
+var deviceLogLevelAliases = map[string]string{
+	"CRIT":    "CRITICAL",
+	"WARNING": "WARN",
+}
+
+// deviceLogLine matches lines like "INFO  | 12:34:56 123 [Router] Received routing" printed by the firmware,
+// followed by the uptime in seconds. The clock is ??:??:?? as long as the device has no time, the thread name is optional.
+var deviceLogLine = regexp.MustCompile(`^(TRACE|DEBUG|INFO|WARN|ERROR|CRIT)\s*\|\s*(?:(?:\d{2}|\?\?):(?:\d{2}|\?\?):(?:\d{2}|\?\?)\s+(\d+)\s+)?(?:\[([^\]]*)\]\s*)?(.*)$`)
+
+// ansiEscape matches the color codes of the firmware log
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// DeviceLogRecord is a log message of the meshtastic firmware
+type DeviceLogRecord struct {
+	Time       time.Time `json:"time"` // when the gateway received the message
+	Level      string    `json:"level"`
+	Module     string    `json:"module,omitempty"`
+	Message    string    `json:"message"`
+	Uptime     *uint32   `json:"uptime,omitempty"`      // seconds since the device booted
+	DeviceTime int64     `json:"device_time,omitempty"` // unix time of the device, if it is known
+}
+
+// ParseDeviceLogLine parses a line of the text log which the device prints between the frames
+// Lines without the level prefix, like the boot banner, are kept as INFO messages.
+func ParseDeviceLogLine(line string) DeviceLogRecord {
+	line = strings.TrimSpace(ansiEscape.ReplaceAllString(line, ""))
+	record := DeviceLogRecord{Time: time.Now(), Level: "INFO", Message: line}
+	match := deviceLogLine.FindStringSubmatch(line)
+	if match == nil {
+		return record
+	}
+	record.Level = normalizeDeviceLogLevel(match[1])
+	if match[2] != "" {
+		if uptime, err := strconv.ParseUint(match[2], 10, 32); err == nil {
+			value := uint32(uptime)
+			record.Uptime = &value
+		}
+	}
+	record.Module = match[3]
+	record.Message = strings.TrimSpace(match[4])
+	return record
+}
+
+// DeviceLogFromRecord converts a LogRecord which the device sends instead of the text log
+// if debug_log_api_enabled is set in its security config
+func DeviceLogFromRecord(logRecord *generated.LogRecord) DeviceLogRecord {
+	record := DeviceLogRecord{
+		Time:    time.Now(),
+		Level:   "INFO",
+		Module:  logRecord.GetSource(),
+		Message: strings.TrimSpace(logRecord.GetMessage()),
+	}
+	if logRecord.GetLevel() != generated.LogRecord_UNSET {
+		record.Level = normalizeDeviceLogLevel(logRecord.GetLevel().String())
+	}
+	if logRecord.GetTime() != 0 {
+		record.DeviceTime = int64(logRecord.GetTime())
+	}
+	return record
+}
+
+func normalizeDeviceLogLevel(level string) string {
+	level = strings.ToUpper(strings.TrimSpace(level))
+	if alias, ok := deviceLogLevelAliases[level]; ok {
+		return alias
+	}
+	return level
+}
+
+// ParseDeviceLogLevel returns the name of a firmware log level, accepting any case and the aliases
+func ParseDeviceLogLevel(level string) (string, error) {
+	name := normalizeDeviceLogLevel(level)
+	if _, ok := deviceLogLevels[name]; !ok {
+		return "", fmt.Errorf("unknown device log level %q", level)
+	}
+	return name, nil
+}
+
+// DeviceLogFilter selects records of the DeviceLog, empty fields match all records
+type DeviceLogFilter struct {
+	Level  string // minimum level
+	Module string
+	Text   string // case insensitive substring of the message
+	Limit  int    // maximum number of records, the newest are kept
+}
+
+// DeviceLog keeps the latest log messages of the device in memory
+type DeviceLog struct {
+	mutex   sync.RWMutex
+	size    int
+	records []DeviceLogRecord
+}
+
+// NewDeviceLog creates a DeviceLog which keeps at most size records
+func NewDeviceLog(size int) *DeviceLog {
+	return &DeviceLog{size: size}
+}
+
+// Add appends a record, dropping the oldest one if the log is full
+func (l *DeviceLog) Add(record DeviceLogRecord) {
+	if l == nil || l.size <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.records = append(l.records, record)
+	if len(l.records) > l.size {
+		l.records = l.records[len(l.records)-l.size:]
+	}
+}
+
+// Records returns a copy of the records matching the filter, oldest first
+func (l *DeviceLog) Records(filter DeviceLogFilter) []DeviceLogRecord {
+	records := []DeviceLogRecord{}
+	if l == nil {
+		return records
+	}
+	minLevel, filterLevel := deviceLogLevels[normalizeDeviceLogLevel(filter.Level)]
+	text := strings.ToLower(filter.Text)
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, record := range l.records {
+		if filterLevel && deviceLogLevels[record.Level] < minLevel {
+			continue
+		}
+		if filter.Module != "" && !strings.EqualFold(record.Module, filter.Module) {
+			continue
+		}
+		if text != "" && !strings.Contains(strings.ToLower(record.Message), text) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[len(records)-filter.Limit:]
+	}
+	return records
+}
+
+// DeviceLogs returns the latest log messages of the device
+func (mts *MTSerial) DeviceLogs() *DeviceLog {
+	return mts.logs
+}
+
+// addDeviceLog keeps a log message of the device and forwards it to slog if serial logging is enabled
+func (mts *MTSerial) addDeviceLog(record DeviceLogRecord) {
+	if record.Message == "" {
+		return
+	}
+	mts.logs.Add(record)
+	if !cfg.Cfg.LogSerial {
+		return
+	}
+	// Not "source", which holds the file and line of the log call with AddSource
+	attrs := []slog.Attr{slog.String("origin", "device")}
+	if record.Module != "" {
+		attrs = append(attrs, slog.String("module", record.Module))
+	}
+	if record.Uptime != nil {
+		attrs = append(attrs, slog.Uint64("uptime", uint64(*record.Uptime)))
+	}
+	level, ok := deviceLogLevels[record.Level]
+	if !ok {
+		level = slog.LevelInfo
+	}
+	slog.LogAttrs(context.Background(), level, record.Message, attrs...)
+}
@@ -0,0 +1,119 @@
+package meshtastic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+func uptime(seconds uint32) *uint32 {
+	return &seconds
+}
+
+func TestParseDeviceLogLine(t *testing.T) {
+	testCases := []struct {
+		name     string
+		line     string
+		expected DeviceLogRecord
+	}{
+		{
+			name:     "Full line",
+			line:     "INFO  | 12:34:56 123 [Router] Received routing from=0x1234",
+			expected: DeviceLogRecord{Level: "INFO", Module: "Router", Message: "Received routing from=0x1234", Uptime: uptime(123)},
+		},
+		{
+			name:     "Unknown time",
+			line:     "WARN  | ??:??:?? 5 [RadioIf] Ignore false preamble detection",
+			expected: DeviceLogRecord{Level: "WARN", Module: "RadioIf", Message: "Ignore false preamble detection", Uptime: uptime(5)},
+		},
+		{
+			name:     "Colored critical line",
+			line:     "\x1b[31mCRIT  | 00:00:07 7 [Power] Battery low\x1b[0m",
+			expected: DeviceLogRecord{Level: "CRITICAL", Module: "Power", Message: "Battery low", Uptime: uptime(7)},
+		},
+		{
+			name:     "Without thread",
+			line:     "DEBUG | 00:00:01 1 Start meshtastic",
+			expected: DeviceLogRecord{Level: "DEBUG", Message: "Start meshtastic", Uptime: uptime(1)},
+		},
+		{
+			name:     "Without time",
+			line:     "ERROR | 5 nodes lost",
+			expected: DeviceLogRecord{Level: "ERROR", Message: "5 nodes lost"},
+		},
+		{
+			name:     "Boot banner",
+			line:     "//\\ E S H T /\\ S T / C  ",
+			expected: DeviceLogRecord{Level: "INFO", Message: "//\\ E S H T /\\ S T / C"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			record := ParseDeviceLogLine(tc.line)
+			assert.False(t, record.Time.IsZero())
+			record.Time = tc.expected.Time
+			assert.Equal(t, tc.expected, record)
+		})
+	}
+}
+
+func TestDeviceLogFromRecord(t *testing.T) {
+	record := DeviceLogFromRecord(&generated.LogRecord{
+		Message: "Received text msg\n",
+		Time:    1700000000,
+		Source:  "TextMessage",
+		Level:   generated.LogRecord_WARNING,
+	})
+	assert.Equal(t, "WARN", record.Level)
+	assert.Equal(t, "TextMessage", record.Module)
+	assert.Equal(t, "Received text msg", record.Message)
+	assert.Equal(t, int64(1700000000), record.DeviceTime)
+
+	record = DeviceLogFromRecord(&generated.LogRecord{Message: "unset level"})
+	assert.Equal(t, "INFO", record.Level)
+	assert.Zero(t, record.DeviceTime)
+}
+
+func TestDeviceLog(t *testing.T) {
+	log := NewDeviceLog(3)
+	log.Add(DeviceLogRecord{Level: "DEBUG", Module: "Router", Message: "dropped"})
+	log.Add(DeviceLogRecord{Level: "DEBUG", Module: "Router", Message: "Received routing"})
+	log.Add(DeviceLogRecord{Level: "WARN", Module: "Power", Message: "Battery low"})
+	log.Add(DeviceLogRecord{Level: "ERROR", Module: "RadioIf", Message: "Radio TX failed"})
+
+	messages := func(records []DeviceLogRecord) []string {
+		result := []string{}
+		for _, record := range records {
+			result = append(result, record.Message)
+		}
+		return result
+	}
+
+	// The oldest record was dropped
+	assert.Equal(t, []string{"Received routing", "Battery low", "Radio TX failed"}, messages(log.Records(DeviceLogFilter{})))
+	assert.Equal(t, []string{"Battery low", "Radio TX failed"}, messages(log.Records(DeviceLogFilter{Level: "WARN"})))
+	assert.Equal(t, []string{"Radio TX failed"}, messages(log.Records(DeviceLogFilter{Level: "error"})))
+	assert.Equal(t, []string{"Received routing"}, messages(log.Records(DeviceLogFilter{Module: "router"})))
+	assert.Equal(t, []string{"Battery low"}, messages(log.Records(DeviceLogFilter{Text: "BATTERY"})))
+	assert.Equal(t, []string{"Radio TX failed"}, messages(log.Records(DeviceLogFilter{Limit: 1})))
+	assert.Equal(t, []string{}, messages(log.Records(DeviceLogFilter{Level: "CRITICAL"})))
+
+	var missing *DeviceLog
+	missing.Add(DeviceLogRecord{Message: "ignored"})
+	assert.Empty(t, missing.Records(DeviceLogFilter{}))
+}
+
+func TestParseDeviceLogLevel(t *testing.T) {
+	level, err := ParseDeviceLogLevel("warning")
+	assert.NoError(t, err)
+	assert.Equal(t, "WARN", level)
+	level, err = ParseDeviceLogLevel("crit")
+	assert.NoError(t, err)
+	assert.Equal(t, "CRITICAL", level)
+	_, err = ParseDeviceLogLevel("verbose")
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package meshtastic
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/metrics"
+)
+
+// Gateway internals exported for Prometheus
+var (
+	framesRead        = metrics.Factory.NewCounter(prometheus.CounterOpts{Name: "kiezbox_frames_read_total", Help: "Frames read from the meshtastic device"})
+	framesWritten     = metrics.Factory.NewCounter(prometheus.CounterOpts{Name: "kiezbox_frames_written_total", Help: "Frames written to the meshtastic device"})
+	frameErrors       = metrics.Factory.NewCounterVec(prometheus.CounterOpts{Name: "kiezbox_frame_errors_total", Help: "Framing errors in the stream from the meshtastic device"}, []string{"class"})
+	unmarshalFailures = metrics.Factory.NewCounterVec(prometheus.CounterOpts{Name: "kiezbox_unmarshal_failures_total", Help: "Protobuf messages from the device which could not be unmarshalled"}, []string{"message"})
+	deviceReconnects  = metrics.Factory.NewCounter(prometheus.CounterOpts{Name: "kiezbox_device_reconnects_total", Help: "Attempts to reopen the connection to the meshtastic device"})
+)
+
+// Labels of the box telemetry gauges
+var telemetryLabels = []string{"box_id", "dist_id", "sens_id"}
+
+// Latest core and sensor values, one gauge per protobuf field
+var (
+	coreGauges      = valueGauges("core", (&generated.KiezboxMessage_CoreValues{}).ProtoReflect().Descriptor())
+	sensorGauges    = valueGauges("sensor", (&generated.KiezboxMessage_SensorValues{}).ProtoReflect().Descriptor())
+	updateTimestamp = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{Name: "kiezbox_update_timestamp_seconds", Help: "Unix time of the latest update of a box"}, append([]string{"module"}, telemetryLabels...))
+)
+
+// valueGauges creates a gauge for every field of a values message
+func valueGauges(module string, descriptor protoreflect.MessageDescriptor) map[protoreflect.Name]*prometheus.GaugeVec {
+	gauges := make(map[protoreflect.Name]*prometheus.GaugeVec)
+	fields := descriptor.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		name := fields.Get(i).Name()
+		gauges[name] = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kiezbox_" + module + "_" + string(name),
+			Help: "Latest " + string(name) + " reported by the " + module + " module",
+		}, telemetryLabels)
+	}
+	return gauges
+}
+
+// observeUpdate sets the telemetry gauges from a KiezboxMessage Update
+// The values are scaled like the datapoints written to the database.
+func observeUpdate(update *generated.KiezboxMessage_Update) {
+	labels := []string{"", "", ""}
+	if meta := update.GetMeta(); meta != nil {
+		if meta.BoxId != nil {
+			labels[0] = strconv.FormatUint(uint64(meta.GetBoxId()), 10)
+		}
+		if meta.DistId != nil {
+			labels[1] = strconv.FormatUint(uint64(meta.GetDistId()), 10)
+		}
+		if meta.SensId != nil {
+			labels[2] = strconv.FormatUint(uint64(meta.GetSensId()), 10)
+		}
+	}
+
+	var module string
+	var values protoreflect.Message
+	var gauges map[protoreflect.Name]*prometheus.GaugeVec
+	switch {
+	case update.GetCore().GetValues() != nil:
+		module, values, gauges = "core", update.GetCore().GetValues().ProtoReflect(), coreGauges
+	case update.GetSensor().GetValues() != nil:
+		module, values, gauges = "sensor", update.GetSensor().GetValues().ProtoReflect(), sensorGauges
+	default:
+		return
+	}
+	values.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if intVal, ok := v.Interface().(int32); ok {
+			gauges[fd.Name()].WithLabelValues(labels...).Set(float64(intVal) / 1000.0)
+		}
+		return true
+	})
+	updateTimestamp.WithLabelValues(append([]string{module}, labels...)...).Set(float64(update.GetUnixTime()))
+}
+
+// Depth of the device channels and bus subscriptions, collected on every scrape
+var queueDepth = prometheus.NewDesc("kiezbox_queue_depth", "Messages waiting in the internal queues", []string{"queue"}, nil)
+
+// queueCollector exports the fill level of the device channels and bus subscriptions
+type queueCollector struct {
+	mts *MTSerial
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepth
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(queueDepth, prometheus.GaugeValue, float64(len(c.mts.ToChan)), "to_device")
+	ch <- prometheus.MustNewConstMetric(queueDepth, prometheus.GaugeValue, float64(len(c.mts.FromChan)), "from_device")
+	// Several subscriptions may share a name (like the event streams of the API clients)
+	queued := make(map[string]int)
+	var names []string
+	for _, stats := range c.mts.Bus.Stats() {
+		if _, ok := queued[stats.Name]; !ok {
+			names = append(names, stats.Name)
+		}
+		queued[stats.Name] += stats.Queued
+	}
+	for _, name := range names {
+		ch <- prometheus.MustNewConstMetric(queueDepth, prometheus.GaugeValue, float64(queued[name]), "bus_"+name)
+	}
+}
+
+// RegisterMetrics exports the fill level of the device channels and bus subscriptions to the registerer
+func (mts *MTSerial) RegisterMetrics(registerer prometheus.Registerer) error {
+	return registerer.Register(queueCollector{mts: mts})
+}
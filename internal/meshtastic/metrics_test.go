@@ -0,0 +1,53 @@
+package meshtastic
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+func TestObserveUpdate(t *testing.T) {
+	observeUpdate(&generated.KiezboxMessage_Update{
+		Meta:     &generated.KiezboxMessage_Meta{BoxId: proto.Uint32(7), DistId: proto.Uint32(3)},
+		UnixTime: 1700000000,
+		Core: &generated.KiezboxMessage_Core{
+			Values: &generated.KiezboxMessage_CoreValues{TempIn: proto.Int32(21500)},
+		},
+	})
+	assert.Equal(t, 21.5, testutil.ToFloat64(coreGauges["temp_in"].WithLabelValues("7", "3", "")))
+	assert.Equal(t, float64(1700000000), testutil.ToFloat64(updateTimestamp.WithLabelValues("core", "7", "3", "")))
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	mts := &MTSerial{
+		FromChan: make(chan *generated.FromRadio, 10),
+		ToChan:   make(chan *generated.ToRadio, 10),
+		Bus:      NewBus(),
+	}
+	mts.ToChan <- &generated.ToRadio{}
+	mts.Bus.Subscribe("test", Filter{}, 4, PolicyDrop)
+	// Subscriptions with the same name are reported together
+	mts.Bus.Subscribe("events", Filter{Events: true}, 4, PolicyDrop)
+	mts.Bus.Subscribe("events", Filter{Events: true}, 4, PolicyDrop)
+	mts.publishEvent(EventMode, map[string]any{"mode": 1})
+
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, mts.RegisterMetrics(registry))
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP kiezbox_queue_depth Messages waiting in the internal queues
+# TYPE kiezbox_queue_depth gauge
+kiezbox_queue_depth{queue="bus_events"} 2
+kiezbox_queue_depth{queue="bus_test"} 0
+kiezbox_queue_depth{queue="from_device"} 0
+kiezbox_queue_depth{queue="to_device"} 1
+`)))
+	// Registering a second device fails instead of replacing the metrics of the first one
+	assert.Error(t, (&MTSerial{}).RegisterMetrics(registry))
+}
@@ -0,0 +1,304 @@
+package meshtastic
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Node is the gateway's view on a single node of the mesh
+type Node struct {
+	Num             uint32   `json:"num"`
+	Id              string   `json:"id,omitempty"`
+	LongName        string   `json:"long_name,omitempty"`
+	ShortName       string   `json:"short_name,omitempty"`
+	HwModel         string   `json:"hw_model,omitempty"`
+	Role            string   `json:"role,omitempty"`
+	FirmwareVersion string   `json:"firmware_version,omitempty"`
+	IsLocal         bool     `json:"is_local"`
+	LastHeard       int64    `json:"last_heard,omitempty"`
+	Snr             float32  `json:"snr"`
+	HopsAway        *uint32  `json:"hops_away,omitempty"`
+	BatteryLevel    *uint32  `json:"battery_level,omitempty"`
+	Voltage         *float32 `json:"voltage,omitempty"`
+	Latitude        *float64 `json:"latitude,omitempty"`
+	Longitude       *float64 `json:"longitude,omitempty"`
+	Altitude        *int32   `json:"altitude,omitempty"`
+	// BoxId and DistId are taken from the meta of the KiezboxMessage updates sent by the node
+	BoxId  *uint32 `json:"box_id,omitempty"`
+	DistId *uint32 `json:"dist_id,omitempty"`
+}
+
+// radioConfig holds the configuration of the local device as streamed during the config handshake
+type radioConfig struct {
+	Metadata     *generated.DeviceMetadata
+	Channels     map[int32]*generated.Channel
+	Config       map[string]*generated.Config
+	ModuleConfig map[string]*generated.ModuleConfig
+}
+
+// NodeDB is the registry of all nodes known to the gateway
+// It is populated from the config handshake and kept up to date from live packets
+type NodeDB struct {
+	mutex sync.RWMutex
+	nodes map[uint32]*Node
+	radio radioConfig
+	// Number of the node the gateway is connected to, 0 until MyInfo is received
+	myNodeNum uint32
+}
+
+// NewNodeDB creates an empty node registry
+func NewNodeDB() *NodeDB {
+	return &NodeDB{
+		nodes: make(map[uint32]*Node),
+		radio: radioConfig{
+			Channels:     make(map[int32]*generated.Channel),
+			Config:       make(map[string]*generated.Config),
+			ModuleConfig: make(map[string]*generated.ModuleConfig),
+		},
+	}
+}
+
+// node returns the entry for a node number, creating it if needed. The caller has to hold the lock.
+func (n *NodeDB) node(num uint32) *Node {
+	node, ok := n.nodes[num]
+	if !ok {
+		node = &Node{Num: num}
+		n.nodes[num] = node
+	}
+	return node
+}
+
+// List returns a copy of all known nodes, ordered by node number
+func (n *NodeDB) List() []Node {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	nodes := make([]Node, 0, len(n.nodes))
+	for _, node := range n.nodes {
+		nodes = append(nodes, *node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Num < nodes[j].Num })
+	return nodes
+}
+
+// Get returns a copy of a single node and false if the node is unknown
+func (n *NodeDB) Get(num uint32) (Node, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	node, ok := n.nodes[num]
+	if !ok {
+		return Node{}, false
+	}
+	return *node, true
+}
+
+// FindBox returns the number of the node which sends the updates of a kiezbox.
+// The district is only compared if given. False is returned unless exactly one node matches.
+func (n *NodeDB) FindBox(boxId uint32, distId *uint32) (uint32, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	var num uint32
+	matches := 0
+	for _, node := range n.nodes {
+		if node.BoxId == nil || *node.BoxId != boxId {
+			continue
+		}
+		if distId != nil && (node.DistId == nil || *node.DistId != *distId) {
+			continue
+		}
+		num = node.Num
+		matches++
+	}
+	return num, matches == 1
+}
+
+// SetMyInfo marks the node the gateway is connected to
+func (n *NodeDB) SetMyInfo(myInfo *generated.MyNodeInfo) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, node := range n.nodes {
+		node.IsLocal = false
+	}
+	n.myNodeNum = myInfo.GetMyNodeNum()
+	n.node(n.myNodeNum).IsLocal = true
+}
+
+// MyNodeNum returns the number of the node the gateway is connected to, false before it is known
+func (n *NodeDB) MyNodeNum() (uint32, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.myNodeNum, n.myNodeNum != 0
+}
+
+// SetNodeInfo stores a NodeInfo as streamed by the device during the config handshake
+func (n *NodeDB) SetNodeInfo(info *generated.NodeInfo) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	node := n.node(info.GetNum())
+	node.applyUser(info.GetUser())
+	node.applyPosition(info.GetPosition())
+	node.applyDeviceMetrics(info.GetDeviceMetrics())
+	node.Snr = info.GetSnr()
+	if info.GetLastHeard() != 0 {
+		node.LastHeard = int64(info.GetLastHeard())
+	}
+	if info.HopsAway != nil {
+		node.HopsAway = proto.Uint32(info.GetHopsAway())
+	}
+}
+
+// SetMetadata stores the metadata of the local device
+func (n *NodeDB) SetMetadata(myNodeNum uint32, metadata *generated.DeviceMetadata) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.radio.Metadata = metadata
+	if myNodeNum != 0 {
+		node := n.node(myNodeNum)
+		node.FirmwareVersion = metadata.GetFirmwareVersion()
+		if node.HwModel == "" {
+			node.HwModel = metadata.GetHwModel().String()
+		}
+	}
+}
+
+// SetChannel stores a channel of the local device
+func (n *NodeDB) SetChannel(channel *generated.Channel) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.radio.Channels[channel.GetIndex()] = channel
+}
+
+// SetConfig stores a config section of the local device, keyed by the section name
+func (n *NodeDB) SetConfig(config *generated.Config) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.radio.Config[oneofName(config.ProtoReflect(), "payload_variant")] = config
+}
+
+// SetModuleConfig stores a module config section of the local device, keyed by the section name
+func (n *NodeDB) SetModuleConfig(config *generated.ModuleConfig) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.radio.ModuleConfig[oneofName(config.ProtoReflect(), "payload_variant")] = config
+}
+
+// oneofName returns the name of the field set in the given oneof or an empty string
+func oneofName(message protoreflect.Message, oneof protoreflect.Name) string {
+	od := message.Descriptor().Oneofs().ByName(oneof)
+	if od == nil {
+		return ""
+	}
+	if fd := message.WhichOneof(od); fd != nil {
+		return string(fd.Name())
+	}
+	return ""
+}
+
+// UpdateFromPacket updates the sending node from any received MeshPacket
+// Decoded NODEINFO, POSITION and TELEMETRY packets additionally update the according node details,
+// KiezboxMessage updates tell which box the node belongs to
+func (n *NodeDB) UpdateFromPacket(packet *generated.MeshPacket) {
+	if packet.GetFrom() == 0 {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	node := n.node(packet.GetFrom())
+	node.LastHeard = time.Now().Unix()
+	if packet.GetRxTime() != 0 {
+		node.LastHeard = int64(packet.GetRxTime())
+	}
+	if packet.GetRxSnr() != 0 {
+		node.Snr = packet.GetRxSnr()
+	}
+	if packet.GetHopStart() != 0 && packet.GetHopStart() >= packet.GetHopLimit() {
+		node.HopsAway = proto.Uint32(packet.GetHopStart() - packet.GetHopLimit())
+	}
+
+	decoded := packet.GetDecoded()
+	if decoded == nil {
+		return
+	}
+	var err error
+	switch decoded.GetPortnum() {
+	case generated.PortNum_NODEINFO_APP:
+		var user generated.User
+		if err = proto.Unmarshal(decoded.GetPayload(), &user); err == nil {
+			node.applyUser(&user)
+		}
+	case generated.PortNum_POSITION_APP:
+		var position generated.Position
+		if err = proto.Unmarshal(decoded.GetPayload(), &position); err == nil {
+			node.applyPosition(&position)
+		}
+	case generated.PortNum_TELEMETRY_APP:
+		var telemetry generated.Telemetry
+		if err = proto.Unmarshal(decoded.GetPayload(), &telemetry); err == nil {
+			node.applyDeviceMetrics(telemetry.GetDeviceMetrics())
+		}
+	case generated.PortNum_KIEZBOX_CONTROL_APP:
+		var message generated.KiezboxMessage
+		if err = proto.Unmarshal(decoded.GetPayload(), &message); err == nil {
+			node.applyKiezboxMeta(message.GetUpdate().GetMeta())
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to unmarshal node update", "from", packet.GetFrom(), "portnum", decoded.GetPortnum(), "err", err)
+	}
+}
+
+func (node *Node) applyUser(user *generated.User) {
+	if user == nil {
+		return
+	}
+	node.Id = user.GetId()
+	node.LongName = user.GetLongName()
+	node.ShortName = user.GetShortName()
+	node.HwModel = user.GetHwModel().String()
+	node.Role = user.GetRole().String()
+}
+
+func (node *Node) applyPosition(position *generated.Position) {
+	if position == nil {
+		return
+	}
+	// Positions are transmitted as integers in units of 1e-7 degrees
+	if position.LatitudeI != nil && position.LongitudeI != nil {
+		latitude := float64(position.GetLatitudeI()) * 1e-7
+		longitude := float64(position.GetLongitudeI()) * 1e-7
+		node.Latitude = &latitude
+		node.Longitude = &longitude
+	}
+	if position.Altitude != nil {
+		node.Altitude = proto.Int32(position.GetAltitude())
+	}
+}
+
+func (node *Node) applyDeviceMetrics(metrics *generated.DeviceMetrics) {
+	if metrics == nil {
+		return
+	}
+	if metrics.BatteryLevel != nil {
+		node.BatteryLevel = proto.Uint32(metrics.GetBatteryLevel())
+	}
+	if metrics.Voltage != nil {
+		node.Voltage = proto.Float32(metrics.GetVoltage())
+	}
+}
+
+func (node *Node) applyKiezboxMeta(meta *generated.KiezboxMessage_Meta) {
+	if meta == nil || meta.BoxId == nil {
+		return
+	}
+	node.BoxId = proto.Uint32(meta.GetBoxId())
+	node.DistId = nil
+	if meta.DistId != nil {
+		node.DistId = proto.Uint32(meta.GetDistId())
+	}
+}
@@ -0,0 +1,125 @@
+package meshtastic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Build a decoded packet from a node carrying the given payload
+func nodePacket(t *testing.T, from uint32, portnum generated.PortNum, payload proto.Message) *generated.MeshPacket {
+	data, err := proto.Marshal(payload)
+	assert.NoError(t, err)
+	return &generated.MeshPacket{
+		From:     from,
+		RxTime:   1672531200,
+		RxSnr:    6.5,
+		HopStart: 3,
+		HopLimit: 1,
+		PayloadVariant: &generated.MeshPacket_Decoded{
+			Decoded: &generated.Data{Portnum: portnum, Payload: data},
+		},
+	}
+}
+
+func TestNodeDB(t *testing.T) {
+	nodes := NewNodeDB()
+
+	// Handshake
+	_, ok := nodes.MyNodeNum()
+	assert.False(t, ok)
+	nodes.SetMyInfo(&generated.MyNodeInfo{MyNodeNum: 10})
+	nodes.SetNodeInfo(&generated.NodeInfo{
+		Num:  20,
+		User: &generated.User{Id: "!00000014", LongName: "Kiezbox 20", ShortName: "KB20", HwModel: generated.HardwareModel_HELTEC_V3},
+		Snr:  2.25,
+	})
+	nodes.SetMetadata(10, &generated.DeviceMetadata{FirmwareVersion: "2.5.0", HwModel: generated.HardwareModel_TBEAM})
+	nodes.SetConfig(&generated.Config{PayloadVariant: &generated.Config_Lora{Lora: &generated.Config_LoRaConfig{}}})
+
+	// Live packets
+	nodes.UpdateFromPacket(nodePacket(t, 20, generated.PortNum_POSITION_APP, &generated.Position{
+		LatitudeI:  proto.Int32(524885870),
+		LongitudeI: proto.Int32(133426510),
+	}))
+	nodes.UpdateFromPacket(nodePacket(t, 30, generated.PortNum_TELEMETRY_APP, &generated.Telemetry{
+		Variant: &generated.Telemetry_DeviceMetrics{DeviceMetrics: &generated.DeviceMetrics{BatteryLevel: proto.Uint32(87)}},
+	}))
+
+	list := nodes.List()
+	assert.Len(t, list, 3)
+	assert.Equal(t, []uint32{10, 20, 30}, []uint32{list[0].Num, list[1].Num, list[2].Num})
+
+	local, ok := nodes.Get(10)
+	assert.True(t, ok)
+	assert.True(t, local.IsLocal)
+	assert.Equal(t, "2.5.0", local.FirmwareVersion)
+	assert.Equal(t, "TBEAM", local.HwModel)
+	myNodeNum, ok := nodes.MyNodeNum()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(10), myNodeNum)
+
+	node, ok := nodes.Get(20)
+	assert.True(t, ok)
+	assert.Equal(t, "Kiezbox 20", node.LongName)
+	assert.Equal(t, "HELTEC_V3", node.HwModel)
+	assert.Equal(t, int64(1672531200), node.LastHeard)
+	assert.Equal(t, float32(6.5), node.Snr)
+	assert.Equal(t, uint32(2), *node.HopsAway)
+	assert.InDelta(t, 52.488587, *node.Latitude, 1e-6)
+	assert.InDelta(t, 13.342651, *node.Longitude, 1e-6)
+
+	node, _ = nodes.Get(30)
+	assert.Equal(t, uint32(87), *node.BatteryLevel)
+
+	_, ok = nodes.Get(40)
+	assert.False(t, ok)
+	assert.Contains(t, nodes.radio.Config, "lora")
+}
+
+func TestNodeDBFindBox(t *testing.T) {
+	nodes := NewNodeDB()
+	update := func(boxId uint32, distId uint32) *generated.KiezboxMessage {
+		return &generated.KiezboxMessage{Update: &generated.KiezboxMessage_Update{
+			Meta: &generated.KiezboxMessage_Meta{BoxId: proto.Uint32(boxId), DistId: proto.Uint32(distId)},
+		}}
+	}
+	nodes.UpdateFromPacket(nodePacket(t, 20, generated.PortNum_KIEZBOX_CONTROL_APP, update(1, 1)))
+	nodes.UpdateFromPacket(nodePacket(t, 30, generated.PortNum_KIEZBOX_CONTROL_APP, update(1, 2)))
+	nodes.UpdateFromPacket(nodePacket(t, 40, generated.PortNum_KIEZBOX_CONTROL_APP, update(2, 2)))
+	// Control messages relayed by other nodes do not tell which box they belong to
+	nodes.UpdateFromPacket(nodePacket(t, 50, generated.PortNum_KIEZBOX_CONTROL_APP, &generated.KiezboxMessage{
+		Control: &generated.KiezboxMessage_Control{Meta: &generated.KiezboxMessage_Meta{BoxId: proto.Uint32(3)}},
+	}))
+
+	node, _ := nodes.Get(30)
+	assert.Equal(t, uint32(1), *node.BoxId)
+	assert.Equal(t, uint32(2), *node.DistId)
+
+	testCases := []struct {
+		name        string
+		boxId       uint32
+		distId      *uint32
+		expectedNum uint32
+		expectedOk  bool
+	}{
+		{"Box in district", 1, proto.Uint32(2), 30, true},
+		{"Unique box without district", 2, nil, 40, true},
+		{"Ambiguous box without district", 1, nil, 0, false},
+		{"Unknown district", 2, proto.Uint32(1), 0, false},
+		{"Box only addressed by control", 3, nil, 0, false},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			num, ok := nodes.FindBox(tc.boxId, tc.distId)
+			assert.Equal(t, tc.expectedOk, ok)
+			if ok {
+				assert.Equal(t, tc.expectedNum, num)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ package meshtastic
 import (
 	"context"
 	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/state"
 	"log/slog"
 	"sync"
 
@@ -11,8 +12,8 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-// MessageHandler takes a FromRadio protobuf KiezboxMessage or AdminMessage and extracts it if possible
-// It returns the containing message or nil otherwise
+// MessageHandler takes FromRadio protobufs, extracts contained KiezboxMessages or AdminMessages if possible
+// and publishes every decoded packet on the message bus
 func (mts *MTSerial) MessageHandler(ctx context.Context, wg *sync.WaitGroup) {
 	// Decrement WaitGroup when function exits
 	defer wg.Done()
@@ -32,8 +33,11 @@ func (mts *MTSerial) MessageHandler(ctx context.Context, wg *sync.WaitGroup) {
 			// debugPrintProtobuf(fromRadio)
 			switch v := fromRadio.PayloadVariant.(type) {
 			case *generated.FromRadio_Packet:
+				// Every packet tells us that its sender is alive
+				mts.nodes.UpdateFromPacket(v.Packet)
 				switch v := v.Packet.PayloadVariant.(type) {
 				case *generated.MeshPacket_Decoded:
+					envelope := &Envelope{Packet: fromRadio.GetPacket()}
 					// Extract the message according to its type
 					switch v.Decoded.Portnum {
 					// Extract KiezboxMessage
@@ -42,10 +46,21 @@ func (mts *MTSerial) MessageHandler(ctx context.Context, wg *sync.WaitGroup) {
 						err := proto.Unmarshal(v.Decoded.Payload, &KiezboxMessage)
 						if err != nil {
 							slog.Error("Failed to unmarshal KiezboxMessage", "err", err)
+							unmarshalFailures.WithLabelValues("KiezboxMessage").Inc()
 						} else {
 							slog.Info("Sucessfully extracted KiezboxMessage")
 							debugPrintProtobuf(&KiezboxMessage)
-							mts.KBChan <- &KiezboxMessage
+							if KiezboxMessage.Distress != nil {
+								if emergency, added := state.AddEmergency(KiezboxMessage.Distress); added {
+									slog.Warn("Emergency received", "id", emergency.ID, "type", emergency.Type, "button_id", emergency.ButtonId)
+								} else {
+									slog.Info("Ignoring retransmitted emergency", "id", emergency.ID, "button_id", emergency.ButtonId)
+								}
+							}
+							if KiezboxMessage.Update != nil {
+								observeUpdate(KiezboxMessage.Update)
+							}
+							envelope.Kiezbox = &KiezboxMessage
 						}
 					// Extract AdminMessage
 					case generated.PortNum_ADMIN_APP:
@@ -53,27 +68,59 @@ func (mts *MTSerial) MessageHandler(ctx context.Context, wg *sync.WaitGroup) {
 						err := proto.Unmarshal(v.Decoded.Payload, &AdminMessage)
 						if err != nil {
 							slog.Error("Failed to unmarshal AdminMessage", "err", err)
+							unmarshalFailures.WithLabelValues("AdminMessage").Inc()
 						} else {
 							slog.Info("Sucessfully extracted AdminMessage")
 							debugPrintProtobuf(&AdminMessage)
-							mts.ConfigChan <- &AdminMessage
+							envelope.Admin = &AdminMessage
+						}
+					// Extract Routing (ACK/NAK) message
+					case generated.PortNum_ROUTING_APP:
+						var Routing generated.Routing
+						err := proto.Unmarshal(v.Decoded.Payload, &Routing)
+						if err != nil {
+							slog.Error("Failed to unmarshal Routing", "err", err)
+							unmarshalFailures.WithLabelValues("Routing").Inc()
+						} else {
+							envelope.Routing = &Routing
 						}
 					default:
-						slog.Info("Payload variant not an accepted type of message")
+						slog.Debug("Forwarding packet without extracting its payload", "portnum", v.Decoded.Portnum)
 					}
+					// Answers to our own requests are handed to the waiting transaction as well
+					if mts.txs.resolve(envelope) {
+						slog.Info("Received reply to pending request", "request_id", v.Decoded.RequestId, "portnum", v.Decoded.Portnum)
+					}
+					// Hand the packet to all interested subscribers
+					mts.Bus.Publish(ctx, envelope)
 				default:
 					// slog.Info("Payload variant is encrypted")
 				}
 			case *generated.FromRadio_MyInfo:
-				{
-					mts.MyInfo = v.MyInfo
-					mts.WaitInfo.Done()
+				mts.nodes.SetMyInfo(v.MyInfo)
+			// The device streams its node database and configuration during the config handshake
+			case *generated.FromRadio_NodeInfo:
+				mts.nodes.SetNodeInfo(v.NodeInfo)
+			case *generated.FromRadio_Metadata:
+				myNodeNum, _ := mts.nodes.MyNodeNum()
+				mts.nodes.SetMetadata(myNodeNum, v.Metadata)
+			case *generated.FromRadio_Channel:
+				mts.nodes.SetChannel(v.Channel)
+			case *generated.FromRadio_Config:
+				mts.nodes.SetConfig(v.Config)
+			case *generated.FromRadio_ModuleConfig:
+				mts.nodes.SetModuleConfig(v.ModuleConfig)
+			case *generated.FromRadio_ConfigCompleteId:
+				if mts.conn.configComplete(v.ConfigCompleteId) {
+					slog.Info("Config handshake complete", "config_id", v.ConfigCompleteId, "nodes", len(mts.nodes.List()))
 				}
+			// Sent instead of the text log if the device has the debug log API enabled
+			case *generated.FromRadio_LogRecord:
+				mts.addDeviceLog(DeviceLogFromRecord(v.LogRecord))
 			//Device rebooted, so we ask for config again to initialize communication
 			case *generated.FromRadio_Rebooted:
 				{
-					mts.WaitInfo.Add(1)
-					mts.WantConfig()
+					mts.WantConfig("device rebooted")
 				}
 			default:
 				// slog.Info("Payload variant is not 'packet'")
@@ -0,0 +1,95 @@
+package meshtastic
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tarm/serial"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/capture"
+	cfg "kiezbox/internal/config"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+func awaitFromRadio(t *testing.T, mts *MTSerial) *generated.FromRadio {
+	select {
+	case fromRadio := <-mts.FromChan:
+		return fromRadio
+	case <-time.After(5 * time.Second):
+		t.Fatal("No FromRadio message received")
+		return nil
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device.kbcap")
+	cfg.Cfg.CaptureFile = path
+	cfg.Cfg.DeviceLogSize = 10
+	cfg.Cfg.StopTimeout = time.Second
+	defer func() { cfg.Cfg.CaptureFile = "" }()
+
+	payload, err := proto.Marshal(&generated.FromRadio{PayloadVariant: &generated.FromRadio_MyInfo{MyInfo: &generated.MyNodeInfo{MyNodeNum: 42}}})
+	require.NoError(t, err)
+	stream := append([]byte("INFO  | 00:00:01 1 [Main] booted\r\n\x94\x00garbage"), EncodeFrame(payload)...)
+
+	// Record what a device sends and what the gateway writes to it
+	port := newBlockingPort()
+	go port.writer.Write(stream)
+	var recorded MTSerial
+	recorded.Init(func(*serial.Config) (SerialPort, error) {
+		return port, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go recorded.Reader(ctx, &wg)
+	go recorded.Writer(ctx, &wg)
+	assert.Equal(t, uint32(42), awaitFromRadio(t, &recorded).GetMyInfo().GetMyNodeNum())
+	cancel()
+	wg.Wait()
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	reader, err := capture.NewReader(file)
+	require.NoError(t, err)
+	directions := map[capture.Direction]int{}
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			break
+		}
+		directions[record.Direction] += len(record.Data)
+	}
+	assert.Equal(t, len(stream), directions[capture.FromRadio])
+	// The want_config sent after opening the port
+	assert.Greater(t, directions[capture.ToRadio], 0)
+
+	// Replaying the capture gives the same messages and device log
+	cfg.Cfg.CaptureFile = ""
+	_, err = file.Seek(0, 0)
+	require.NoError(t, err)
+	reader, err = capture.NewReader(file)
+	require.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var replayed MTSerial
+	replayed.Init(func(*serial.Config) (SerialPort, error) {
+		return capture.NewReplayPort(ctx, reader, capture.ReplayOptions{}), nil
+	})
+	wg.Add(1)
+	go replayed.Reader(ctx, &wg)
+	assert.Equal(t, uint32(42), awaitFromRadio(t, &replayed).GetMyInfo().GetMyNodeNum())
+	records := replayed.DeviceLogs().Records(DeviceLogFilter{Module: "Main"})
+	require.Len(t, records, 1)
+	assert.Equal(t, "booted", records[0].Message)
+	cancel()
+	wg.Wait()
+}
@@ -2,27 +2,22 @@
 package meshtastic
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
-	"math/rand"
-	"net/http"
 	"reflect"
-	"strconv"
 	"sync"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/tarm/serial"
 	"google.golang.org/protobuf/proto"
 
 	cfg "kiezbox/internal/config"
 
+	"kiezbox/internal/capture"
 	"kiezbox/internal/db"
 	"kiezbox/internal/github.com/meshtastic/go/generated"
 	"kiezbox/internal/state"
@@ -36,6 +31,13 @@ const (
 	maxProtoSize = 512
 )
 
+// EncodeFrame prepends the stream protocol header (start bytes and big endian length) to a marshalled protobuf
+func EncodeFrame(payload []byte) []byte {
+	frame := make([]byte, 0, 4+len(payload))
+	frame = append(frame, start1, start2, byte((len(payload)>>8)&0xFF), byte(len(payload)&0xFF))
+	return append(frame, payload...)
+}
+
 // SerialPort defines the interface for serial port operations.
 type SerialPort interface {
 	io.ReadWriteCloser
@@ -51,14 +53,15 @@ func CreateSerialPort(conf *serial.Config) (SerialPort, error) {
 type MTSerial struct {
 	conf        *serial.Config
 	port        SerialPort
-	config_id   uint32
 	ToChan      chan *generated.ToRadio
 	FromChan    chan *generated.FromRadio
-	KBChan      chan *generated.KiezboxMessage
-	ConfigChan  chan *generated.AdminMessage
-	MyInfo      *generated.MyNodeInfo
-	WaitInfo    sync.WaitGroup
+	Bus         *Bus
 	portFactory PortFactory
+	conn        connection
+	txs         transactions
+	nodes       *NodeDB
+	logs        *DeviceLog
+	capture     *capture.Writer
 }
 
 // Using an interface as an intermediate layer instead of calling the meshtastic functions directly
@@ -68,185 +71,115 @@ type MeshtasticDevice interface {
 	Heartbeat(ctx context.Context, wg *sync.WaitGroup, interval time.Duration)
 	Reader(ctx context.Context, wg *sync.WaitGroup)
 	MessageHandler(ctx context.Context, wg *sync.WaitGroup)
-	DBWriter(ctx context.Context, wg *sync.WaitGroup, db_client *db.InfluxDB)
-	DBRetry(ctx context.Context, wg *sync.WaitGroup, db_client *db.InfluxDB)
+	SubscribeDBWriter() *Subscription
+	DBWriter(ctx context.Context, drain context.Context, wg *sync.WaitGroup, subscription *Subscription, sink db.Sink, cache *db.Cache)
+	DBRetry(ctx context.Context, wg *sync.WaitGroup, sink db.Sink, cache *db.Cache)
 	SetKiezboxControlValue(ctx context.Context, wg *sync.WaitGroup, control *generated.KiezboxMessage_Control)
+	SendKiezboxControl(ctx context.Context, control *generated.KiezboxMessage_Control) (*TxResult, error)
+	Nodes() *NodeDB
+	DeviceLogs() *DeviceLog
+	ConnectionStatus() ConnStatus
 	GetConfig(ctx context.Context, wg *sync.WaitGroup, interval time.Duration)
-	ConfigWriter(ctx context.Context, wg *sync.WaitGroup)
-	APIHandler(ctx context.Context, wg *sync.WaitGroup, r *gin.Engine)
+	SubscribeConfigWriter() *Subscription
+	ConfigWriter(ctx context.Context, wg *sync.WaitGroup, subscription *Subscription)
+	SubscribeEvents(size int) *Subscription
+	UnsubscribeEvents(subscription *Subscription)
 }
 
 func interfaceIsNil(i interface{}) bool {
 	return i == nil || (reflect.ValueOf(i).Kind() == reflect.Ptr && reflect.ValueOf(i).IsNil())
 }
 
-// BuildKiezboxControlMessage creates a Control message with only one field set, based on key and value.
-// TODO: Ideally, we should refactor to simplify the duplicated logic and extract the fields dinamically from the protobuf generated code.
-func BuildKiezboxControlMessage(key string, value string, filter []string) *generated.KiezboxMessage_Control {
-	message := &generated.KiezboxMessage_Control{}
-	message.Meta = &generated.KiezboxMessage_Meta{}
-
-	switch key {
-	case "mode":
-		v, ok := generated.KiezboxMessage_Mode_value[value]
-		if !ok {
-			slog.Error("Invalid mode value", "value", value)
-			return nil
-		}
-		message.Set = &generated.KiezboxMessage_Control_Mode{
-			Mode: generated.KiezboxMessage_Mode(v),
-		}
-	case "unix_time":
-		v, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			slog.Error("Invalid unix_time value", "value", value)
-			return nil
-		}
-		message.Set = &generated.KiezboxMessage_Control_UnixTime{
-			UnixTime: v,
-		}
-	case "router_power":
-		v, err := strconv.ParseBool(value)
-		if err != nil {
-			slog.Error("Invalid router_power value", "value", value)
-			return nil
-		}
-		message.Set = &generated.KiezboxMessage_Control_RouterPower{
-			RouterPower: v,
-		}
-	case "box_id":
-		v, err := strconv.ParseUint(value, 10, 32)
-		if err != nil {
-			slog.Error("Invalid box_id value", "value", value)
-			return nil
-		}
-		message.Set = &generated.KiezboxMessage_Control_BoxId{
-			BoxId: uint32(v),
-		}
-	case "dist_id":
-		v, err := strconv.ParseUint(value, 10, 32)
-		if err != nil {
-			slog.Error("Invalid dist_id value", "value", value)
-			return nil
-		}
-		message.Set = &generated.KiezboxMessage_Control_DistId{
-			DistId: uint32(v),
-		}
-	case "sens_id":
-		v, err := strconv.ParseUint(value, 10, 32)
-		if err != nil {
-			slog.Error("Invalid sens_id value", "value", value)
-			return nil
-		}
-		message.Set = &generated.KiezboxMessage_Control_SensId{
-			SensId: uint32(v),
-		}
-	case "status_interval":
-		v, err := strconv.ParseInt(value, 10, 32)
-		if err != nil {
-			slog.Error("Invalid status_interval value", "value", value)
-			return nil
-		}
-		message.Set = &generated.KiezboxMessage_Control_StatusInterval{
-			StatusInterval: int32(v),
-		}
-	default:
-		slog.Error("Unknown key for Kiezbox control", "key", key, "value", value)
-		return nil
-	}
-	//TODO: improve this hacky code. the whole function needs rework based on protobuf reflections. so it does not feel that bad
-	if filter[0] != "" {
-		val, err := strconv.Atoi(filter[0])
-		if err != nil {
-			slog.Error("Invalid box_id", "value", filter[0])
-			return nil
-		} else {
-			message.Meta.BoxId = proto.Uint32(uint32(val))
-		}
-	}
-	if filter[1] != "" {
-		val, err := strconv.Atoi(filter[1])
-		if err != nil {
-			slog.Error("Invalid dist_id", "value", filter[1])
-			return nil
-		} else {
-			message.Meta.DistId = proto.Uint32(uint32(val))
-		}
-	}
-	if filter[2] != "" {
-		val, err := strconv.Atoi(filter[2])
-		if err != nil {
-			slog.Error("Invalid sens_id", "value", filter[2])
-			return nil
-		} else {
-			message.Meta.SensId = proto.Uint32(uint32(val))
-		}
-	}
-	if filter[3] != "" {
-		val, err := strconv.Atoi(filter[3])
-		if err != nil {
-			slog.Error("Invalid dev_type", "value", filter[3])
-			return nil
-		} else {
-			dt := generated.KiezboxMessage_DeviceType(val)
-			message.Meta.DevType = &dt
-		}
-	}
-	return message
-}
-
 // Init initializes the serial device of an MTSerial object
 // and also sends the necessary initial radioConfig protobuf packet
 // to start the communication with the meshtastic serial device
 func (mts *MTSerial) Init(portFactory PortFactory) {
 	mts.FromChan = make(chan *generated.FromRadio, 10)
 	mts.ToChan = make(chan *generated.ToRadio, 10)
-	mts.KBChan = make(chan *generated.KiezboxMessage, 10)
-	mts.ConfigChan = make(chan *generated.AdminMessage, 10)
-	mts.WaitInfo.Add(1)
-	mts.config_id = rand.Uint32()
+	mts.Bus = NewBus()
+	mts.nodes = NewNodeDB()
+	mts.logs = NewDeviceLog(cfg.Cfg.DeviceLogSize)
 	mts.conf = &serial.Config{
 		Name: cfg.Cfg.SerialDevice,
 		Baud: cfg.Cfg.SerialBaud,
 	}
 	mts.portFactory = portFactory
+	if cfg.Cfg.CaptureFile != "" {
+		var err error
+		mts.capture, err = capture.Create(cfg.Cfg.CaptureFile, cfg.Cfg.CaptureMax)
+		if err != nil {
+			slog.Error("Failed to open capture file, the device stream is not recorded", "file", cfg.Cfg.CaptureFile, "err", err)
+		} else {
+			slog.Info("Recording the device stream", "file", cfg.Cfg.CaptureFile)
+		}
+	}
 	var err = mts.Open()
 	if err != nil {
 		slog.Info("Serial port not available yet. Reader will retry opening it.")
 	}
 }
 
+// deviceName describes the device connection for logs and events
+func (mts *MTSerial) deviceName() string {
+	if cfg.Cfg.Transport != "" && cfg.Cfg.Transport != "serial" {
+		return cfg.Cfg.Transport
+	}
+	return mts.conf.Name
+}
+
+// Nodes returns the registry of all nodes known to the device
+func (mts *MTSerial) Nodes() *NodeDB {
+	return mts.nodes
+}
+
 // Opens the serial port and sends the necessary initial radioConfig protobuf packet
 // to start the communication with the meshtastic serial device
 func (mts *MTSerial) Open() (err error) {
+	mts.conn.transition(StateOpening, "opening port")
 	mts.port, err = mts.portFactory(mts.conf)
 	if err != nil {
 		slog.Error("Failed to open serial port", "err", err)
+		mts.conn.transition(StateDisconnected, err.Error())
 		return err
 	}
-	mts.WantConfig()
+	if mts.capture != nil {
+		mts.port = mts.capture.Tee(mts.port)
+	}
+	slog.Info("Serial port opened successfully", "device", mts.deviceName(), "baud", mts.conf.Baud)
+	mts.publishEvent(EventSerial, map[string]any{"status": "connected", "device": mts.deviceName()})
+	mts.WantConfig("port opened")
 	return nil
 }
 
-func (mts *MTSerial) WantConfig() {
-	slog.Info("Serial port opened successfully", "baud", mts.conf.Baud)
+// WantConfig starts a new config handshake with the device
+func (mts *MTSerial) WantConfig(reason string) {
+	configId := mts.conn.requestConfig(reason)
 	radioConfig := &generated.ToRadio{
 		PayloadVariant: &generated.ToRadio_WantConfigId{
-			WantConfigId: mts.config_id,
+			WantConfigId: configId,
 		},
 	}
 	slog.Info("Sending ToRadio message", "message", radioConfig)
 	mts.Write(radioConfig)
 }
 
-// Closes the serial connection and blocks WaitInfo again
+// Closes the serial connection, the device is not ready anymore until the next handshake
 func (mts *MTSerial) Close() {
-	mts.WaitInfo.Add(1)
+	mts.conn.transition(StateDisconnected, "port closed")
 	var err error
 	err = mts.port.Close()
 	if err != nil {
 		slog.Error("Failed to close serial port", "err", err)
 	}
+	mts.publishEvent(EventSerial, map[string]any{"status": "disconnected", "device": mts.deviceName()})
+}
+
+// publishEvent hands a change of the gateway state to the subscribers of the gateway events
+func (mts *MTSerial) publishEvent(eventType string, data any) {
+	if mts.Bus == nil {
+		return
+	}
+	mts.Bus.Publish(context.Background(), &Envelope{Event: &GatewayEvent{Type: eventType, Data: data}})
 }
 
 // Heartbeat sends a periodic heartbeat message to the meshtastic device to keep the serial connection alive
@@ -272,113 +205,80 @@ func (mts *MTSerial) Heartbeat(ctx context.Context, wg *sync.WaitGroup, interval
 	}
 }
 
-// SetKiezboxControlValue sends a Kiezbox control message to the meshtastic device in order to set a Kiezbox control value.
+// SetKiezboxControlValue waits for the device and sends a Kiezbox control message to it in order to set a Kiezbox control value.
 func (mts *MTSerial) SetKiezboxControlValue(ctx context.Context, wg *sync.WaitGroup, control *generated.KiezboxMessage_Control) {
-	mts.WaitInfo.Wait()
-	slog.Info("Setting Kiezbox values:", "control", control)
+	// Decrement WaitGroup when function exits
 	defer wg.Done()
 
-	// Create the Kiezbox message with the provided control field
-	kiezboxMessage := &generated.KiezboxMessage{
-		Control: control,
+	if err := mts.WaitReady(ctx); err != nil {
+		return
 	}
+	slog.Info("Setting Kiezbox values:", "control", control)
 
-	// Marshal the Kiezbox message
-	kiezboxData, err := proto.Marshal(kiezboxMessage)
+	result, err := mts.SendKiezboxControl(ctx, control)
 	if err != nil {
-		slog.Error("Failed to marshal KiezboxMessage", "err", err)
-	}
-
-	// Create the Data message
-	dataMessage := &generated.Data{
-		Portnum: generated.PortNum_KIEZBOX_CONTROL_APP,
-		Payload: kiezboxData,
-	}
-
-	// Create the MeshPacket
-	meshPacket := &generated.MeshPacket{
-		From:    mts.MyInfo.MyNodeNum, // TODO: what should be sender id ?
-		To:      math.MaxUint32,
-		Channel: 1, // TODO: get Channel dynamically
-		HopLimit: 3,
-		PayloadVariant: &generated.MeshPacket_Decoded{
-			Decoded: dataMessage,
-		},
-	}
-
-	// Create the ToRadio message
-	toRadio := &generated.ToRadio{
-		PayloadVariant: &generated.ToRadio_Packet{
-			Packet: meshPacket,
-		},
-	}
-
-	// Check if the context has been canceled before attempting to write
-	select {
-	case <-ctx.Done():
+		slog.Error("Failed to set Kiezbox control value", "err", err)
 		return
-	default:
-		mts.Write(toRadio)
+	}
+	if !result.Ok() {
+		slog.Warn("Kiezbox control value was not acknowledged", "status", result.Status, "attempts", result.Attempts, "routing_error", result.Error)
+	} else if result.Status == TxRelayed {
+		slog.Info("Kiezbox control value was relayed, the boxes do not confirm it", "packet_id", result.PacketId)
 	}
 }
 
-// Settime sends a Kiezbox control message to the meshtastic device containing the current system time
-// The meshtastic device uses it to update its own RTC to the new value
-func (mts *MTSerial) Settime(ctx context.Context, wg *sync.WaitGroup, time int64) {
-	mts.WaitInfo.Wait()
-	// Decrement WaitGroup when function exits
-	defer wg.Done()
+// SendKiezboxControl sends a Kiezbox control message to the meshtastic device and waits until it is acknowledged.
+// It does not wait for the device handshake, but fails with ErrNotReady instead.
+// If the targeted box id resolves to a single node of the NodeDB, the packet is addressed to that node, so the ACK
+// comes from the box itself. Otherwise it is broadcast and an ACK is reported as TxRelayed.
+func (mts *MTSerial) SendKiezboxControl(ctx context.Context, control *generated.KiezboxMessage_Control) (*TxResult, error) {
+	myNodeNum, ok := mts.nodes.MyNodeNum()
+	if mts.ConnectionStatus().State != StateReady || !ok {
+		return nil, ErrNotReady
+	}
 
-	// Create the Kiezbox message
+	// Create the Kiezbox message with the provided control field
 	kiezboxMessage := &generated.KiezboxMessage{
-		Control: &generated.KiezboxMessage_Control{
-			Set: &generated.KiezboxMessage_Control_UnixTime{
-				UnixTime: time,
-			},
-		},
+		Control: control,
 	}
 
 	// Marshal the Kiezbox message
 	kiezboxData, err := proto.Marshal(kiezboxMessage)
 	if err != nil {
-		slog.Error("Failed to marshal KiezboxMessage", "err", err)
+		return nil, fmt.Errorf("failed to marshal KiezboxMessage: %w", err)
 	}
 
 	// Create the Data message
 	dataMessage := &generated.Data{
-		Portnum: generated.PortNum_KIEZBOX_CONTROL_APP, // Replace with the appropriate port number
+		Portnum: generated.PortNum_KIEZBOX_CONTROL_APP,
 		Payload: kiezboxData,
 	}
 
+	// Address the box directly if the node sending its updates is known
+	to := uint32(math.MaxUint32)
+	if meta := control.GetMeta(); meta != nil && meta.BoxId != nil {
+		if num, ok := mts.nodes.FindBox(meta.GetBoxId(), meta.DistId); ok {
+			to = num
+		}
+	}
+
 	// Create the MeshPacket
 	meshPacket := &generated.MeshPacket{
-		From:    0, //TODO: what should be sender id ?
-		To:      mts.MyInfo.MyNodeNum,
-		Channel: 1, //TODO: get Channel dynamically
+		From:     myNodeNum, // TODO: what should be sender id ?
+		To:       to,
+		Channel:  1, // TODO: get Channel dynamically
+		HopLimit: 3,
+		WantAck:  true,
 		PayloadVariant: &generated.MeshPacket_Decoded{
 			Decoded: dataMessage,
 		},
 	}
 
-	// Create the ToRadio message
-	toRadio := &generated.ToRadio{
-		PayloadVariant: &generated.ToRadio_Packet{
-			Packet: meshPacket,
-		},
-	}
-
-	slog.Info("Setting time", "unix_time", time)
-
-	// Check if the context has been canceled before attempting to write
-	select {
-	case <-ctx.Done():
-		return
-	default:
-		// Send the message
-		mts.Write(toRadio)
+	result, err := mts.Transact(ctx, meshPacket, txOptions(false))
+	if err == nil && to == math.MaxUint32 && result.Status == TxAcked {
+		result.Status = TxRelayed
 	}
-
-	return
+	return result, err
 }
 
 // Write takes a ToRadio protobuf and writes it to the ToChan to be processed by the Writer
@@ -388,6 +288,7 @@ func (mts *MTSerial) Write(toradio *generated.ToRadio) {
 
 // Writer takes a ToRadio protobuf from to ToChan, marshalls it and sends it over the serial
 // connection to the meshtastic device. The necessary framing is done here.
+// When the context is canceled, the queued messages are still sent before the port is closed.
 func (mts *MTSerial) Writer(ctx context.Context, wg *sync.WaitGroup) {
 	// Decrement WaitGroup when function exits
 	defer wg.Done()
@@ -395,7 +296,8 @@ func (mts *MTSerial) Writer(ctx context.Context, wg *sync.WaitGroup) {
 	for {
 		select {
 		case <-ctx.Done():
-			// Context has been cancelled, exit the loop
+			// Context has been cancelled, flush the queue and close the port
+			mts.flush()
 			slog.Info("Writer stopped")
 			return
 		case ToRadio, ok := <-mts.ToChan:
@@ -404,198 +306,250 @@ func (mts *MTSerial) Writer(ctx context.Context, wg *sync.WaitGroup) {
 				slog.Info("ToChan closed")
 				return
 			}
-			slog.Info("Sending Protobuf to device", "message", ToRadio)
-			pb_marshalled, err := proto.Marshal(ToRadio)
-			if err != nil {
-				slog.Error("Failed to marshal ToRadio", "err", err)
-			}
-			hex := fmt.Sprintf("%x", pb_marshalled)
-			slog.Info("ToRadio Marshalled", "hex", hex)
-			configLen := len(pb_marshalled)
-			configHeader := []byte{
-				start1,
-				start2,
-				byte((configLen >> 8) & 0xFF),
-				byte(configLen & 0xFF),
-			}
-			packet := append(configHeader, pb_marshalled...)
-			// Debug output
-			slog.Info("Sending packet", "hex", fmt.Sprintf("%x", packet))
-			// Write the packet to the serial port
-			if !interfaceIsNil(mts.port) {
-				_, err = mts.port.Write(packet)
-				if err != nil {
-					slog.Error("Failed to write to serial port", "err", err)
+			mts.writeToRadio(ToRadio)
+		}
+	}
+}
+
+// flush sends all messages left in ToChan to the device within the shutdown timeout and closes the port
+func (mts *MTSerial) flush() {
+	deadline := time.After(cfg.Cfg.StopTimeout)
+	flushed := 0
+	func() {
+		for {
+			select {
+			case ToRadio, ok := <-mts.ToChan:
+				if !ok {
+					return
 				}
-			} else {
-				slog.Error("Failed to write data to serial, port is not available")
+				mts.writeToRadio(ToRadio)
+				flushed++
+			case <-deadline:
+				slog.Warn("Shutdown timeout reached, dropping queued messages", "dropped", len(mts.ToChan))
+				return
+			default:
+				return
 			}
 		}
+	}()
+	slog.Info("Flushed queued messages to the device", "messages", flushed)
+	if !interfaceIsNil(mts.port) {
+		// Also stops the Reader waiting for the next byte
+		mts.Close()
+	}
+	if err := mts.capture.Close(); err != nil {
+		slog.Error("Failed to close capture file", "err", err)
+	}
+}
+
+// writeToRadio marshals and frames a single ToRadio message and writes it to the port
+func (mts *MTSerial) writeToRadio(ToRadio *generated.ToRadio) {
+	slog.Info("Sending Protobuf to device", "message", ToRadio)
+	pb_marshalled, err := proto.Marshal(ToRadio)
+	if err != nil {
+		slog.Error("Failed to marshal ToRadio", "err", err)
+	}
+	hex := fmt.Sprintf("%x", pb_marshalled)
+	slog.Info("ToRadio Marshalled", "hex", hex)
+	packet := EncodeFrame(pb_marshalled)
+	// Debug output
+	slog.Info("Sending packet", "hex", fmt.Sprintf("%x", packet))
+	// Write the packet to the serial port
+	if !interfaceIsNil(mts.port) {
+		_, err = mts.port.Write(packet)
+		if err != nil {
+			slog.Error("Failed to write to serial port", "err", err)
+		} else {
+			framesWritten.Inc()
+		}
+	} else {
+		slog.Error("Failed to write data to serial, port is not available")
 	}
 }
 
 // Reader takes a channel to write FromRadio protobuf messages to as they arrive on the serial interface
-// It parses the framing information and discards any 'non protobuf' messages that may arrive
+// The framing is parsed by a FrameDecoder, text the device prints between the frames is kept as device log
 // It should probably be started as goroutine, as it never returns and blocks while reading from serial
 func (mts *MTSerial) Reader(ctx context.Context, wg *sync.WaitGroup) {
 	// Decrement WaitGroup when function exits
 	defer wg.Done()
 
-	var buffer bytes.Buffer
-	var debugBuffer bytes.Buffer
-
 	for {
-		select {
-		case <-ctx.Done():
-			slog.Info("Reader stopped")
-			return
-		default:
-			// Read one byte at a time from the serial port.
-			byteBuf := make([]byte, 1)
-			var portbroken bool = false
-			if interfaceIsNil(mts.port) {
-				slog.Error("Serial port is not initialized", "port", mts.port)
-				portbroken = true
-			} else {
-				_, err := mts.port.Read(byteBuf)
-				if err != nil {
-					slog.Error("Error reading from serial port", "err", err)
-					portbroken = true
-					mts.Close()
-				}
-			}
-			if portbroken {
-				for {
-					slog.Info("Waiting for device to reconnect...")
-					var err = mts.Open()
-					if err == nil {
-						break
-					}
-					time.Sleep(time.Second * 3)
-				}
-				continue
+		if interfaceIsNil(mts.port) {
+			slog.Error("Serial port is not initialized", "port", mts.port)
+		} else {
+			err := mts.readFrames(ctx, NewFrameDecoder(mts.port))
+			if ctx.Err() != nil {
+				// The Writer closed the port while shutting down
+				slog.Info("Reader stopped")
+				return
 			}
-
-			b := byteBuf[0]
-
-			// Check for START1 and START2 in the buffer.
-			if buffer.Len() == 0 && b != start1 {
-				// Accumulate bytes for debug output.
-				if b == '\n' {
-					if cfg.Cfg.LogSerial {
-						// Print debug output when a newline is detected.
-						ascii := debugBuffer.String()
-						// hex := fmt.Sprintf("%x", debugBuffer.Bytes())
-						slog.Info("DEBUG (ASCII):", "ascii", ascii)
-						// log.Printf("Debug output (Hex): %s\n", hex)
-					}
-					debugBuffer.Reset()
-				} else {
-					debugBuffer.WriteByte(b)
-				}
-				continue
+			slog.Error("Error reading from serial port", "err", err)
+			mts.Close()
+		}
+		for {
+			slog.Info("Waiting for device to reconnect...")
+			deviceReconnects.Inc()
+			var err = mts.Open()
+			if err == nil {
+				break
 			}
-
-			// Accumulate bytes into the buffer.
-			buffer.WriteByte(b)
-
-			// Look for START1 and START2 sequence.
-			if buffer.Len() == 2 && !(buffer.Bytes()[0] == start1 && buffer.Bytes()[1] == start2) {
-				// Not a valid protobuf start, reset the buffer.
-				buffer.Reset()
-				continue
+			select {
+			case <-ctx.Done():
+				slog.Info("Reader stopped")
+				return
+			case <-time.After(time.Second * 3):
 			}
+		}
+	}
+}
 
-			// Once the buffer contains the header, check for the length.
-			if buffer.Len() >= 4 {
-				header := buffer.Bytes()
-				protoLen := binary.BigEndian.Uint16(header[2:4])
-
-				if protoLen > maxProtoSize {
-					slog.Error("Invalid packet: length exceeds 512 bytes. Ignoring...")
-					buffer.Reset() // Reset and continue looking for START1.
-					continue
-				}
-
-				// Wait until we have the entire protobuf payload.
-				if buffer.Len() >= int(4+protoLen) {
-					protobufMsg := buffer.Bytes()[4 : 4+protoLen]
-
-					// Log Protobuf frame details for debugging.
-					slog.Debug("Protobuf frame detected", "length", protoLen)
-					slog.Debug("Protobuf frame", "hex", fmt.Sprintf("%x", protobufMsg))
-					var fromRadio generated.FromRadio
-					err := proto.Unmarshal(protobufMsg, &fromRadio)
-					if err != nil {
-						slog.Error("Failed to unmarshal fromRadio", "err", err)
-					} else {
-						mts.FromChan <- &fromRadio
-					}
-					// Remove the processed message from the buffer.
-					buffer.Reset()
-				}
-			}
+// readFrames unmarshals the frames of the decoder into FromRadio messages until reading fails or the context is canceled
+// Frames which do not unmarshal are rejected, so the decoder resyncs inside of them.
+func (mts *MTSerial) readFrames(ctx context.Context, decoder *FrameDecoder) error {
+	decoder.DebugLine = func(line string) {
+		mts.addDeviceLog(ParseDeviceLogLine(line))
+	}
+	decoder.Error = func(class string) {
+		slog.Warn("Invalid frame in serial stream", "class", class)
+		frameErrors.WithLabelValues(class).Inc()
+	}
+	for {
+		payload, err := decoder.Next()
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.Debug("Protobuf frame", "length", len(payload), "hex", fmt.Sprintf("%x", payload))
+		framesRead.Inc()
+		var fromRadio generated.FromRadio
+		err = proto.Unmarshal(payload, &fromRadio)
+		if err != nil {
+			slog.Error("Failed to unmarshal fromRadio", "err", err)
+			unmarshalFailures.WithLabelValues("FromRadio").Inc()
+			decoder.Reject()
+			continue
+		}
+		// The MessageHandler may already be stopped while shutting down, so do not wait on a full queue
+		select {
+		case mts.FromChan <- &fromRadio:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-// DBWriter writes the received data to the InfluxDB instance.
-func (mts *MTSerial) DBWriter(ctx context.Context, wg *sync.WaitGroup, db_client *db.InfluxDB) {
+// SubscribeDBWriter registers the bus subscription of the DBWriter.
+// It is created before the worker starts, so no message is lost until it runs or while it is restarted.
+func (mts *MTSerial) SubscribeDBWriter() *Subscription {
+	return mts.Bus.Subscribe("dbwriter", Filter{
+		Variants: []KiezboxVariant{VariantUpdate, VariantDistress},
+	}, 10, PolicyBlock)
+}
+
+// DBWriter writes the data received on the subscription to the storage sink.
+// When the context is canceled, the messages still queued are written to the sink until drain is done
+// and cached after that, before it returns.
+func (mts *MTSerial) DBWriter(ctx context.Context, drain context.Context, wg *sync.WaitGroup, subscription *Subscription, sink db.Sink, cache *db.Cache) {
 	// Decrement WaitGroup when function exits
 	defer wg.Done()
+	defer mts.unsubscribeOnShutdown(ctx, subscription)
 
 	for {
 		select {
 		case <-ctx.Done():
 			// Exit gracefully when the context is canceled
-			slog.Info("DBWriter context canceled, shutting down.")
+			drainDBWriter(drain, subscription, sink, cache, nil)
 			return
-		case message := <-mts.KBChan:
-			if message == nil {
-				continue
+		case envelope := <-subscription.C:
+			if ctx.Err() != nil {
+				// The shutdown started while taking the message, it is drained with the rest
+				drainDBWriter(drain, subscription, sink, cache, envelope)
+				return
 			}
-			if message.Update == nil {
-				slog.Warn("DBwriter only handles Update messages. skipping.")
-				continue
+			storeMessage(ctx, sink, cache, envelope.Kiezbox)
+		}
+	}
+}
+
+// drainDBWriter stores the messages still queued for the DBWriter, starting with pending if it is set.
+// They are written to the sink until drain is done, the rest goes to the cache, which does not need the network.
+func drainDBWriter(drain context.Context, subscription *Subscription, sink db.Sink, cache *db.Cache, pending *Envelope) {
+	slog.Info("DBWriter context canceled, draining queued messages.")
+	next := func() *generated.KiezboxMessage {
+		if pending != nil {
+			envelope := pending
+			pending = nil
+			return envelope.Kiezbox
+		}
+		return (<-subscription.C).Kiezbox
+	}
+	drained := 0
+	for drain.Err() == nil && (pending != nil || len(subscription.C) > 0) {
+		storeMessage(drain, sink, cache, next())
+		drained++
+	}
+	for pending != nil || len(subscription.C) > 0 {
+		if message := next(); message != nil {
+			if message.Update != nil {
+				message.Update.ArrivalTime = proto.Int64(time.Now().Unix())
 			}
-			// Set the arrival time to the current time
-			message.Update.ArrivalTime = proto.Int64(time.Now().Unix())
-
-			// Check connection to database before trying to write the point
-			databaseConnected, err := db_client.Client.Ping(ctx)
-			if !databaseConnected {
-				// Cache the message if database is not connected
-				slog.Warn("No database connection. Caching point.", "err", err)
-				db.WritePointToFile(message, cfg.Cfg.CacheDir)
-				continue
+			if err := cache.Append(message); err != nil {
+				slog.Error("Failed to cache point", "err", err)
 			}
+		}
+		drained++
+	}
+	slog.Info("DBWriter shutting down.", "drained", drained)
+}
 
-			slog.Info("Handling Protobuf message")
-			// Convert the Protobuf message to an InfluxDB point
-			point, err := db.KiezboxMessageToPoint(message)
-			slog.Info("Adding point", "point", point)
+// storeMessage writes an Update or Distress message to the sink, or to the cache if the sink is not available
+func storeMessage(ctx context.Context, sink db.Sink, cache *db.Cache, message *generated.KiezboxMessage) {
+	if message == nil {
+		return
+	}
+	if message.Update == nil && message.Distress == nil {
+		slog.Warn("DBwriter only handles Update and Distress messages. skipping.")
+		return
+	}
+	// Set the arrival time to the current time
+	if message.Update != nil {
+		message.Update.ArrivalTime = proto.Int64(time.Now().Unix())
+	}
 
-			// Write the point to InfluxDB
-			err = db_client.WritePointToDatabase(point)
+	// Check connection to the sink before trying to write the point
+	if err := sink.Health(ctx); err != nil {
+		// Cache the message if the sink is not available
+		slog.Warn("No database connection. Caching point.", "err", err)
+		if err := cache.Append(message); err != nil {
+			slog.Error("Failed to cache point", "err", err)
+		}
+		return
+	}
 
-			// Cache message if connection to database failed
-			if err != nil {
-				if errors.Is(err, context.DeadlineExceeded) {
-					slog.Warn("No connection to database, caching point.")
-					db.WritePointToFile(message, cfg.Cfg.CacheDir)
+	slog.Info("Handling Protobuf message")
+	err := sink.Write(ctx, message)
 
-				} else {
-					slog.Error("Unexpected error", "err", err)
-				}
-			} else {
-				slog.Info("Data written to InfluxDB successfully")
+	// Cache message if connection to database failed
+	if err != nil {
+		// A write canceled by the end of the drain is cached as well
+		if errors.Is(err, db.ErrNoConnection) || ctx.Err() != nil {
+			slog.Warn("No connection to database, caching point.", "err", err)
+			if err := cache.Append(message); err != nil {
+				slog.Error("Failed to cache point", "err", err)
 			}
+		} else {
+			slog.Error("Unexpected error", "err", err)
 		}
+	} else {
+		slog.Info("Data written to database successfully")
 	}
 }
 
-// DBRetry tries to write cached points to the InfluxDB instance.
-func (mts *MTSerial) DBRetry(ctx context.Context, wg *sync.WaitGroup, db_client *db.InfluxDB) {
+// DBRetry tries to write cached points to the storage sink.
+func (mts *MTSerial) DBRetry(ctx context.Context, wg *sync.WaitGroup, sink db.Sink, cache *db.Cache) {
 	// Decrement WaitGroup when function exits
 	defer wg.Done()
 
@@ -610,11 +564,11 @@ func (mts *MTSerial) DBRetry(ctx context.Context, wg *sync.WaitGroup, db_client
 			return
 		case <-ticker.C:
 			// Check if the database is connected before retrying
-			databaseConnected, err := db_client.Client.Ping(ctx)
+			err := sink.Health(ctx)
 
-			if databaseConnected {
+			if err == nil {
 				slog.Info("Database connected, retrying cached points.")
-				db_client.RetryCachedPoints(cfg.Cfg.CacheDir)
+				db.RetryCachedPoints(ctx, sink, cache, cfg.Cfg.ReplayBatch, cfg.Cfg.ReplayRate)
 
 			} else {
 				slog.Warn("No database connection. Skipping retry.", "err", err)
@@ -625,10 +579,13 @@ func (mts *MTSerial) DBRetry(ctx context.Context, wg *sync.WaitGroup, db_client
 
 // GetConfig sends a periodic request to the meshtastic device to get the current configuration
 func (mts *MTSerial) GetConfig(ctx context.Context, wg *sync.WaitGroup, interval time.Duration) {
-	mts.WaitInfo.Wait()
 	// Decrement WaitGroup when function exits
 	defer wg.Done()
 
+	if err := mts.WaitReady(ctx); err != nil {
+		return
+	}
+
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -638,6 +595,11 @@ func (mts *MTSerial) GetConfig(ctx context.Context, wg *sync.WaitGroup, interval
 			fmt.Println("GetConfig stopped")
 			return
 		case <-ticker.C:
+			// Skip requests while the device is reconnecting
+			if mts.ConnectionStatus().State != StateReady {
+				slog.Info("Device not ready, skipping config request")
+				continue
+			}
 			// Create the Admin message
 			adminMessage := &generated.AdminMessage{
 				PayloadVariant: &generated.AdminMessage_GetModuleConfigRequest{
@@ -648,7 +610,8 @@ func (mts *MTSerial) GetConfig(ctx context.Context, wg *sync.WaitGroup, interval
 			// Marshal the Admin message
 			adminData, err := proto.Marshal(adminMessage)
 			if err != nil {
-				fmt.Printf("Failed to marshal AdminMessage: %v", err)
+				slog.Error("Failed to marshal AdminMessage", "err", err)
+				continue
 			}
 
 			// Create the Data message
@@ -659,32 +622,69 @@ func (mts *MTSerial) GetConfig(ctx context.Context, wg *sync.WaitGroup, interval
 			}
 
 			// Create the MeshPacket
+			myNodeNum, _ := mts.nodes.MyNodeNum()
 			meshPacket := &generated.MeshPacket{
 				From:    0, //TODO: what should be sender id ?
-				To:      mts.MyInfo.MyNodeNum,
+				To:      myNodeNum,
 				Channel: 1, //TODO: get Channel dynamically
 				PayloadVariant: &generated.MeshPacket_Decoded{
 					Decoded: dataMessage,
 				},
 			}
-			// Create the ToRadio message
-			toRadio := &generated.ToRadio{
-				PayloadVariant: &generated.ToRadio_Packet{
-					Packet: meshPacket,
-				},
-			}
 
 			slog.Info("Sending config request")
-			// Send the message
-			mts.Write(toRadio)
+			// Send the request, the response itself is handled by the ConfigWriter
+			result, err := mts.Transact(ctx, meshPacket, txOptions(true))
+			if err != nil {
+				slog.Info("Config request canceled", "err", err)
+				continue
+			}
+			if !result.Ok() {
+				slog.Warn("Config request not answered", "status", result.Status, "attempts", result.Attempts, "routing_error", result.Error)
+			}
 		}
 	}
 }
 
-// ConfigWriter saves the current configuration of the meshtastic device
-func (mts *MTSerial) ConfigWriter(ctx context.Context, wg *sync.WaitGroup) {
+// SubscribeConfigWriter registers the bus subscription of the ConfigWriter, before the worker starts
+func (mts *MTSerial) SubscribeConfigWriter() *Subscription {
+	return mts.Bus.Subscribe("configwriter", Filter{
+		Portnums: []generated.PortNum{generated.PortNum_ADMIN_APP},
+	}, 10, PolicyBlock)
+}
+
+// SubscribeEvents registers a subscription for the live events: all KiezboxMessages and the gateway events
+// Messages are dropped for this subscription only if its queue is full.
+func (mts *MTSerial) SubscribeEvents(size int) *Subscription {
+	return mts.Bus.Subscribe("events", Filter{
+		Variants: []KiezboxVariant{VariantUpdate, VariantControl, VariantDistress},
+		Events:   true,
+	}, size, PolicyDrop)
+}
+
+// UnsubscribeEvents removes a subscription created by SubscribeEvents
+func (mts *MTSerial) UnsubscribeEvents(subscription *Subscription) {
+	mts.Bus.Unsubscribe(subscription)
+}
+
+// CloseEvents removes all subscriptions for the live events, which ends their streams
+func (mts *MTSerial) CloseEvents() {
+	mts.Bus.UnsubscribeAll("events")
+}
+
+// unsubscribeOnShutdown removes the subscription of a worker once the context is canceled.
+// A worker returning early (e.g. after a panic) is restarted and keeps the subscription with the messages queued meanwhile.
+func (mts *MTSerial) unsubscribeOnShutdown(ctx context.Context, subscription *Subscription) {
+	if ctx.Err() != nil {
+		mts.Bus.Unsubscribe(subscription)
+	}
+}
+
+// ConfigWriter saves the current configuration of the meshtastic device received on the subscription
+func (mts *MTSerial) ConfigWriter(ctx context.Context, wg *sync.WaitGroup, subscription *Subscription) {
 	// Decrement WaitGroup when function exits
 	defer wg.Done()
+	defer mts.unsubscribeOnShutdown(ctx, subscription)
 
 	for {
 		select {
@@ -692,7 +692,8 @@ func (mts *MTSerial) ConfigWriter(ctx context.Context, wg *sync.WaitGroup) {
 			// Exit gracefully when the context is canceled
 			fmt.Println("ConfigWriter context canceled, shutting down.")
 			return
-		case message := <-mts.ConfigChan:
+		case envelope := <-subscription.C:
+			message := envelope.Admin
 			if message == nil {
 				continue
 			}
@@ -701,6 +702,10 @@ func (mts *MTSerial) ConfigWriter(ctx context.Context, wg *sync.WaitGroup) {
 				kiezboxControl := config.GetKiezboxControl()
 				if kiezboxControl != nil {
 					mode := kiezboxControl.GetMode()
+					// Notify live subscribers only if the mode actually changed
+					if int(mode) != state.GetMode() {
+						mts.publishEvent(EventMode, map[string]any{"mode": int(mode), "name": mode.String()})
+					}
 					// Save mode in the global state
 					state.SetMode(mode)
 					slog.Info("Wrote current mode to global state", "mode", mode)
@@ -709,27 +714,3 @@ func (mts *MTSerial) ConfigWriter(ctx context.Context, wg *sync.WaitGroup) {
 		}
 	}
 }
-
-// APIHandler starts the API for the Kiezbox Gateway Service.
-func (mts *MTSerial) APIHandler(ctx context.Context, wg *sync.WaitGroup, r *gin.Engine) {
-	// Decrement WaitGroup when function exits
-	defer wg.Done()
-
-	// Configure the HTTP server
-	server := &http.Server{
-		Addr:    fmt.Sprintf("localhost:%s", cfg.Cfg.ApiPort),
-		Handler: r,
-	}
-
-	// Start the HTTP server
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		slog.Error("Failed to start API server", "err", err)
-	}
-
-	// Handle context cancellation and server shutdown
-	<-ctx.Done()
-	slog.Info("Shutting down API server...")
-	if err := server.Shutdown(ctx); err != nil {
-		slog.Error("API server forced to shut down", "err", err)
-	}
-}
@@ -0,0 +1,209 @@
+package meshtastic
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tarm/serial"
+
+	cfg "kiezbox/internal/config"
+	"kiezbox/internal/db"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/testutils"
+)
+
+// Port whose reads block until it is closed
+type blockingPort struct {
+	mutex   sync.Mutex
+	written bytes.Buffer
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+	closed  bool
+}
+
+func newBlockingPort() *blockingPort {
+	reader, writer := io.Pipe()
+	return &blockingPort{reader: reader, writer: writer}
+}
+
+func (p *blockingPort) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *blockingPort) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.written.Write(b)
+}
+
+func (p *blockingPort) Close() error {
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+	return p.writer.Close()
+}
+
+// Sink which is slow or unavailable on demand
+type drainSink struct {
+	mutex   sync.Mutex
+	down    bool
+	delay   time.Duration
+	written int
+}
+
+func (s *drainSink) Write(ctx context.Context, message *generated.KiezboxMessage) error {
+	if s.delay > 0 {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			// Not a connection error, the write was canceled by the end of the drain
+			return ctx.Err()
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.written++
+	return nil
+}
+
+func (s *drainSink) WriteBatch(ctx context.Context, messages []*generated.KiezboxMessage) error {
+	return nil
+}
+
+func (s *drainSink) Health(ctx context.Context) error {
+	if s.down {
+		return db.ErrNoConnection
+	}
+	return nil
+}
+
+func (s *drainSink) Close() error {
+	return nil
+}
+
+func TestWriterFlushesOnShutdown(t *testing.T) {
+	cfg.Cfg.StopTimeout = time.Second
+	port := newBlockingPort()
+	mts := &MTSerial{
+		ToChan: make(chan *generated.ToRadio, 10),
+		conf:   &serial.Config{Name: "test"},
+		port:   port,
+	}
+	for i := 0; i < 3; i++ {
+		mts.ToChan <- &generated.ToRadio{PayloadVariant: &generated.ToRadio_Heartbeat{}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go mts.Reader(ctx, &wg)
+	go mts.Writer(ctx, &wg)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reader and Writer did not stop")
+	}
+
+	// All queued messages were written before the port was closed, which also stopped the Reader
+	heartbeat := EncodeFrame([]byte{0x3a, 0x00})
+	assert.Equal(t, bytes.Repeat(heartbeat, 3), port.written.Bytes())
+	assert.True(t, port.closed)
+	assert.Equal(t, StateDisconnected, mts.ConnectionStatus().State)
+}
+
+func TestReaderStopsWithFullQueue(t *testing.T) {
+	port := newBlockingPort()
+	defer port.Close()
+	mts := &MTSerial{
+		FromChan: make(chan *generated.FromRadio, 1),
+		conf:     &serial.Config{Name: "test"},
+		port:     port,
+	}
+	// The device keeps sending frames, until the port is closed
+	go func() {
+		heartbeat := EncodeFrame([]byte{0x3a, 0x00})
+		for {
+			if _, err := port.writer.Write(heartbeat); err != nil {
+				return
+			}
+		}
+	}()
+
+	// No MessageHandler takes the messages, so the Reader waits on the full queue when shutting down
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go mts.Reader(ctx, &wg)
+	require.Eventually(t, func() bool { return len(mts.FromChan) == cap(mts.FromChan) }, 5*time.Second, time.Millisecond)
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reader did not stop")
+	}
+}
+
+func TestDBWriterDrainsOnShutdown(t *testing.T) {
+	testCases := []struct {
+		name           string
+		sink           *drainSink
+		timeout        time.Duration
+		expectedCached int
+	}{
+		{"written", &drainSink{}, time.Second, 0},
+		{"sink down", &drainSink{down: true}, time.Second, 5},
+		{"timeout", &drainSink{delay: 100 * time.Millisecond}, 250 * time.Millisecond, -1},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := db.OpenCache(t.TempDir(), db.CacheOptions{})
+			require.NoError(t, err)
+			defer cache.Close()
+			mts := &MTSerial{Bus: NewBus()}
+
+			// Messages published before the worker runs are queued on its subscription
+			subscription := mts.SubscribeDBWriter()
+			for i := 0; i < 5; i++ {
+				mts.Bus.Publish(context.Background(), &Envelope{Kiezbox: testutils.CreateKiezboxMessage(int64(1700000000 + i))})
+			}
+
+			// Shut down right away
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			drain, stopDrain := context.WithTimeout(context.Background(), tc.timeout)
+			defer stopDrain()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go mts.DBWriter(ctx, drain, &wg, subscription, tc.sink, cache)
+			wg.Wait()
+			assert.Empty(t, mts.Bus.Stats())
+
+			// Nothing was lost, whatever could not be written in time is cached
+			assert.Equal(t, 5, tc.sink.written+cache.Pending())
+			if tc.expectedCached >= 0 {
+				assert.Equal(t, tc.expectedCached, cache.Pending())
+			} else {
+				assert.Greater(t, cache.Pending(), 0)
+				assert.Greater(t, tc.sink.written, 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package meshtastic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	cfg "kiezbox/internal/config"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// TxStatus describes how a transaction with the device ended
+type TxStatus int
+
+const (
+	// TxAcked means the device (or the mesh) acknowledged the packet without error
+	TxAcked TxStatus = iota
+	// TxResponse means a reply packet referencing the request arrived
+	TxResponse
+	// TxNak means the packet was rejected with a routing error
+	TxNak
+	// TxTimeout means neither an acknowledgment nor a response arrived after all retries
+	TxTimeout
+	// TxRelayed means a broadcast was acknowledged. The ACK only tells that a neighbour rebroadcast the packet,
+	// not that any addressed node received it.
+	TxRelayed
+)
+
+func (s TxStatus) String() string {
+	switch s {
+	case TxAcked:
+		return "acked"
+	case TxResponse:
+		return "response"
+	case TxNak:
+		return "nak"
+	case TxTimeout:
+		return "timeout"
+	case TxRelayed:
+		return "relayed"
+	}
+	return fmt.Sprintf("TxStatus(%d)", int(s))
+}
+
+// MarshalText encodes the status by name, e.g. for JSON API responses
+func (s TxStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses the status from its name
+func (s *TxStatus) UnmarshalText(text []byte) error {
+	for _, status := range []TxStatus{TxAcked, TxResponse, TxNak, TxTimeout, TxRelayed} {
+		if status.String() == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown transaction status %q", text)
+}
+
+// TxResult is the typed result of a transaction
+type TxResult struct {
+	PacketId uint32                  `json:"packet_id"`
+	Status   TxStatus                `json:"status"`
+	Attempts int                     `json:"attempts"`
+	Error    generated.Routing_Error `json:"-"`
+	Response *Envelope               `json:"-"`
+}
+
+// Ok reports whether the packet was accepted
+func (r *TxResult) Ok() bool {
+	return r.Status == TxAcked || r.Status == TxResponse || r.Status == TxRelayed
+}
+
+// TxOptions configures how long and how often a transaction is tried
+type TxOptions struct {
+	// Timeout per attempt
+	Timeout time.Duration
+	// Retries after the first attempt timed out
+	Retries int
+	// WaitResponse ignores plain routing ACKs and waits for a reply carrying data
+	WaitResponse bool
+}
+
+// ErrNotReady is returned when a transaction is started before the device handshake finished
+var ErrNotReady = errors.New("meshtastic device not ready")
+
+// pendingTx is a transaction waiting for its reply
+type pendingTx struct {
+	replies      chan *Envelope
+	waitResponse bool
+}
+
+// transactions tracks all transactions waiting for a reply, by packet id
+type transactions struct {
+	mutex   sync.Mutex
+	pending map[uint32]*pendingTx
+}
+
+// register reserves a new unique, non zero packet id for a pending transaction
+func (t *transactions) register(waitResponse bool) (uint32, *pendingTx) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[uint32]*pendingTx)
+	}
+	tx := &pendingTx{
+		replies:      make(chan *Envelope, 1),
+		waitResponse: waitResponse,
+	}
+	for {
+		id := rand.Uint32()
+		if _, taken := t.pending[id]; id != 0 && !taken {
+			t.pending[id] = tx
+			return id, tx
+		}
+	}
+}
+
+// unregister removes a finished transaction
+func (t *transactions) unregister(id uint32) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.pending, id)
+}
+
+// resolve hands a received packet to the transaction it answers
+// It returns false if the packet does not answer a pending transaction
+func (t *transactions) resolve(envelope *Envelope) bool {
+	requestId := envelope.Packet.GetDecoded().GetRequestId()
+	if requestId == 0 {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tx, ok := t.pending[requestId]
+	if !ok {
+		return false
+	}
+	// Plain ACKs do not finish transactions waiting for data, errors always do
+	if tx.waitResponse && envelope.Routing != nil && envelope.Routing.GetErrorReason() == generated.Routing_NONE {
+		return true
+	}
+	select {
+	case tx.replies <- envelope:
+	default:
+		// A reply was already delivered, duplicates are ignored
+	}
+	return true
+}
+
+// txOptions returns the transaction options as configured for the service
+func txOptions(waitResponse bool) TxOptions {
+	return TxOptions{
+		Timeout:      cfg.Cfg.TxTimeout,
+		Retries:      cfg.Cfg.TxRetries,
+		WaitResponse: waitResponse,
+	}
+}
+
+// Transact sends a MeshPacket to the device and waits until it is acknowledged or answered.
+// The packet id is assigned here. Attempts time out after opts.Timeout and are repeated opts.Retries times.
+// An error is only returned if the context is canceled, a missing reply is reported as TxTimeout.
+func (mts *MTSerial) Transact(ctx context.Context, packet *generated.MeshPacket, opts TxOptions) (*TxResult, error) {
+	id, tx := mts.txs.register(opts.WaitResponse)
+	defer mts.txs.unregister(id)
+
+	packet.Id = id
+	toRadio := &generated.ToRadio{
+		PayloadVariant: &generated.ToRadio_Packet{
+			Packet: packet,
+		},
+	}
+	result := &TxResult{PacketId: id}
+
+	for result.Attempts <= opts.Retries {
+		result.Attempts++
+		slog.Info("Sending packet", "id", id, "attempt", result.Attempts)
+		// Do not wait past the deadline of the caller while the queue to the device is full
+		select {
+		case mts.ToChan <- toRadio:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		timer := time.NewTimer(opts.Timeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+			slog.Warn("No reply to packet", "id", id, "attempt", result.Attempts, "timeout", opts.Timeout)
+			continue
+		case reply := <-tx.replies:
+			timer.Stop()
+			if reply.Routing != nil && reply.Routing.GetErrorReason() != generated.Routing_NONE {
+				result.Status = TxNak
+				result.Error = reply.Routing.GetErrorReason()
+			} else if reply.Routing != nil {
+				result.Status = TxAcked
+			} else {
+				result.Status = TxResponse
+				result.Response = reply
+			}
+			slog.Info("Packet answered", "id", id, "status", result.Status, "routing_error", result.Error)
+			return result, nil
+		}
+	}
+	result.Status = TxTimeout
+	return result, nil
+}
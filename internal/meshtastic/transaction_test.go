@@ -0,0 +1,125 @@
+package meshtastic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Build the envelope of a reply to the given packet id as the MessageHandler would
+func replyEnvelope(requestId uint32, routing *generated.Routing) *Envelope {
+	portnum := generated.PortNum_ADMIN_APP
+	if routing != nil {
+		portnum = generated.PortNum_ROUTING_APP
+	}
+	return &Envelope{
+		Packet: &generated.MeshPacket{
+			PayloadVariant: &generated.MeshPacket_Decoded{
+				Decoded: &generated.Data{Portnum: portnum, RequestId: requestId},
+			},
+		},
+		Routing: routing,
+	}
+}
+
+func routingError(reason generated.Routing_Error) *generated.Routing {
+	return &generated.Routing{Variant: &generated.Routing_ErrorReason{ErrorReason: reason}}
+}
+
+func TestTransact(t *testing.T) {
+	testCases := []struct {
+		name             string
+		waitResponse     bool
+		replies          []func(id uint32) *Envelope
+		expectedStatus   TxStatus
+		expectedAttempts int
+		expectedError    generated.Routing_Error
+	}{
+		{
+			name:             "Routing ACK",
+			replies:          []func(uint32) *Envelope{func(id uint32) *Envelope { return replyEnvelope(id, routingError(generated.Routing_NONE)) }},
+			expectedStatus:   TxAcked,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "Routing NAK",
+			replies:          []func(uint32) *Envelope{func(id uint32) *Envelope { return replyEnvelope(id, routingError(generated.Routing_NO_CHANNEL)) }},
+			expectedStatus:   TxNak,
+			expectedAttempts: 1,
+			expectedError:    generated.Routing_NO_CHANNEL,
+		},
+		{
+			name:         "Response after ACK",
+			waitResponse: true,
+			replies: []func(uint32) *Envelope{
+				func(id uint32) *Envelope { return replyEnvelope(id, routingError(generated.Routing_NONE)) },
+				func(id uint32) *Envelope { return replyEnvelope(id, nil) },
+			},
+			expectedStatus:   TxResponse,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "Reply to another request",
+			replies:          []func(uint32) *Envelope{func(id uint32) *Envelope { return replyEnvelope(id+1, routingError(generated.Routing_NONE)) }},
+			expectedStatus:   TxTimeout,
+			expectedAttempts: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mts := &MTSerial{ToChan: make(chan *generated.ToRadio, 10)}
+			opts := TxOptions{Timeout: 20 * time.Millisecond, Retries: 2, WaitResponse: tc.waitResponse}
+
+			results := make(chan *TxResult)
+			go func() {
+				result, err := mts.Transact(context.Background(), &generated.MeshPacket{}, opts)
+				assert.NoError(t, err)
+				results <- result
+			}()
+
+			// Answer the first attempt like the device would
+			sent := <-mts.ToChan
+			id := sent.GetPacket().GetId()
+			assert.NotZero(t, id)
+			for _, reply := range tc.replies {
+				mts.txs.resolve(reply(id))
+			}
+
+			result := <-results
+			assert.Equal(t, id, result.PacketId)
+			assert.Equal(t, tc.expectedStatus, result.Status)
+			assert.Equal(t, tc.expectedAttempts, result.Attempts)
+			assert.Equal(t, tc.expectedError, result.Error)
+			assert.Len(t, mts.ToChan, tc.expectedAttempts-1, "retries should resend the packet")
+			assert.Empty(t, mts.txs.pending, "finished transactions should be removed")
+		})
+	}
+}
+
+func TestTransactCanceled(t *testing.T) {
+	mts := &MTSerial{ToChan: make(chan *generated.ToRadio, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := mts.Transact(ctx, &generated.MeshPacket{}, TxOptions{Timeout: time.Second})
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, result)
+}
+
+func TestTransactFullQueue(t *testing.T) {
+	// Nothing takes the packets from the queue to the device
+	mts := &MTSerial{ToChan: make(chan *generated.ToRadio)}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	result, err := mts.Transact(ctx, &generated.MeshPacket{}, TxOptions{Timeout: time.Second})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, result)
+}
@@ -0,0 +1,57 @@
+package meshtastic
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	// Port the meshtastic firmware serves its stream API on
+	defaultTCPPort = "4403"
+	// Timeout for establishing a TCP connection to the device
+	tcpDialTimeout = 10 * time.Second
+	// Interval of the TCP keepalive probes, so dead connections are detected by the Reader
+	tcpKeepAlive = 15 * time.Second
+)
+
+// CreateTCPPort connects to a meshtastic device serving the stream API over TCP
+// The framing on the connection is the same as on the serial interface
+func CreateTCPPort(address string) (SerialPort, error) {
+	dialer := net.Dialer{
+		Timeout:   tcpDialTimeout,
+		KeepAlive: tcpKeepAlive,
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// NewPortFactory returns the PortFactory for the configured transport
+// "serial" (or an empty string) opens the configured serial device,
+// "tcp://host[:port]" connects to a device over TCP, by default on port 4403
+func NewPortFactory(transport string) (PortFactory, error) {
+	if transport == "" || transport == "serial" {
+		return CreateSerialPort, nil
+	}
+	u, err := url.Parse(transport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport %q: %w", transport, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid transport %q: missing host", transport)
+		}
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), defaultTCPPort)
+		}
+		return func(*serial.Config) (SerialPort, error) {
+			return CreateTCPPort(address)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport %q", transport)
+	}
+}
@@ -0,0 +1,68 @@
+package meshtastic
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPortFactory(t *testing.T) {
+	testCases := []struct {
+		name        string
+		transport   string
+		expectError bool
+	}{
+		{"Default serial", "", false},
+		{"Serial", "serial", false},
+		{"TCP with port", "tcp://192.168.1.20:4403", false},
+		{"TCP without port", "tcp://meshtastic.local", false},
+		{"TCP without host", "tcp://", true},
+		{"Unsupported scheme", "udp://192.168.1.20:4403", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			factory, err := NewPortFactory(tc.transport)
+			if tc.expectError {
+				assert.Error(t, err)
+				assert.Nil(t, factory)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, factory)
+			}
+		})
+	}
+}
+
+func TestTCPPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	// Echo whatever the gateway writes, like a device answering
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 16)
+		n, _ := conn.Read(buf)
+		conn.Write(buf[:n])
+	}()
+
+	factory, err := NewPortFactory("tcp://" + listener.Addr().String())
+	assert.NoError(t, err)
+	port, err := factory(nil)
+	assert.NoError(t, err)
+	defer port.Close()
+
+	frame := []byte{start1, start2, 0x00, 0x00}
+	_, err = port.Write(frame)
+	assert.NoError(t, err)
+	buf := make([]byte, len(frame))
+	_, err = port.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, frame, buf)
+}
@@ -0,0 +1,15 @@
+// Package metrics holds the Prometheus registry of the gateway
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Registry holds the metrics served at /metrics.
+// Packages create their metrics with Factory, collectors of single instances like the offline cache are registered
+// when main sets them up. Registering a name twice fails instead of replacing the metric.
+var Registry = prometheus.NewRegistry()
+
+// Factory creates metrics which are registered to Registry
+var Factory = promauto.With(Registry)
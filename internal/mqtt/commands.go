@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"kiezbox/internal/audit"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/meshtastic"
+)
+
+// Topic element addressing every district or box
+const broadcast = "all"
+
+// Command is a control value received on <prefix>/<dist_id>/<box_id>/set/<key>
+type Command struct {
+	Topic  string
+	DistId string
+	BoxId  string
+	Key    string
+	Value  string
+}
+
+// CommandResult is published to the command topic followed by /result
+type CommandResult struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	DistId string `json:"dist_id"`
+	BoxId  string `json:"box_id"`
+	// One of the transaction statuses (acked, response, nak, timeout, relayed), rejected, not_ready or error.
+	// Only acked means the box confirmed the value, relayed means a neighbour rebroadcast the packet.
+	Status string               `json:"status"`
+	Error  string               `json:"error,omitempty"`
+	Result *meshtastic.TxResult `json:"result,omitempty"`
+}
+
+// ControlSender sends a control message and waits for the mesh to acknowledge it, implemented by the MeshtasticDevice
+type ControlSender interface {
+	SendKiezboxControl(ctx context.Context, control *generated.KiezboxMessage_Control) (*meshtastic.TxResult, error)
+}
+
+// Commander forwards control values from MQTT command topics to the boxes
+// Only keys in the allowlist are accepted, <dist_id> and <box_id> may be "all" to address every box.
+type Commander struct {
+	conn     *Connection
+	device   ControlSender
+	allowed  []string
+	commands chan Command
+}
+
+// NewCommander subscribes to the command topics, renewing the subscription after every reconnect
+func NewCommander(conn *Connection, device ControlSender, allowed []string) *Commander {
+	c := &Commander{
+		conn:     conn,
+		device:   device,
+		allowed:  allowed,
+		commands: make(chan Command, 10),
+	}
+	filter := conn.Topic("+", "+", "set", "+")
+	conn.OnConnect(func(client paho.Client) {
+		token := client.Subscribe(filter, 1, c.receive)
+		if token.WaitTimeout(conn.opts.Timeout) && token.Error() == nil {
+			slog.Info("Subscribed to MQTT command topics", "filter", filter, "keys", allowed)
+		} else {
+			slog.Error("Failed to subscribe to MQTT command topics", "filter", filter, "err", token.Error())
+		}
+	})
+	return c
+}
+
+// receive queues a command, the device is only ever sent one command at a time
+func (c *Commander) receive(client paho.Client, message paho.Message) {
+	elements := strings.Split(strings.TrimPrefix(message.Topic(), c.conn.opts.Prefix+"/"), "/")
+	if len(elements) != 4 {
+		return
+	}
+	command := Command{
+		Topic:  message.Topic(),
+		DistId: elements[0],
+		BoxId:  elements[1],
+		Key:    elements[3],
+		Value:  strings.TrimSpace(string(message.Payload())),
+	}
+	// A retained command is delivered again on every (re)connect, it must not be sent to the boxes each time
+	if message.Retained() {
+		slog.Warn("Rejected retained MQTT command", "topic", command.Topic)
+		c.publishResult(command, CommandResult{Status: "rejected", Error: "retained commands are not accepted"})
+		return
+	}
+	select {
+	case c.commands <- command:
+	default:
+		slog.Warn("MQTT command queue full, dropping command", "topic", command.Topic)
+		c.publishResult(command, CommandResult{Status: "error", Error: "command queue full"})
+	}
+}
+
+// Run sends the queued commands to the device until the context is canceled
+func (c *Commander) Run(ctx context.Context, wg *sync.WaitGroup) {
+	// Decrement WaitGroup when function exits
+	defer wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("MQTT commander shutting down.")
+			return
+		case command := <-c.commands:
+			c.publishResult(command, c.Handle(ctx, command))
+		}
+	}
+}
+
+// Handle validates a command and sends it to the device, waiting for the mesh to acknowledge it.
+// Commands for all boxes, or for a box whose node is not known yet, can only be reported as relayed.
+func (c *Commander) Handle(ctx context.Context, command Command) CommandResult {
+	if !contains(c.allowed, command.Key) {
+		slog.Warn("Rejected MQTT command for key not in allowlist", "key", command.Key, "topic", command.Topic)
+		return CommandResult{Status: "rejected", Error: "key not allowed"}
+	}
+	filter := []string{command.BoxId, command.DistId, "", ""}
+	for i, id := range filter {
+		if id == broadcast {
+			filter[i] = ""
+		}
+	}
+	control := meshtastic.BuildKiezboxControlMessage(command.Key, command.Value, filter)
+	if control == nil {
+		return CommandResult{Status: "rejected", Error: "invalid key, value or target"}
+	}
+
+	slog.Info("Sending control value from MQTT", "key", command.Key, "value", command.Value, "dist_id", command.DistId, "box_id", command.BoxId)
+	result, err := c.device.SendKiezboxControl(ctx, control)
+	if err != nil {
+		status := "error"
+		if errors.Is(err, meshtastic.ErrNotReady) {
+			status = "not_ready"
+		}
+		return CommandResult{Status: status, Error: err.Error()}
+	}
+	commandResult := CommandResult{Status: result.Status.String(), Result: result}
+	if result.Status == meshtastic.TxNak {
+		commandResult.Error = result.Error.String()
+	}
+	return commandResult
+}
+
+// publishResult records the outcome of a command in the audit log and sends it to <command topic>/result
+func (c *Commander) publishResult(command Command, result CommandResult) {
+	result.Key, result.Value, result.DistId, result.BoxId = command.Key, command.Value, command.DistId, command.BoxId
+	// The sender of an MQTT message is unknown, the broker is responsible for restricting the command topics
+	audit.Log(audit.Entry{
+		Who:     "mqtt",
+		Source:  command.Topic,
+		Action:  "control.set",
+		Target:  map[string]string{"dist_id": command.DistId, "box_id": command.BoxId},
+		Details: map[string]string{"key": command.Key, "value": command.Value},
+		Result:  result.Status,
+		Error:   result.Error,
+	})
+	payload, err := json.Marshal(result)
+	if err != nil {
+		slog.Error("Failed to marshal MQTT command result", "err", err)
+		return
+	}
+	c.conn.client.Publish(command.Topic+"/result", 1, false, payload)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
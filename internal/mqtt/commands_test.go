@@ -0,0 +1,126 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/meshtastic"
+)
+
+// fakeSender records the control messages and acknowledges them
+type fakeSender struct {
+	mutex    sync.Mutex
+	controls []*generated.KiezboxMessage_Control
+}
+
+func (f *fakeSender) SendKiezboxControl(ctx context.Context, control *generated.KiezboxMessage_Control) (*meshtastic.TxResult, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.controls = append(f.controls, control)
+	return &meshtastic.TxResult{PacketId: 42, Status: meshtastic.TxAcked, Attempts: 1}, nil
+}
+
+func (f *fakeSender) sent() []*generated.KiezboxMessage_Control {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]*generated.KiezboxMessage_Control{}, f.controls...)
+}
+
+func TestCommander(t *testing.T) {
+	server, url := startBroker(t)
+	r := subscribe(t, server)
+
+	conn, err := Connect(Options{Broker: url, ClientId: "gw-cmd", Timeout: time.Second})
+	require.NoError(t, err)
+	defer conn.Close()
+	sender := &fakeSender{}
+	commander := NewCommander(conn, sender, []string{"mode", "router_power"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go commander.Run(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	require.Eventually(t, conn.Connected, 5*time.Second, 10*time.Millisecond)
+
+	// Wait until the subscription is active, keys outside the allowlist never reach the device
+	require.Eventually(t, func() bool {
+		require.NoError(t, server.Publish("kiezbox/0/0/set/probe", []byte("1"), false, 1))
+		time.Sleep(20 * time.Millisecond)
+		return len(r.get("kiezbox/0/0/set/probe/result")) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	tests := []struct {
+		name           string
+		topic          string
+		payload        string
+		expectedStatus string
+	}{
+		{"Allowed key", "kiezbox/2/1/set/mode", "emergency", "acked"},
+		{"Key not in allowlist", "kiezbox/2/1/set/box_id", "7", "rejected"},
+		{"Invalid value", "kiezbox/2/1/set/router_power", "maybe", "rejected"},
+		{"Broadcast", "kiezbox/all/all/set/router_power", "false", "acked"},
+	}
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.NoError(t, server.Publish(testCase.topic, []byte(testCase.payload), false, 1))
+			require.Eventually(t, func() bool {
+				return len(r.get(testCase.topic+"/result")) > 0
+			}, 5*time.Second, 10*time.Millisecond)
+
+			var result CommandResult
+			require.NoError(t, json.Unmarshal([]byte(r.get(testCase.topic + "/result")[0]), &result))
+			assert.Equal(t, testCase.expectedStatus, result.Status)
+			assert.Equal(t, testCase.payload, result.Value)
+		})
+	}
+
+	controls := sender.sent()
+	require.Len(t, controls, 2)
+	assert.Equal(t, generated.KiezboxMessage_emergency, controls[0].GetMode())
+	assert.Equal(t, uint32(1), controls[0].GetMeta().GetBoxId())
+	assert.Equal(t, uint32(2), controls[0].GetMeta().GetDistId())
+	assert.False(t, controls[1].GetRouterPower())
+	assert.Nil(t, controls[1].GetMeta().BoxId)
+}
+
+func TestCommanderRetained(t *testing.T) {
+	server, url := startBroker(t)
+	r := subscribe(t, server)
+
+	// A command retained by the broker is delivered as soon as the gateway subscribes
+	require.NoError(t, server.Publish("kiezbox/2/1/set/mode", []byte("emergency"), true, 1))
+
+	conn, err := Connect(Options{Broker: url, ClientId: "gw-cmd", Timeout: time.Second})
+	require.NoError(t, err)
+	defer conn.Close()
+	sender := &fakeSender{}
+	commander := NewCommander(conn, sender, []string{"mode"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go commander.Run(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(r.get("kiezbox/2/1/set/mode/result")) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	var result CommandResult
+	require.NoError(t, json.Unmarshal([]byte(r.get("kiezbox/2/1/set/mode/result")[0]), &result))
+	assert.Equal(t, "rejected", result.Status)
+	assert.Empty(t, sender.sent())
+}
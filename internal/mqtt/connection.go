@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Connection is the connection to the broker, shared by the publisher and the command handler
+// The gateway announces itself as online/offline with a retained status message and LWT.
+type Connection struct {
+	client      paho.Client
+	opts        Options
+	statusTopic string
+
+	mutex     sync.Mutex
+	onConnect []func(paho.Client)
+}
+
+// Connect creates the connection and connects to the broker in the background
+// An unreachable broker is not an error, the client keeps retrying.
+func Connect(opts Options) (*Connection, error) {
+	if opts.Broker == "" {
+		return nil, fmt.Errorf("no MQTT broker configured")
+	}
+	if opts.ClientId == "" {
+		hostname, _ := os.Hostname()
+		opts.ClientId = "kiezbox-gateway-" + hostname
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "kiezbox"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	c := &Connection{
+		opts:        opts,
+		statusTopic: fmt.Sprintf("%s/gateway/%s/status", opts.Prefix, opts.ClientId),
+	}
+
+	clientOpts := paho.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientId).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5*time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(c.statusTopic, "offline", 1, true).
+		SetOnConnectHandler(c.connected).
+		SetConnectionLostHandler(func(client paho.Client, err error) {
+			slog.Warn("Lost connection to MQTT broker", "broker", opts.Broker, "err", err)
+		})
+	c.client = paho.NewClient(clientOpts)
+	c.client.Connect()
+	return c, nil
+}
+
+// connected announces the gateway and runs the OnConnect hooks after every (re)connect
+func (c *Connection) connected(client paho.Client) {
+	slog.Info("Connected to MQTT broker", "broker", c.opts.Broker)
+	client.Publish(c.statusTopic, 1, true, "online")
+	c.mutex.Lock()
+	hooks := append([]func(paho.Client){}, c.onConnect...)
+	c.mutex.Unlock()
+	for _, hook := range hooks {
+		hook(client)
+	}
+}
+
+// OnConnect registers fn to run after every (re)connect, e.g. to renew subscriptions
+// If the connection is already up, fn runs right away.
+func (c *Connection) OnConnect(fn func(paho.Client)) {
+	c.mutex.Lock()
+	c.onConnect = append(c.onConnect, fn)
+	c.mutex.Unlock()
+	if c.client.IsConnectionOpen() {
+		fn(c.client)
+	}
+}
+
+// Client returns the underlying MQTT client
+func (c *Connection) Client() paho.Client {
+	return c.client
+}
+
+// Connected tells whether the connection to the broker is up
+func (c *Connection) Connected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+// Topic builds a topic below the configured prefix
+func (c *Connection) Topic(elements ...any) string {
+	topic := c.opts.Prefix
+	for _, element := range elements {
+		topic += fmt.Sprintf("/%v", element)
+	}
+	return topic
+}
+
+// Close announces the gateway as offline and disconnects from the broker
+func (c *Connection) Close() error {
+	var err error
+	if c.client.IsConnectionOpen() {
+		token := c.client.Publish(c.statusTopic, 1, true, "offline")
+		if !token.WaitTimeout(c.opts.Timeout) {
+			err = errors.New("timeout while publishing offline status")
+		} else {
+			err = token.Error()
+		}
+	}
+	c.client.Disconnect(250)
+	return err
+}
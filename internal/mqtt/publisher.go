@@ -0,0 +1,193 @@
+// Package mqtt connects the gateway to a central MQTT broker
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	cfg "kiezbox/internal/config"
+	"kiezbox/internal/db"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/marshal"
+)
+
+// Options configures the connection to the broker
+type Options struct {
+	Broker   string
+	ClientId string
+	Username string
+	Password string
+	// First element of all topics
+	Prefix string
+	// Additionally publish the raw protobuf to <topic>/pb
+	Protobuf bool
+	// Time to wait for the broker to acknowledge a message
+	Timeout time.Duration
+}
+
+// OptionsFromConfig reads the MQTT options from the gateway config
+func OptionsFromConfig() Options {
+	return Options{
+		Broker:   cfg.Cfg.MqttBroker,
+		ClientId: cfg.Cfg.MqttClientId,
+		Username: cfg.Cfg.MqttUsername,
+		Password: cfg.Cfg.MqttPassword,
+		Prefix:   cfg.Cfg.MqttPrefix,
+		Protobuf: cfg.Cfg.MqttProtobuf,
+		Timeout:  cfg.Cfg.DbTimeout,
+	}
+}
+
+func init() {
+	db.RegisterSink("mqtt", func() (db.Sink, error) {
+		return NewPublisher(OptionsFromConfig())
+	})
+}
+
+// Publisher is a storage sink which publishes KiezboxMessages to an MQTT broker
+// Updates are published with QoS 1 and retained as last state of their topic.
+type Publisher struct {
+	conn *Connection
+
+	mutex sync.Mutex
+	// Unix time of the last retained message per topic, so replayed old points do not replace newer state
+	retained map[string]int64
+}
+
+// publication is a single MQTT message derived from a KiezboxMessage
+type publication struct {
+	topic     string
+	payload   proto.Message
+	timestamp int64
+	retain    bool
+}
+
+// NewPublisher connects to the broker and creates the publisher
+func NewPublisher(opts Options) (*Publisher, error) {
+	conn, err := Connect(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{conn: conn, retained: make(map[string]int64)}, nil
+}
+
+// Connection returns the connection to the broker, so it can be shared with the command handler
+func (p *Publisher) Connection() *Connection {
+	return p.conn
+}
+
+// publicationOf maps a KiezboxMessage to its topic: <prefix>/<dist>/<box>/core, <prefix>/<dist>/<box>/sensor/<sens>
+// or <prefix>/distress/<button> for emergency events, which are not retained.
+func (p *Publisher) publicationOf(message *generated.KiezboxMessage) (publication, error) {
+	if update := message.GetUpdate(); update != nil {
+		meta := update.GetMeta()
+		switch {
+		case update.GetCore() != nil:
+			return publication{p.conn.Topic(meta.GetDistId(), meta.GetBoxId(), "core"), update, update.GetUnixTime(), true}, nil
+		case update.GetSensor() != nil:
+			return publication{p.conn.Topic(meta.GetDistId(), meta.GetBoxId(), "sensor", meta.GetSensId()), update, update.GetUnixTime(), true}, nil
+		}
+		return publication{}, fmt.Errorf("update contains neither core nor sensor values")
+	}
+	if distress := message.GetDistress(); distress != nil {
+		return publication{p.conn.Topic("distress", distress.GetButtonId()), distress, distress.GetUnixTime(), false}, nil
+	}
+	return publication{}, fmt.Errorf("KiezboxMessage contains neither Update nor Distress")
+}
+
+// Write publishes a single KiezboxMessage
+func (p *Publisher) Write(ctx context.Context, message *generated.KiezboxMessage) error {
+	return p.WriteBatch(ctx, []*generated.KiezboxMessage{message})
+}
+
+// WriteBatch publishes several KiezboxMessages, messages which can not be mapped to a topic are skipped
+func (p *Publisher) WriteBatch(ctx context.Context, messages []*generated.KiezboxMessage) error {
+	start := time.Now()
+	err := p.writeBatch(ctx, messages)
+	db.ObserveWrite(start, err)
+	return err
+}
+
+func (p *Publisher) writeBatch(ctx context.Context, messages []*generated.KiezboxMessage) error {
+	if !p.conn.Connected() {
+		return db.ErrNoConnection
+	}
+	var tokens []paho.Token
+	for _, message := range messages {
+		pub, err := p.publicationOf(message)
+		if err != nil {
+			if len(messages) == 1 {
+				return err
+			}
+			slog.Error("Failed to map message to topic", "err", err)
+			continue
+		}
+		payload, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(pub.payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message to JSON: %w", err)
+		}
+		retain := pub.retain && p.newest(pub.topic, pub.timestamp)
+		tokens = append(tokens, p.conn.client.Publish(pub.topic, 1, retain, payload))
+		if p.conn.opts.Protobuf {
+			raw, err := marshal.MarshalKiezboxMessage(message)
+			if err != nil {
+				return fmt.Errorf("failed to marshal message: %w", err)
+			}
+			tokens = append(tokens, p.conn.client.Publish(pub.topic+"/pb", 1, retain, raw))
+		}
+	}
+	return p.wait(ctx, tokens)
+}
+
+// newest tells whether a message is the newest one for its topic and should be retained
+func (p *Publisher) newest(topic string, timestamp int64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if last, ok := p.retained[topic]; ok && last > timestamp {
+		return false
+	}
+	p.retained[topic] = timestamp
+	return true
+}
+
+// wait blocks until the broker acknowledged all messages
+// Any failure is reported as connection failure, so the messages stay cached.
+func (p *Publisher) wait(ctx context.Context, tokens []paho.Token) error {
+	timeout := time.NewTimer(p.conn.opts.Timeout)
+	defer timeout.Stop()
+	for _, token := range tokens {
+		select {
+		case <-token.Done():
+			if err := token.Error(); err != nil {
+				return fmt.Errorf("%w: %w", db.ErrNoConnection, err)
+			}
+		case <-timeout.C:
+			return fmt.Errorf("%w: broker did not acknowledge within %s", db.ErrNoConnection, p.conn.opts.Timeout)
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", db.ErrNoConnection, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Health checks whether the connection to the broker is up
+func (p *Publisher) Health(ctx context.Context) error {
+	if !p.conn.Connected() {
+		return fmt.Errorf("%w: not connected to MQTT broker %s", db.ErrNoConnection, p.conn.opts.Broker)
+	}
+	return nil
+}
+
+// Close announces the gateway as offline and disconnects from the broker
+func (p *Publisher) Close() error {
+	return p.conn.Close()
+}
+
+var _ db.Sink = (*Publisher)(nil)
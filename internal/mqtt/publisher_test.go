@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/db"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/testutils"
+)
+
+// startBroker runs an embedded MQTT broker and returns its URL
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	server := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(testWriter{t}, &slog.HandlerOptions{Level: slog.LevelWarn}))})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	listener := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	require.NoError(t, server.AddListener(listener))
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server, "tcp://" + listener.Address()
+}
+
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// received collects the messages published to the broker
+type received struct {
+	mutex    sync.Mutex
+	messages map[string][]string
+}
+
+func (r *received) get(topic string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.messages[topic]
+}
+
+func subscribe(t *testing.T, server *mochi.Server) *received {
+	r := &received{messages: make(map[string][]string)}
+	require.NoError(t, server.Subscribe("kiezbox/#", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.messages[pk.TopicName] = append(r.messages[pk.TopicName], string(pk.Payload))
+	}))
+	return r
+}
+
+func retainedPayload(server *mochi.Server, topic string) string {
+	for _, pk := range server.Topics.Messages(topic) {
+		return string(pk.Payload)
+	}
+	return ""
+}
+
+func TestPublisher(t *testing.T) {
+	server, url := startBroker(t)
+	r := subscribe(t, server)
+
+	publisher, err := NewPublisher(Options{Broker: url, ClientId: "gw1", Protobuf: true, Timeout: time.Second})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return publisher.Health(context.Background()) == nil }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return retainedPayload(server, "kiezbox/gateway/gw1/status") == "online" }, 5*time.Second, 10*time.Millisecond)
+
+	newer := testutils.CreateKiezboxMessage(1672531300)
+	newer.Update.ArrivalTime = proto.Int64(1672531300)
+	older := testutils.CreateKiezboxMessage(1672531200)
+	older.Update.ArrivalTime = proto.Int64(1672531200)
+	require.NoError(t, publisher.Write(context.Background(), newer))
+	// A replayed older point is published but does not replace the retained state
+	require.NoError(t, publisher.WriteBatch(context.Background(), []*generated.KiezboxMessage{older, testutils.CreateDistressMessage(1672531250)}))
+
+	require.Eventually(t, func() bool { return len(r.get("kiezbox/2/1/core")) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, r.get("kiezbox/2/1/core")[0], `"unix_time":"1672531300"`)
+	assert.Contains(t, retainedPayload(server, "kiezbox/2/1/core"), `"unix_time":"1672531300"`)
+	assert.Len(t, r.get("kiezbox/2/1/core/pb"), 2)
+	require.Eventually(t, func() bool { return len(r.get("kiezbox/distress/3")) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, r.get("kiezbox/distress/3")[0], `"smoke in the staircase"`)
+	assert.Empty(t, retainedPayload(server, "kiezbox/distress/3"))
+
+	require.NoError(t, publisher.Close())
+	assert.Equal(t, "offline", retainedPayload(server, "kiezbox/gateway/gw1/status"))
+}
+
+func TestPublisherOffline(t *testing.T) {
+	// Nothing listens on this port, so the message has to be cached
+	publisher, err := NewPublisher(Options{Broker: "tcp://127.0.0.1:1", ClientId: "gw2", Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	assert.True(t, errors.Is(publisher.Health(context.Background()), db.ErrNoConnection))
+	message := testutils.CreateKiezboxMessage(1672531200)
+	message.Update.ArrivalTime = proto.Int64(1672531200)
+	assert.True(t, errors.Is(publisher.Write(context.Background(), message), db.ErrNoConnection))
+}
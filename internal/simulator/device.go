@@ -0,0 +1,520 @@
+// Package simulator provides a simulated meshtastic device running the kiezbox firmware,
+// so the gateway can be developed and tested without hardware
+package simulator
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/meshtastic"
+)
+
+// Config configures the simulated device
+type Config struct {
+	// Node number of the simulated device
+	NodeNum uint32
+	// Interval of the synthetic core and sensor updates, 0 disables them
+	UpdateInterval time.Duration
+	// Interval of the synthetic distress events, 0 disables them
+	DistressInterval time.Duration
+	// Initial kiezbox control state of the device
+	Control *generated.ModuleConfig_KiezboxControlConfig
+}
+
+// DefaultConfig returns the configuration used by kb-sim
+func DefaultConfig() Config {
+	return Config{
+		NodeNum:          0x1234abcd,
+		UpdateInterval:   30 * time.Second,
+		DistressInterval: 0,
+		Control: &generated.ModuleConfig_KiezboxControlConfig{
+			Enabled:        true,
+			StatusInterval: 30,
+			BoxId:          1,
+			DistId:         1,
+			Mode:           generated.KiezboxMessage_normal,
+			DevType:        generated.KiezboxMessage_core,
+		},
+	}
+}
+
+// Device is a simulated meshtastic device
+// It answers the config handshake and KIEZBOXCONTROL_CONFIG admin requests,
+// applies control messages to its own state and emits synthetic updates and distress events
+type Device struct {
+	config Config
+
+	mutex      sync.Mutex
+	control    *generated.ModuleConfig_KiezboxControlConfig
+	timeOffset time.Duration
+	booted     time.Time
+	// Stream to the gateway currently attached to the device
+	stream    io.Writer
+	writeLock sync.Mutex
+}
+
+// New creates a simulated device
+func New(config Config) *Device {
+	control := config.Control
+	if control == nil {
+		control = DefaultConfig().Control
+	}
+	return &Device{
+		config:  config,
+		control: proto.Clone(control).(*generated.ModuleConfig_KiezboxControlConfig),
+		booted:  time.Now(),
+	}
+}
+
+// Control returns a copy of the current kiezbox control state of the device
+func (d *Device) Control() *generated.ModuleConfig_KiezboxControlConfig {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return proto.Clone(d.control).(*generated.ModuleConfig_KiezboxControlConfig)
+}
+
+// Port attaches a new in-memory stream to the device and returns the gateway side of it
+// It can be returned from a meshtastic.PortFactory in place of a serial port
+func (d *Device) Port(ctx context.Context) meshtastic.SerialPort {
+	gateway, device := net.Pipe()
+	go func() {
+		if err := d.Serve(ctx, device); err != nil {
+			slog.Info("Simulated device stream closed", "err", err)
+		}
+	}()
+	return gateway
+}
+
+// Serve runs the device on a stream (e.g. a TCP connection) until the stream is closed or the context is done
+func (d *Device) Serve(ctx context.Context, stream io.ReadWriteCloser) error {
+	d.mutex.Lock()
+	d.stream = stream
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		if d.stream == stream {
+			d.stream = nil
+		}
+		d.mutex.Unlock()
+	}()
+
+	// Unblock the frame reader when the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(stream)
+	for {
+		payload, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		var toRadio generated.ToRadio
+		if err := proto.Unmarshal(payload, &toRadio); err != nil {
+			slog.Error("Simulator failed to unmarshal ToRadio", "err", err)
+			continue
+		}
+		if err := d.handle(&toRadio); err != nil {
+			return err
+		}
+	}
+}
+
+// Run emits the scheduled synthetic updates and distress events until the context is done
+func (d *Device) Run(ctx context.Context) {
+	updates := newTicker(d.config.UpdateInterval)
+	defer updates.Stop()
+	distress := newTicker(d.config.DistressInterval)
+	defer distress.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates.C:
+			d.EmitUpdates()
+		case <-distress.C:
+			d.EmitDistress(generated.KiezboxMessage_EmergencyType(rand.Intn(len(generated.KiezboxMessage_EmergencyType_name))), "simulated emergency")
+		}
+	}
+}
+
+// newTicker returns a ticker which never fires for a zero interval
+func newTicker(interval time.Duration) *time.Ticker {
+	if interval <= 0 {
+		ticker := time.NewTicker(time.Hour)
+		ticker.Stop()
+		return ticker
+	}
+	return time.NewTicker(interval)
+}
+
+// now returns the device clock, which can be set by unix_time control messages
+func (d *Device) now() time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return time.Now().Add(d.timeOffset)
+}
+
+// meta returns the meta information the device puts into its updates
+func (d *Device) meta() *generated.KiezboxMessage_Meta {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return &generated.KiezboxMessage_Meta{
+		BoxId:   proto.Uint32(uint32(d.control.BoxId)),
+		DistId:  proto.Uint32(uint32(d.control.DistId)),
+		SensId:  proto.Uint32(uint32(d.control.SensId)),
+		DevType: d.control.DevType.Enum(),
+	}
+}
+
+// EmitUpdates sends one synthetic core and one synthetic sensor update
+func (d *Device) EmitUpdates() {
+	// Values are transmitted in thousandths
+	jitter := func(base int32, spread int32) *int32 {
+		return proto.Int32(base + rand.Int31n(2*spread+1) - spread)
+	}
+	d.mutex.Lock()
+	mode := d.control.Mode
+	routerPower := d.control.RouterPower
+	d.mutex.Unlock()
+
+	d.sendKiezbox(&generated.KiezboxMessage{
+		Update: &generated.KiezboxMessage_Update{
+			Meta:     d.meta(),
+			UnixTime: d.now().Unix(),
+			Core: &generated.KiezboxMessage_Core{
+				Mode:   mode,
+				Router: &generated.KiezboxMessage_Router{Powered: routerPower},
+				Values: &generated.KiezboxMessage_CoreValues{
+					TempOut:        jitter(18000, 3000),
+					TempIn:         jitter(24000, 2000),
+					HumidIn:        jitter(45000, 5000),
+					SolarVoltage:   jitter(19000, 1000),
+					BatteryVoltage: jitter(12800, 300),
+				},
+			},
+		},
+	})
+	d.sendKiezbox(&generated.KiezboxMessage{
+		Update: &generated.KiezboxMessage_Update{
+			Meta:     d.meta(),
+			UnixTime: d.now().Unix(),
+			Sensor: &generated.KiezboxMessage_Sensor{
+				Values: &generated.KiezboxMessage_SensorValues{
+					TempMain:  jitter(18000, 3000),
+					HumidMain: jitter(60000, 10000),
+					Pressure:  jitter(1013000, 5000),
+				},
+			},
+		},
+	})
+}
+
+// EmitDistress sends a distress event as if an emergency button was pressed
+func (d *Device) EmitDistress(emergencyType generated.KiezboxMessage_EmergencyType, message string) {
+	d.mutex.Lock()
+	buttonId := d.control.ButtonId
+	d.mutex.Unlock()
+	d.sendKiezbox(&generated.KiezboxMessage{
+		Distress: &generated.KiezboxMessage_Emergency{
+			Type:     emergencyType,
+			ButtonId: buttonId,
+			UnixTime: d.now().Unix(),
+			Message:  proto.String(message),
+		},
+	})
+}
+
+// handle reacts to a single ToRadio message from the gateway
+func (d *Device) handle(toRadio *generated.ToRadio) error {
+	switch v := toRadio.PayloadVariant.(type) {
+	case *generated.ToRadio_WantConfigId:
+		return d.sendConfig(v.WantConfigId)
+	case *generated.ToRadio_Heartbeat:
+		return nil
+	case *generated.ToRadio_Packet:
+		decoded := v.Packet.GetDecoded()
+		if decoded == nil {
+			return nil
+		}
+		switch decoded.GetPortnum() {
+		case generated.PortNum_ADMIN_APP:
+			return d.handleAdmin(v.Packet)
+		case generated.PortNum_KIEZBOX_CONTROL_APP:
+			return d.handleControl(v.Packet)
+		}
+	}
+	return nil
+}
+
+// sendConfig streams the node database and configuration, like the firmware does after want_config
+func (d *Device) sendConfig(configId uint32) error {
+	if err := d.logf("INFO", "SerialConsole", "Client wants config, nonce=%d", configId); err != nil {
+		return err
+	}
+	control := d.Control()
+	messages := []*generated.FromRadio{
+		{PayloadVariant: &generated.FromRadio_MyInfo{MyInfo: &generated.MyNodeInfo{MyNodeNum: d.config.NodeNum}}},
+		{PayloadVariant: &generated.FromRadio_NodeInfo{NodeInfo: &generated.NodeInfo{
+			Num: d.config.NodeNum,
+			User: &generated.User{
+				Id:        fmt.Sprintf("!%08x", d.config.NodeNum),
+				LongName:  fmt.Sprintf("Kiezbox Simulator %d", control.BoxId),
+				ShortName: "KSIM",
+				HwModel:   generated.HardwareModel_PORTDUINO,
+			},
+			LastHeard: uint32(d.now().Unix()),
+		}}},
+		{PayloadVariant: &generated.FromRadio_Metadata{Metadata: &generated.DeviceMetadata{
+			FirmwareVersion: "kiezbox-simulator",
+			HwModel:         generated.HardwareModel_PORTDUINO,
+		}}},
+		{PayloadVariant: &generated.FromRadio_Channel{Channel: &generated.Channel{
+			Index: 0,
+			Role:  generated.Channel_PRIMARY,
+		}}},
+		{PayloadVariant: &generated.FromRadio_ModuleConfig{ModuleConfig: &generated.ModuleConfig{
+			PayloadVariant: &generated.ModuleConfig_KiezboxControl{KiezboxControl: control},
+		}}},
+		{PayloadVariant: &generated.FromRadio_ConfigCompleteId{ConfigCompleteId: configId}},
+	}
+	for _, message := range messages {
+		if err := d.send(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleAdmin answers KIEZBOXCONTROL_CONFIG requests with the current control state
+func (d *Device) handleAdmin(packet *generated.MeshPacket) error {
+	var admin generated.AdminMessage
+	if err := proto.Unmarshal(packet.GetDecoded().GetPayload(), &admin); err != nil {
+		return d.sendRouting(packet.GetId(), generated.Routing_BAD_REQUEST)
+	}
+	if admin.GetGetModuleConfigRequest() != generated.AdminMessage_KIEZBOXCONTROL_CONFIG {
+		return d.sendRouting(packet.GetId(), generated.Routing_BAD_REQUEST)
+	}
+	response, err := proto.Marshal(&generated.AdminMessage{
+		PayloadVariant: &generated.AdminMessage_GetModuleConfigResponse{
+			GetModuleConfigResponse: &generated.ModuleConfig{
+				PayloadVariant: &generated.ModuleConfig_KiezboxControl{KiezboxControl: d.Control()},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return d.sendPacket(&generated.Data{
+		Portnum:   generated.PortNum_ADMIN_APP,
+		Payload:   response,
+		RequestId: packet.GetId(),
+	})
+}
+
+// handleControl applies a control message to the device state if it is addressed to this device
+func (d *Device) handleControl(packet *generated.MeshPacket) error {
+	var message generated.KiezboxMessage
+	if err := proto.Unmarshal(packet.GetDecoded().GetPayload(), &message); err != nil || message.Control == nil {
+		if packet.GetWantAck() {
+			return d.sendRouting(packet.GetId(), generated.Routing_BAD_REQUEST)
+		}
+		return nil
+	}
+	if d.addressed(message.Control.GetMeta()) {
+		d.apply(message.Control)
+	}
+	if packet.GetWantAck() {
+		return d.sendRouting(packet.GetId(), generated.Routing_NONE)
+	}
+	return nil
+}
+
+// addressed reports whether the filter in a control message matches this device
+// A control message without meta, like the time set by the gateway, addresses all devices.
+func (d *Device) addressed(meta *generated.KiezboxMessage_Meta) bool {
+	if meta == nil {
+		return true
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if meta.BoxId != nil && meta.GetBoxId() != uint32(d.control.BoxId) {
+		return false
+	}
+	if meta.DistId != nil && meta.GetDistId() != uint32(d.control.DistId) {
+		return false
+	}
+	if meta.SensId != nil && meta.GetSensId() != uint32(d.control.SensId) {
+		return false
+	}
+	if meta.DevType != nil && meta.GetDevType() != d.control.DevType {
+		return false
+	}
+	return true
+}
+
+// apply sets the control value on the device state
+func (d *Device) apply(control *generated.KiezboxMessage_Control) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	switch v := control.Set.(type) {
+	case *generated.KiezboxMessage_Control_Mode:
+		d.control.Mode = v.Mode
+	case *generated.KiezboxMessage_Control_UnixTime:
+		d.timeOffset = time.Until(time.Unix(v.UnixTime, 0))
+	case *generated.KiezboxMessage_Control_RouterPower:
+		d.control.RouterPower = v.RouterPower
+	case *generated.KiezboxMessage_Control_BoxId:
+		d.control.BoxId = int32(v.BoxId)
+	case *generated.KiezboxMessage_Control_DistId:
+		d.control.DistId = int32(v.DistId)
+	case *generated.KiezboxMessage_Control_SensId:
+		d.control.SensId = int32(v.SensId)
+	case *generated.KiezboxMessage_Control_StatusInterval:
+		d.control.StatusInterval = v.StatusInterval
+	case *generated.KiezboxMessage_Control_SdsWarmupTime:
+		d.control.SdsWarmupTime = v.SdsWarmupTime
+	case *generated.KiezboxMessage_Control_Enabled:
+		d.control.Enabled = v.Enabled
+	case *generated.KiezboxMessage_Control_DevType:
+		d.control.DevType = v.DevType
+	case *generated.KiezboxMessage_Control_ButtonId:
+		d.control.ButtonId = v.ButtonId
+	}
+	slog.Info("Simulator applied control value", "control", control)
+}
+
+// sendKiezbox sends a KiezboxMessage from the device to the gateway
+func (d *Device) sendKiezbox(message *generated.KiezboxMessage) {
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		slog.Error("Simulator failed to marshal KiezboxMessage", "err", err)
+		return
+	}
+	err = d.sendPacket(&generated.Data{
+		Portnum: generated.PortNum_KIEZBOX_CONTROL_APP,
+		Payload: payload,
+	})
+	if err != nil {
+		slog.Warn("Simulator failed to send KiezboxMessage", "err", err)
+	}
+}
+
+// sendRouting acknowledges a packet, or rejects it with the given error
+func (d *Device) sendRouting(requestId uint32, reason generated.Routing_Error) error {
+	payload, err := proto.Marshal(&generated.Routing{
+		Variant: &generated.Routing_ErrorReason{ErrorReason: reason},
+	})
+	if err != nil {
+		return err
+	}
+	return d.sendPacket(&generated.Data{
+		Portnum:   generated.PortNum_ROUTING_APP,
+		Payload:   payload,
+		RequestId: requestId,
+	})
+}
+
+// sendPacket wraps a Data message into a MeshPacket from this device and sends it
+func (d *Device) sendPacket(data *generated.Data) error {
+	return d.send(&generated.FromRadio{
+		PayloadVariant: &generated.FromRadio_Packet{
+			Packet: &generated.MeshPacket{
+				From:   d.config.NodeNum,
+				To:     d.config.NodeNum,
+				Id:     rand.Uint32(),
+				RxTime: uint32(d.now().Unix()),
+				PayloadVariant: &generated.MeshPacket_Decoded{
+					Decoded: data,
+				},
+			},
+		},
+	})
+}
+
+// ErrNotAttached is returned when the device should send, but no gateway is attached
+var ErrNotAttached = errors.New("no gateway attached to the simulated device")
+
+// send frames a FromRadio message and writes it to the attached stream
+func (d *Device) send(fromRadio *generated.FromRadio) error {
+	d.mutex.Lock()
+	stream := d.stream
+	d.mutex.Unlock()
+	if stream == nil {
+		return ErrNotAttached
+	}
+	payload, err := proto.Marshal(fromRadio)
+	if err != nil {
+		return err
+	}
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	_, err = stream.Write(meshtastic.EncodeFrame(payload))
+	return err
+}
+
+// logf prints a line of the text log between the frames, formatted like the firmware does
+func (d *Device) logf(level string, thread string, format string, args ...any) error {
+	d.mutex.Lock()
+	stream := d.stream
+	d.mutex.Unlock()
+	if stream == nil {
+		return ErrNotAttached
+	}
+	clock := d.now().UTC().Format("15:04:05")
+	uptime := int(time.Since(d.booted).Seconds())
+	line := fmt.Sprintf("%-5s | %s %d [%s] %s\r\n", level, clock, uptime, thread, fmt.Sprintf(format, args...))
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	_, err := io.WriteString(stream, line)
+	return err
+}
+
+// readFrame reads the next framed protobuf from the stream, skipping anything between frames
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0x94 {
+			continue
+		}
+		b, err = reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xC3 {
+			reader.UnreadByte()
+			continue
+		}
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+}
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+// Emergency is a distress event received from an emergency button
+type Emergency struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	ButtonId    int32  `json:"button_id"`
+	UnixTime    int64  `json:"unix_time"`
+	Message     string `json:"message,omitempty"`
+	ArrivalTime int64  `json:"arrival_time"`
+	AckTime     int64  `json:"ack_time,omitempty"`
+}
+
+// maxEmergencies bounds the open emergencies, the oldest one is dropped when a new one exceeds it
+const maxEmergencies = 100
+
+// emergencyKey identifies a distress event, retransmissions of an event have the same key
+type emergencyKey struct {
+	buttonId int32
+	unixTime int64
+}
+
+func (e Emergency) key() emergencyKey {
+	return emergencyKey{buttonId: e.ButtonId, unixTime: e.UnixTime}
+}
+
+// AddEmergency safely adds a distress event to the list of open emergencies and returns the stored entry
+// A retransmission of an open or recently acknowledged event (same button id and unix time) is not added again,
+// the existing entry is returned with false then. Events without time can not be told apart and are always added.
+func AddEmergency(distress *generated.KiezboxMessage_Emergency) (Emergency, bool) {
+	emergency := Emergency{
+		ID:          uuid.New().String(),
+		Type:        distress.GetType().String(),
+		ButtonId:    distress.GetButtonId(),
+		UnixTime:    distress.GetUnixTime(),
+		Message:     distress.GetMessage(),
+		ArrivalTime: time.Now().Unix(),
+	}
+	State.mutex.Lock()
+	defer State.mutex.Unlock()
+	if emergency.UnixTime != 0 {
+		for _, open := range State.emergencies {
+			if open.key() == emergency.key() {
+				return open, false
+			}
+		}
+		for _, acked := range State.acked {
+			if acked.key() == emergency.key() {
+				return acked, false
+			}
+		}
+	}
+	if len(State.emergencies) >= maxEmergencies {
+		dropped := State.emergencies[0]
+		slog.Warn("Too many open emergencies, dropping the oldest", "id", dropped.ID, "type", dropped.Type, "button_id", dropped.ButtonId)
+		State.emergencies = State.emergencies[1:]
+	}
+	State.emergencies = append(State.emergencies, emergency)
+	return emergency, true
+}
+
+// GetEmergencies safely returns a copy of all open (not yet acknowledged) emergencies
+func GetEmergencies() []Emergency {
+	State.mutex.RLock()
+	defer State.mutex.RUnlock()
+	emergencies := make([]Emergency, len(State.emergencies))
+	copy(emergencies, State.emergencies)
+	return emergencies
+}
+
+// AckEmergency safely removes the emergency with the given id from the open emergencies
+// It returns the acknowledged emergency and false if no open emergency with this id exists
+func AckEmergency(id string) (Emergency, bool) {
+	State.mutex.Lock()
+	defer State.mutex.Unlock()
+	for i, emergency := range State.emergencies {
+		if emergency.ID == id {
+			emergency.AckTime = time.Now().Unix()
+			State.emergencies = append(State.emergencies[:i], State.emergencies[i+1:]...)
+			// Remember the event, so a late retransmission does not open it again
+			State.acked = append(State.acked, emergency)
+			if len(State.acked) > maxEmergencies {
+				State.acked = State.acked[1:]
+			}
+			return emergency, true
+		}
+	}
+	return Emergency{}, false
+}
@@ -0,0 +1,92 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+)
+
+func resetEmergencies() {
+	State.mutex.Lock()
+	defer State.mutex.Unlock()
+	State.emergencies = nil
+	State.acked = nil
+}
+
+func distress(buttonId int32, unixTime int64) *generated.KiezboxMessage_Emergency {
+	return &generated.KiezboxMessage_Emergency{
+		Type:     generated.KiezboxMessage_fire,
+		ButtonId: buttonId,
+		UnixTime: unixTime,
+		Message:  proto.String("smoke in the staircase"),
+	}
+}
+
+func TestAddEmergency(t *testing.T) {
+	resetEmergencies()
+	defer resetEmergencies()
+
+	first, added := AddEmergency(distress(3, 1700000000))
+	require.True(t, added)
+	assert.NotEmpty(t, first.ID)
+	assert.Equal(t, "fire", first.Type)
+	assert.Equal(t, int32(3), first.ButtonId)
+	assert.Equal(t, "smoke in the staircase", first.Message)
+	assert.NotZero(t, first.ArrivalTime)
+
+	// A retransmission returns the open emergency
+	retransmitted, added := AddEmergency(distress(3, 1700000000))
+	assert.False(t, added)
+	assert.Equal(t, first.ID, retransmitted.ID)
+
+	// Other buttons, other times and events without time are new emergencies
+	_, added = AddEmergency(distress(4, 1700000000))
+	assert.True(t, added)
+	_, added = AddEmergency(distress(3, 1700000060))
+	assert.True(t, added)
+	_, added = AddEmergency(distress(3, 0))
+	assert.True(t, added)
+	_, added = AddEmergency(distress(3, 0))
+	assert.True(t, added)
+	assert.Len(t, GetEmergencies(), 5)
+}
+
+func TestAddEmergencyBounded(t *testing.T) {
+	resetEmergencies()
+	defer resetEmergencies()
+
+	for i := 0; i < maxEmergencies+10; i++ {
+		AddEmergency(distress(1, int64(1700000000+i)))
+	}
+	emergencies := GetEmergencies()
+	require.Len(t, emergencies, maxEmergencies)
+	// The oldest ones are dropped
+	assert.Equal(t, int64(1700000010), emergencies[0].UnixTime)
+}
+
+func TestAckEmergency(t *testing.T) {
+	resetEmergencies()
+	defer resetEmergencies()
+
+	emergency, _ := AddEmergency(distress(3, 1700000000))
+	other, _ := AddEmergency(distress(4, 1700000000))
+
+	acked, ok := AckEmergency(emergency.ID)
+	require.True(t, ok)
+	assert.Equal(t, emergency.ID, acked.ID)
+	assert.NotZero(t, acked.AckTime)
+	assert.Equal(t, []Emergency{other}, GetEmergencies())
+
+	_, ok = AckEmergency(emergency.ID)
+	assert.False(t, ok)
+
+	// A late retransmission does not open the acknowledged emergency again
+	retransmitted, added := AddEmergency(distress(3, 1700000000))
+	assert.False(t, added)
+	assert.Equal(t, emergency.ID, retransmitted.ID)
+	assert.Len(t, GetEmergencies(), 1)
+}
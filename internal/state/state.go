@@ -6,8 +6,10 @@ import (
 )
 
 type GatewayState struct {
-	mutex sync.RWMutex
-	mode  generated.KiezboxMessage_Mode
+	mutex       sync.RWMutex
+	mode        generated.KiezboxMessage_Mode
+	emergencies []Emergency
+	acked       []Emergency // recently acknowledged emergencies, to ignore retransmissions
 }
 
 // Global gateway service config
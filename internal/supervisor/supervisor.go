@@ -0,0 +1,194 @@
+// Package supervisor runs the gateway routines as named workers, restarts them when they exit
+// or panic and reports their status
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"kiezbox/internal/metrics"
+)
+
+// Worker states
+const (
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateCompleted  = "completed"
+	StateStopped    = "stopped"
+)
+
+// Backoff between restarts, doubled after every restart until the maximum
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+var (
+	workerRestarts = metrics.Factory.NewCounterVec(prometheus.CounterOpts{Name: "kiezbox_worker_restarts_total", Help: "Restarts of gateway workers after they exited or panicked"}, []string{"worker"})
+	workerUp       = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{Name: "kiezbox_worker_up", Help: "Whether a gateway worker is running (1) or not (0)"}, []string{"worker"})
+)
+
+// RunFunc is the signature of the gateway routines, which call wg.Done when they return
+type RunFunc func(ctx context.Context, wg *sync.WaitGroup)
+
+// WorkerStatus is a snapshot of the state of a worker
+type WorkerStatus struct {
+	Name          string     `json:"name"`
+	State         string     `json:"state"`
+	Critical      bool       `json:"critical"`
+	Since         time.Time  `json:"since"`
+	Restarts      int        `json:"restarts"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+type worker struct {
+	status WorkerStatus
+	// One-shot workers complete when they return without panicking
+	once bool
+}
+
+// Supervisor keeps track of all workers, each running in its own goroutine
+type Supervisor struct {
+	wg         *sync.WaitGroup
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mutex   sync.Mutex
+	workers []*worker
+}
+
+// New creates a supervisor which adds every worker to wg until it finally stopped
+func New(wg *sync.WaitGroup) *Supervisor {
+	return &Supervisor{wg: wg, minBackoff: defaultMinBackoff, maxBackoff: defaultMaxBackoff}
+}
+
+// Go starts a long running worker, which is restarted whenever it returns or panics before ctx is canceled.
+// The gateway is unhealthy while a critical worker is not running.
+func (s *Supervisor) Go(ctx context.Context, name string, critical bool, run RunFunc) {
+	s.start(ctx, name, critical, false, run)
+}
+
+// Once starts a worker which only runs until it returns, it is restarted only if it panics
+func (s *Supervisor) Once(ctx context.Context, name string, run RunFunc) {
+	s.start(ctx, name, false, true, run)
+}
+
+func (s *Supervisor) start(ctx context.Context, name string, critical bool, once bool, run RunFunc) {
+	w := &worker{status: WorkerStatus{Name: name, Critical: critical}, once: once}
+	s.mutex.Lock()
+	s.workers = append(s.workers, w)
+	s.mutex.Unlock()
+	s.setState(w, StateRunning)
+
+	s.wg.Add(1)
+	go s.supervise(ctx, w, run)
+}
+
+// supervise runs the worker and restarts it with an increasing backoff until ctx is canceled
+func (s *Supervisor) supervise(ctx context.Context, w *worker, run RunFunc) {
+	defer s.wg.Done()
+
+	backoff := s.minBackoff
+	for {
+		started := time.Now()
+		err := runProtected(ctx, run)
+		if ctx.Err() != nil {
+			s.setState(w, StateStopped)
+			return
+		}
+		if err == nil && w.once {
+			s.setState(w, StateCompleted)
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("worker returned unexpectedly")
+		}
+		// A worker which ran for a while before failing starts over with the minimum backoff
+		if time.Since(started) > s.maxBackoff {
+			backoff = s.minBackoff
+		}
+		slog.Error("Worker failed, restarting", "worker", w.status.Name, "backoff", backoff, "err", err)
+		s.failed(w, err)
+		workerRestarts.WithLabelValues(w.status.Name).Inc()
+
+		select {
+		case <-ctx.Done():
+			s.setState(w, StateStopped)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.maxBackoff)
+		s.mutex.Lock()
+		w.status.Restarts++
+		s.mutex.Unlock()
+		s.setState(w, StateRunning)
+	}
+}
+
+// runProtected runs a worker with its own WaitGroup and turns a panic into an error
+func runProtected(ctx context.Context, run RunFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Worker panicked", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	run(ctx, &wg)
+	return nil
+}
+
+func (s *Supervisor) setState(w *worker, state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w.status.State = state
+	w.status.Since = time.Now()
+	up := 0.0
+	if state == StateRunning {
+		up = 1
+	}
+	workerUp.WithLabelValues(w.status.Name).Set(up)
+}
+
+func (s *Supervisor) failed(w *worker, err error) {
+	s.mutex.Lock()
+	now := time.Now()
+	w.status.LastError = err.Error()
+	w.status.LastErrorTime = &now
+	s.mutex.Unlock()
+	s.setState(w, StateRestarting)
+}
+
+// Status returns the status of all workers sorted by name
+func (s *Supervisor) Status() []WorkerStatus {
+	if s == nil {
+		return []WorkerStatus{}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := make([]WorkerStatus, 0, len(s.workers))
+	for _, w := range s.workers {
+		status = append(status, w.status)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// Healthy reports whether all critical workers are running
+func (s *Supervisor) Healthy() bool {
+	for _, status := range s.Status() {
+		if status.Critical && status.State != StateRunning {
+			return false
+		}
+	}
+	return true
+}
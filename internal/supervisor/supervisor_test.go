@@ -0,0 +1,108 @@
+package supervisor
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func statusOf(t *testing.T, s *Supervisor, name string) WorkerStatus {
+	for _, status := range s.Status() {
+		if status.Name == name {
+			return status
+		}
+	}
+	t.Fatalf("worker %s not found", name)
+	return WorkerStatus{}
+}
+
+// Worker which runs until the context is canceled
+func blocking(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	<-ctx.Done()
+}
+
+func TestSupervisor(t *testing.T) {
+	var wg sync.WaitGroup
+	s := New(&wg)
+	s.minBackoff, s.maxBackoff = 10*time.Millisecond, 40*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Panics twice, then keeps running
+	var panics atomic.Int32
+	s.Go(ctx, "reader", true, func(ctx context.Context, wg *sync.WaitGroup) {
+		defer wg.Done()
+		if panics.Add(1) <= 2 {
+			panic("serial port exploded")
+		}
+		<-ctx.Done()
+	})
+	// Fails until it is released
+	release := make(chan struct{})
+	s.Go(ctx, "writer", true, func(ctx context.Context, wg *sync.WaitGroup) {
+		defer wg.Done()
+		select {
+		case <-release:
+			<-ctx.Done()
+		default:
+		}
+	})
+	s.Go(ctx, "heartbeat", false, blocking)
+	var runs atomic.Int32
+	s.Once(ctx, "settime", func(ctx context.Context, wg *sync.WaitGroup) {
+		defer wg.Done()
+		runs.Add(1)
+	})
+
+	require.Eventually(t, func() bool {
+		status := statusOf(t, s, "reader")
+		return status.State == StateRunning && status.Restarts == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "panic: serial port exploded", statusOf(t, s, "reader").LastError)
+	assert.NotNil(t, statusOf(t, s, "reader").LastErrorTime)
+
+	// The writer keeps failing, so the gateway is not healthy
+	require.Eventually(t, func() bool { return statusOf(t, s, "writer").Restarts >= 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, "worker returned unexpectedly", statusOf(t, s, "writer").LastError)
+	assert.False(t, s.Healthy())
+	close(release)
+	require.Eventually(t, s.Healthy, time.Second, time.Millisecond)
+
+	// One-shot workers complete without restarts
+	assert.Equal(t, StateCompleted, statusOf(t, s, "settime").State)
+	assert.Equal(t, int32(1), runs.Load())
+	assert.Equal(t, StateRunning, statusOf(t, s, "heartbeat").State)
+	assert.Equal(t, []string{"heartbeat", "reader", "settime", "writer"}, func() []string {
+		var names []string
+		for _, status := range s.Status() {
+			names = append(names, status.Name)
+		}
+		return names
+	}())
+
+	// All workers stop with the context and release the WaitGroup
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Workers did not stop after the context was canceled")
+	}
+	assert.Equal(t, StateStopped, statusOf(t, s, "reader").State)
+	assert.Equal(t, StateCompleted, statusOf(t, s, "settime").State)
+}
+
+func TestNilSupervisor(t *testing.T) {
+	var s *Supervisor
+	assert.Empty(t, s.Status())
+	assert.True(t, s.Healthy())
+}
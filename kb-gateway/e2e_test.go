@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tarm/serial"
+
+	"kiezbox/api/handlers"
+	"kiezbox/api/routes"
+	"kiezbox/api/server"
+	cfg "kiezbox/internal/config"
+	"kiezbox/internal/db"
+	"kiezbox/internal/github.com/meshtastic/go/generated"
+	"kiezbox/internal/meshtastic"
+	"kiezbox/internal/simulator"
+	"kiezbox/internal/state"
+)
+
+// Fake InfluxDB, which answers pings and hands every written line to the test
+func fakeInfluxDB(t *testing.T) (*httptest.Server, chan string) {
+	lines := make(chan string, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/api/v2/write":
+			body, _ := io.ReadAll(r.Body)
+			for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+				lines <- line
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, lines
+}
+
+// Wait until a line of the given measurement was written to the database
+func awaitMeasurement(t *testing.T, lines chan string, measurement string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if strings.HasPrefix(line, measurement+",") {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("No %s written to the database", measurement)
+		}
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	cfg.LoadConfigNoFail()
+	cfg.Cfg.TxTimeout = 500 * time.Millisecond
+	cfg.Cfg.TxRetries = 1
+	cfg.Cfg.CacheDir = t.TempDir()
+	cfg.Cfg.DbTimeout = time.Second
+
+	// Start without emergencies left over from other tests
+	for _, emergency := range state.GetEmergencies() {
+		state.AckEmergency(emergency.ID)
+	}
+
+	influx, lines := fakeInfluxDB(t)
+	cfg.Cfg.DbUrl = influx.URL
+	db_client := db.CreateClient()
+	defer db_client.Close()
+	cache, err := db.OpenCache(cfg.Cfg.CacheDir, db.CacheOptions{SegmentSize: cfg.Cfg.CacheSegment})
+	if err != nil {
+		t.Fatalf("Failed to open cache: %v", err)
+	}
+	defer cache.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	simConfig := simulator.DefaultConfig()
+	simConfig.UpdateInterval = 0
+	device := simulator.New(simConfig)
+
+	var mts meshtastic.MTSerial
+	mts.Init(func(*serial.Config) (meshtastic.SerialPort, error) {
+		return device.Port(ctx), nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(6)
+	go mts.Writer(ctx, &wg)
+	go mts.Reader(ctx, &wg)
+	go mts.MessageHandler(ctx, &wg)
+	go mts.ConfigWriter(ctx, &wg, mts.SubscribeConfigWriter())
+	go mts.DBWriter(ctx, context.Background(), &wg, mts.SubscribeDBWriter(), db_client, cache)
+	go mts.GetConfig(ctx, &wg, 50*time.Millisecond)
+
+	// Config handshake
+	readyCtx, readyCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer readyCancel()
+	require.NoError(t, mts.WaitReady(readyCtx))
+
+	// The mode is polled from the device by GetConfig and stored by the ConfigWriter
+	assert.Eventually(t, func() bool {
+		return state.GetMode() == int(generated.KiezboxMessage_normal)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Updates and distress events end up in the database
+	device.EmitUpdates()
+	device.EmitDistress(generated.KiezboxMessage_fire, "smoke in the staircase")
+	assert.Contains(t, awaitMeasurement(t, lines, "core_values"), "box_id=1")
+	assert.Contains(t, awaitMeasurement(t, lines, "sensor_values"), "dist_id=1")
+	assert.Contains(t, awaitMeasurement(t, lines, "distress_events"), "type=fire")
+
+	// API
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	routes.RegisterGroups(r, server.Groups, &mts, db_client, cache, nil)
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/emergencies", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var emergencies struct {
+		Emergencies []state.Emergency `json:"emergencies"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &emergencies))
+	require.Len(t, emergencies.Emergencies, 1)
+	assert.Equal(t, "fire", emergencies.Emergencies[0].Type)
+
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/nodes", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Kiezbox Simulator 1")
+
+	// Nothing was cached while the database was reachable
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cache", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var cacheStatus db.CacheStatus
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &cacheStatus))
+	assert.Equal(t, 0, cacheStatus.Pending)
+
+	// The text log printed by the device between the frames
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/device/logs?level=info&q=wants+config", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var deviceLogs struct {
+		Records []meshtastic.DeviceLogRecord `json:"records"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &deviceLogs))
+	require.NotEmpty(t, deviceLogs.Records)
+	assert.Equal(t, "INFO", deviceLogs.Records[0].Level)
+	assert.Equal(t, "SerialConsole", deviceLogs.Records[0].Module)
+	assert.Contains(t, deviceLogs.Records[0].Message, "Client wants config, nonce=")
+
+	// Without a supervisor there are no workers which could be down
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, recorder.Body.String())
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health/workers", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"status": "ok", "workers": []}`, recorder.Body.String())
+
+	// Prometheus exporter
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `kiezbox_update_timestamp_seconds{box_id="1",dist_id="1",module="core",sens_id="0"}`)
+	assert.Contains(t, recorder.Body.String(), "kiezbox_frames_read_total ")
+	assert.Contains(t, recorder.Body.String(), `kiezbox_db_write_duration_seconds_count`)
+
+	form := url.Values{"key": {"mode"}, "value": {"emergency"}}
+	request := httptest.NewRequest(http.MethodPost, "/admin/control", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	// Without a target the control message is broadcast, so its ACK only means it was relayed
+	assert.Equal(t, http.StatusAccepted, recorder.Code, recorder.Body.String())
+	assert.Contains(t, recorder.Body.String(), `"status":"relayed"`)
+	assert.Equal(t, generated.KiezboxMessage_emergency, device.Control().Mode)
+	assert.Eventually(t, func() bool {
+		return state.GetMode() == int(generated.KiezboxMessage_emergency)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A batch is only sent when every setting is valid
+	body := `{"target": {"box_id": 1, "dist_id": "1", "dev_type": "core"}, "settings": [{"key": "status_interval", "value": 45}, {"key": "mode", "value": "panic"}]}`
+	request = httptest.NewRequest(http.MethodPost, "/admin/control", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+	assert.Contains(t, recorder.Body.String(), `"status":"invalid"`)
+	assert.NotEqual(t, int32(45), device.Control().StatusInterval)
+
+	body = `{"target": {"box_id": 1, "dist_id": "1", "dev_type": "core"}, "settings": [{"key": "status_interval", "value": 45}, {"key": "router_power", "value": false}, {"key": "mode", "value": "normal"}]}`
+	request = httptest.NewRequest(http.MethodPost, "/admin/control", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var batch struct {
+		Results []handlers.ControlSettingResult `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Len(t, batch.Results, 3)
+	// Box 1 is known from its updates, so it is addressed directly and acknowledges the settings itself
+	for _, result := range batch.Results {
+		assert.Equal(t, meshtastic.TxAcked.String(), result.Status, result.Key)
+	}
+	assert.Equal(t, int32(45), device.Control().StatusInterval)
+	assert.False(t, device.Control().RouterPower)
+	assert.Equal(t, generated.KiezboxMessage_normal, device.Control().Mode)
+
+	// Shut everything down
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Goroutines did not stop after the context was canceled")
+	}
+}
@@ -2,70 +2,122 @@ package main
 
 import (
 	"context"
+	"kiezbox/api/auth"
 	"kiezbox/api/routes"
+	"kiezbox/api/server"
 
+	"kiezbox/internal/audit"
 	cfg "kiezbox/internal/config"
 	"kiezbox/internal/db"
 	"kiezbox/internal/github.com/meshtastic/go/generated"
 	"kiezbox/internal/meshtastic"
+	"kiezbox/internal/metrics"
+	"kiezbox/internal/mqtt"
+	"kiezbox/internal/supervisor"
 	"kiezbox/logging"
 	"log/slog"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // RunGoroutines orchestrates the goroutines that run the service.
-func RunGoroutines(ctx context.Context, wg *sync.WaitGroup, device meshtastic.MeshtasticDevice, db_client *db.InfluxDB) {
-	// Launch goroutines
-	//TODO: refactor this function, as it is a little clumsy with all the manual waitgroup stuff
-	wg.Add(1)
-	go device.Writer(ctx, wg)
-	wg.Add(1)
-	go device.Heartbeat(ctx, wg, 30*time.Second)
-	wg.Add(1)
-	go device.Reader(ctx, wg)
-	wg.Add(1)
-	go device.MessageHandler(ctx, wg)
-	wg.Add(1)
-	go device.GetConfig(ctx, wg, 15*time.Second)
-	wg.Add(1)
-	go device.ConfigWriter(ctx, wg)
+// Every routine runs as a supervised worker, which is restarted when it panics or exits before ctx is canceled.
+// drain bounds how long the DBWriter writes its queue to the sink after ctx is canceled, the rest is cached.
+func RunGoroutines(ctx context.Context, drain context.Context, wg *sync.WaitGroup, device meshtastic.MeshtasticDevice, sink db.Sink, cache *db.Cache, listeners []server.Listener) {
+	workers := supervisor.New(wg)
+
+	// The gateway is unhealthy without the routines exchanging messages with the device
+	workers.Go(ctx, "writer", true, device.Writer)
+	workers.Go(ctx, "reader", true, device.Reader)
+	workers.Go(ctx, "message_handler", true, device.MessageHandler)
+	workers.Go(ctx, "heartbeat", false, func(ctx context.Context, wg *sync.WaitGroup) {
+		device.Heartbeat(ctx, wg, 30*time.Second)
+	})
+	workers.Go(ctx, "get_config", false, func(ctx context.Context, wg *sync.WaitGroup) {
+		device.GetConfig(ctx, wg, 15*time.Second)
+	})
+	// Subscriptions are created up front, so messages published before a worker runs or while it restarts are kept
+	configs := device.SubscribeConfigWriter()
+	workers.Go(ctx, "config_writer", false, func(ctx context.Context, wg *sync.WaitGroup) {
+		device.ConfigWriter(ctx, wg, configs)
+	})
 
 	if cfg.Cfg.SetTime {
-		// We wait for the not info to set the time
-		wg.Add(1)
+		// SetKiezboxControlValue waits for the device to be ready to set the time
 		now := time.Now().Unix()
 		message := &generated.KiezboxMessage_Control{
 			Set: &generated.KiezboxMessage_Control_UnixTime{
 				UnixTime: now,
 			},
 		}
-		go device.SetKiezboxControlValue(ctx, wg, message)
+		workers.Once(ctx, "settime", func(ctx context.Context, wg *sync.WaitGroup) {
+			device.SetKiezboxControlValue(ctx, wg, message)
+		})
 	}
 
-	// Process incoming KiezBox messages in its own goroutine
+	// Process incoming KiezBox messages
 	if cfg.Cfg.DbWriter {
-		wg.Add(1)
-		go device.DBWriter(ctx, wg, db_client)
-		// } else {
-		// 	mts.WaitInfo.Wait()
+		messages := device.SubscribeDBWriter()
+		workers.Go(ctx, "dbwriter", true, func(ctx context.Context, wg *sync.WaitGroup) {
+			device.DBWriter(ctx, drain, wg, messages, sink, cache)
+		})
 	}
 
-	// Start the retry mechanism in its own goroutine
+	// Start the retry mechanism
 	if cfg.Cfg.DbRetry {
-		wg.Add(1)
-		go device.DBRetry(ctx, wg, db_client)
+		workers.Go(ctx, "dbretry", false, func(ctx context.Context, wg *sync.WaitGroup) {
+			device.DBRetry(ctx, wg, sink, cache)
+		})
+	}
+
+	// Forward control values from the MQTT command topics
+	if cfg.Cfg.MqttCommands {
+		startMQTTCommander(ctx, workers, device, sink)
 	}
 
-	// Start the API in its own goroutine
-	wg.Add(1)
-	// Create a new Gin router
-	r := gin.Default()
-	// Register API routes
-	routes.RegisterRoutes(r, device, ctx, wg)
-	go device.APIHandler(ctx, wg, r)
+	// Start every API listener as its own worker, serving only its route groups
+	for _, listener := range listeners {
+		listener := listener
+		// Create a new Gin router
+		r := gin.Default()
+		// Register API routes
+		routes.RegisterGroups(r, listener.Groups, device, sink, cache, workers)
+		workers.Go(ctx, "api "+listener.Address, false, func(ctx context.Context, wg *sync.WaitGroup) {
+			// Decrement WaitGroup when function exits
+			defer wg.Done()
+
+			// Serve the API until the context is canceled
+			if err := server.Run(ctx, listener, r); err != nil {
+				slog.Error("Failed to run API server", "listener", listener.String(), "err", err)
+			}
+		})
+	}
+}
+
+// startMQTTCommander subscribes to the MQTT command topics, sharing the connection of the mqtt sink if it is used
+func startMQTTCommander(ctx context.Context, workers *supervisor.Supervisor, device meshtastic.MeshtasticDevice, sink db.Sink) {
+	var conn *mqtt.Connection
+	if publisher, ok := sink.(*mqtt.Publisher); ok {
+		conn = publisher.Connection()
+	} else {
+		var err error
+		conn, err = mqtt.Connect(mqtt.OptionsFromConfig())
+		if err != nil {
+			slog.Error("Failed to set up MQTT commands", "err", err)
+			return
+		}
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+	}
+	commander := mqtt.NewCommander(conn, device, cfg.Cfg.MqttCmdKeys)
+	workers.Go(ctx, "mqtt_commander", false, commander.Run)
 }
 
 func main() {
@@ -82,24 +134,107 @@ func main() {
 	slog.Info("Logger initialized", "app", "kiezbox-gateway-service")
 	slog.Debug("Service configuration", "cfg", cfg.Cfg)
 
-	// Initialize meshtastic serial connection
+	// Initialize meshtastic connection over the configured transport
+	portFactory, err := meshtastic.NewPortFactory(cfg.Cfg.Transport)
+	if err != nil {
+		slog.Error("Invalid transport configuration", "transport", cfg.Cfg.Transport, "err", err)
+		os.Exit(1)
+	}
 	var mts meshtastic.MTSerial
-	mts.Init(meshtastic.CreateSerialPort)
+	mts.Init(portFactory)
+	if err := mts.RegisterMetrics(metrics.Registry); err != nil {
+		slog.Error("Failed to register queue metrics", "err", err)
+	}
 
-	// Initialize InfluxDB client
-	db_client := db.CreateClient()
-	defer db_client.Close()
+	// Initialize the storage sink (InfluxDB or the embedded store)
+	sink, err := db.OpenSink()
+	if err != nil {
+		slog.Error("Failed to open storage sink", "sink", cfg.Cfg.Sink, "err", err)
+		os.Exit(1)
+	}
 
-	// Create a context with cancel
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Open the offline cache for datapoints which could not be written to the database
+	cache, err := db.OpenCache(cfg.Cfg.CacheDir, db.CacheOptions{
+		MaxSize:     cfg.Cfg.CacheMaxSize,
+		MaxAge:      cfg.Cfg.CacheMaxAge,
+		SegmentSize: cfg.Cfg.CacheSegment,
+	})
+	if err != nil {
+		slog.Error("Failed to open datapoint cache", "dir", cfg.Cfg.CacheDir, "err", err)
+		os.Exit(1)
+	}
+	if err := cache.RegisterMetrics(metrics.Registry); err != nil {
+		slog.Error("Failed to register cache metrics", "err", err)
+	}
+
+	// Authenticate API clients and record all admin actions
+	auth.Default, err = auth.FromConfig()
+	if err != nil {
+		slog.Error("Invalid API authentication configuration", "err", err)
+		os.Exit(1)
+	}
+	if auth.Default == nil {
+		slog.Warn("API authentication is disabled, the viewer, operator and admin routes are open to everyone on the gateway itself")
+	}
+
+	// Addresses and route groups of the API
+	listeners, err := server.ListenersFromConfig(auth.Default != nil)
+	if err != nil {
+		slog.Error("Invalid API listener configuration", "err", err)
+		os.Exit(1)
+	}
+
+	audit.Default, err = audit.Open(cfg.Cfg.AuditLog)
+	if err != nil {
+		slog.Error("Failed to open audit log", "file", cfg.Cfg.AuditLog, "err", err)
+		os.Exit(1)
+	}
+	defer audit.Default.Close()
+
+	// Create a context which is canceled by SIGINT and SIGTERM (sent by procd)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// Create a WaitGroup to wait for the goroutines
 	var wg sync.WaitGroup
 
-	// Run the goroutines
-	RunGoroutines(ctx, &wg, &mts, db_client)
+	// Canceled during the shutdown, when the DBWriter has to stop writing to the sink
+	drain, stopDrain := context.WithCancel(context.Background())
+	defer stopDrain()
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+	// Run the goroutines
+	RunGoroutines(ctx, drain, &wg, &mts, sink, cache, listeners)
+
+	<-ctx.Done()
+	// A second signal terminates immediately
+	stop()
+	slog.Info("Shutting down", "timeout", cfg.Cfg.StopTimeout)
+	// Everything has to finish by the deadline. The sink gets the first three quarters of the time,
+	// the rest is left to cache the datapoints it did not take.
+	deadline := time.Now().Add(cfg.Cfg.StopTimeout)
+	drainTimer := time.AfterFunc(cfg.Cfg.StopTimeout*3/4, stopDrain)
+	defer drainTimer.Stop()
+	// End the live event streams, so the API listeners only wait for regular requests
+	mts.CloseEvents()
+
+	// Wait for all goroutines to drain their queues and finish, but not past the deadline
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		// The storage is left open, routines still using it must not fail on a closed cache or sink
+		slog.Warn("Shutdown timeout reached, exiting with routines still running")
+		return
+	}
+	if err := cache.Close(); err != nil {
+		slog.Error("Failed to close datapoint cache", "err", err)
+	}
+	if err := sink.Close(); err != nil {
+		slog.Error("Failed to close storage sink", "err", err)
+	}
+	slog.Info("Shutdown complete")
 }
@@ -6,10 +6,10 @@ import (
 	"testing"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/mock"
 	"github.com/tarm/serial"
 
+	"kiezbox/api/server"
 	cfg "kiezbox/internal/config"
 	"kiezbox/internal/db"
 	"kiezbox/internal/github.com/meshtastic/go/generated"
@@ -56,12 +56,17 @@ func (m *MockMTSerial) MessageHandler(ctx context.Context, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
-func (m *MockMTSerial) DBWriter(ctx context.Context, wg *sync.WaitGroup, db_client *db.InfluxDB) {
+func (m *MockMTSerial) SubscribeDBWriter() *meshtastic.Subscription {
+	m.Called()
+	return nil
+}
+
+func (m *MockMTSerial) DBWriter(ctx context.Context, drain context.Context, wg *sync.WaitGroup, subscription *meshtastic.Subscription, sink db.Sink, cache *db.Cache) {
 	m.Called(ctx, wg)
 	wg.Done()
 }
 
-func (m *MockMTSerial) DBRetry(ctx context.Context, wg *sync.WaitGroup, db_client *db.InfluxDB) {
+func (m *MockMTSerial) DBRetry(ctx context.Context, wg *sync.WaitGroup, sink db.Sink, cache *db.Cache) {
 	m.Called(ctx, wg)
 	wg.Done()
 }
@@ -76,12 +81,12 @@ func (m *MockMTSerial) GetConfig(ctx context.Context, wg *sync.WaitGroup, durati
 	wg.Done()
 }
 
-func (m *MockMTSerial) ConfigWriter(ctx context.Context, wg *sync.WaitGroup) {
-	m.Called(ctx, wg)
-	wg.Done()
+func (m *MockMTSerial) SubscribeConfigWriter() *meshtastic.Subscription {
+	m.Called()
+	return nil
 }
 
-func (m *MockMTSerial) APIHandler(ctx context.Context, wg *sync.WaitGroup, r *gin.Engine) {
+func (m *MockMTSerial) ConfigWriter(ctx context.Context, wg *sync.WaitGroup, subscription *meshtastic.Subscription) {
 	m.Called(ctx, wg)
 	wg.Done()
 }
@@ -104,7 +109,8 @@ func TestRunGoroutines(t *testing.T) {
 	mockMTSerial.On("SetKiezboxControlValue", mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	mockMTSerial.On("GetConfig", mock.Anything, mock.Anything, time.Duration(15*time.Second)).Return(nil)
 	mockMTSerial.On("ConfigWriter", mock.Anything, mock.Anything).Return(nil)
-	mockMTSerial.On("APIHandler", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockMTSerial.On("SubscribeDBWriter").Return(nil)
+	mockMTSerial.On("SubscribeConfigWriter").Return(nil)
 
 	portFactory := func(conf *serial.Config) (meshtastic.SerialPort, error) {
 		return mockMTSerial, nil
@@ -123,12 +129,17 @@ func TestRunGoroutines(t *testing.T) {
 	var wg sync.WaitGroup
 
 	// Run the function under test
-	RunGoroutines(ctx, &wg, mockMTSerial, db_client)
+	// The API is served by its own worker, on a free port so the test does not collide with a running gateway
+	listeners := []server.Listener{{Address: "localhost:0", Groups: server.Groups}}
+	RunGoroutines(ctx, context.Background(), &wg, mockMTSerial, db_client, nil, listeners)
 
 	// Cancel the context after a small interval
 	time.Sleep(time.Millisecond * 1)
 	cancel()
 
+	// Wait for all goroutines to finish, every supervised worker runs at least once
+	wg.Wait()
+
 	// Assertions to check if the expected functions were called
 	mockMTSerial.AssertCalled(t, "Writer")
 	mockMTSerial.AssertCalled(t, "Heartbeat", mock.Anything, mock.Anything, time.Duration(30*time.Second))
@@ -139,8 +150,6 @@ func TestRunGoroutines(t *testing.T) {
 	mockMTSerial.AssertCalled(t, "SetKiezboxControlValue", mock.Anything, mock.Anything, mock.Anything)
 	mockMTSerial.AssertCalled(t, "GetConfig", mock.Anything, mock.Anything, time.Duration(15*time.Second))
 	mockMTSerial.AssertCalled(t, "ConfigWriter", mock.Anything, mock.Anything)
-	mockMTSerial.AssertCalled(t, "APIHandler", mock.Anything, mock.Anything, mock.Anything)
-
-	// Wait for all goroutines to finish
-	wg.Wait()
+	mockMTSerial.AssertCalled(t, "SubscribeDBWriter")
+	mockMTSerial.AssertCalled(t, "SubscribeConfigWriter")
 }
@@ -0,0 +1,182 @@
+// kb-inspect decodes the protobufs of the gateway into prototext or JSON, including the Data.Payload of packets by portnum.
+// Each argument is a cache directory, a capture file, a legacy .pb cache file, a file with a raw framed stream,
+// or a hex or base64 string like the `ToRadio Marshalled` log. Without arguments a raw stream is read from stdin.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiezbox/internal/capture"
+	"kiezbox/internal/inspect"
+)
+
+// Kinds of input, auto detects them from the argument
+var inputs = []string{"auto", "cache", "capture", "pb", "stream", "hex", "base64"}
+
+func main() {
+	in := flag.String("in", "auto", "Kind of the arguments: "+strings.Join(inputs, ", "))
+	messageType := flag.String("type", "", "Message type of streams, .pb files and hex or base64 strings: "+strings.Join(inspect.MessageTypes(), ", ")+" (default fromradio, kiezbox for .pb files)")
+	format := flag.String("format", inspect.FormatText, "Output format, text (prototext) or json (one object per line)")
+	measurement := flag.String("measurement", "", "Only show KiezboxMessages of this measurement: core_values, sensor_values or distress_events")
+	boxId := flag.Int("box_id", -1, "Only show KiezboxMessages of this box id (-1 for all)")
+	start := flag.String("start", "", "Only show messages recorded at or after this time, RFC3339, unix seconds or relative like -24h")
+	stop := flag.String("stop", "", "Only show messages recorded before this time, RFC3339, unix seconds or relative like -1h")
+	flag.Parse()
+
+	// Logs go to stderr, so they do not mix with the decoded messages
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	filter := inspect.Filter{Measurement: *measurement}
+	if *boxId >= 0 {
+		id := uint32(*boxId)
+		filter.BoxId = &id
+	}
+	var err error
+	now := time.Now()
+	if filter.Start, err = parseTime(*start, now); err != nil {
+		fail(2, "Invalid start time", err)
+	}
+	if filter.Stop, err = parseTime(*stop, now); err != nil {
+		fail(2, "Invalid stop time", err)
+	}
+	printer, err := inspect.NewPrinter(os.Stdout, *format)
+	if err != nil {
+		fail(2, "Invalid format", err)
+	}
+	show := func(item inspect.Item) error {
+		if !filter.Match(item) {
+			return nil
+		}
+		return printer.Print(item)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+	for _, arg := range args {
+		if err := inspectArg(arg, *in, *messageType, show); err != nil {
+			fail(1, "Failed to inspect", err, "arg", arg)
+		}
+	}
+}
+
+func fail(code int, msg string, err error, args ...any) {
+	slog.Error(msg, append([]any{"err", err}, args...)...)
+	os.Exit(code)
+}
+
+// inspectArg decodes a single argument as the given kind of input
+func inspectArg(arg string, in string, messageType string, show func(inspect.Item) error) error {
+	if in == "auto" {
+		in = detectInput(arg)
+	}
+	if messageType == "" {
+		messageType = "fromradio"
+		if in == "pb" {
+			messageType = "kiezbox"
+		}
+	}
+	switch in {
+	case "cache":
+		return inspect.ScanCache(arg, show)
+	case "capture", "stream":
+		var r io.Reader = os.Stdin
+		if arg != "-" {
+			file, err := os.Open(arg)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+		if in == "capture" {
+			return inspect.ScanCapture(r, arg, show)
+		}
+		return inspect.ScanStream(r, arg, messageType, show)
+	case "pb":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return err
+		}
+		return printMessage(data, arg, messageType, show)
+	case "hex", "base64":
+		data, err := inspect.ParseBytes(arg, in)
+		if err != nil {
+			return err
+		}
+		return printMessage(data, "arg", messageType, show)
+	case "bytes":
+		data, err := inspect.ParseBytes(arg, "")
+		if err != nil {
+			return fmt.Errorf("no such file and %w", err)
+		}
+		return printMessage(data, "arg", messageType, show)
+	}
+	return fmt.Errorf("unknown input %q, expected one of %s", in, strings.Join(inputs, ", "))
+}
+
+func printMessage(data []byte, source string, messageType string, show func(inspect.Item) error) error {
+	item, err := inspect.ReadMessage(data, source, messageType)
+	if err != nil {
+		return err
+	}
+	return show(item)
+}
+
+// detectInput guesses the kind of input: directories are caches, files are told apart by their magic bytes
+// and extension, anything else is decoded as hex or base64
+func detectInput(arg string) string {
+	if arg == "-" {
+		return "stream"
+	}
+	info, err := os.Stat(arg)
+	if err != nil {
+		return "bytes"
+	}
+	if info.IsDir() {
+		return "cache"
+	}
+	if strings.HasSuffix(arg, ".pb") {
+		return "pb"
+	}
+	if file, err := os.Open(arg); err == nil {
+		defer file.Close()
+		magic := make([]byte, len(capture.Magic))
+		if _, err := io.ReadFull(file, magic); err == nil && bytes.Equal(magic, []byte(capture.Magic)) {
+			return "capture"
+		}
+	}
+	return "stream"
+}
+
+// parseTime accepts RFC3339, unix seconds or a negative duration relative to now, an empty value gives the zero time
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasPrefix(value, "-") {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(duration), nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("expected RFC3339, unix seconds or a duration like -24h")
+	}
+	return t, nil
+}
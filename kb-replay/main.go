@@ -0,0 +1,117 @@
+// kb-replay serves a capture recorded with the gateway's `-capture_file` option over the meshtastic stream API on TCP,
+// so a field issue can be reproduced by running the gateway with `-transport tcp://localhost:4403` against it.
+// Every connection gets the data the device sent, from the start of the capture. What the gateway writes is discarded.
+// Afterwards the connection stays open, like the one to an idle device, until the gateway disconnects.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kiezbox/internal/capture"
+	"kiezbox/logging"
+)
+
+func main() {
+	var options capture.ReplayOptions
+	file := flag.String("file", "", "Capture file to replay")
+	listen := flag.String("listen", "localhost:4403", "Address to serve the meshtastic stream API on")
+	flag.Float64Var(&options.Speed, "speed", 1, "Replay speed, 1 keeps the original timing, 10 is ten times faster and 0 as fast as possible")
+	flag.DurationVar(&options.MaxGap, "max_gap", 0, "Maximum time to wait between two records, e.g. to skip restarts of the gateway (0 for no limit)")
+	flag.Parse()
+
+	logging.InitLogger(logging.LoggerConfig{
+		Level:     slog.LevelInfo,
+		Format:    "text",
+		AddSource: true,
+		ShortPath: true,
+	})
+
+	if *file == "" {
+		slog.Error("No capture file given, use -file")
+		os.Exit(2)
+	}
+	// Fail early on files which are not captures
+	if err := checkCapture(*file); err != nil {
+		slog.Error("Failed to open capture", "file", *file, "err", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		slog.Error("Failed to listen", "address", *listen, "err", err)
+		os.Exit(1)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	slog.Info("Replaying capture", "address", listener.Addr(), "file", *file, "speed", options.Speed)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				slog.Info("Replay stopped")
+				return
+			}
+			slog.Error("Failed to accept connection", "err", err)
+			continue
+		}
+		slog.Info("Gateway connected", "remote", conn.RemoteAddr())
+		go func() {
+			replayed, err := serve(ctx, conn, *file, options)
+			slog.Info("Gateway disconnected", "remote", conn.RemoteAddr(), "records", replayed, "err", err)
+		}()
+	}
+}
+
+// checkCapture opens the capture file once to validate its magic bytes
+func checkCapture(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = capture.NewReader(file)
+	return err
+}
+
+// serve replays the capture to a single connection and keeps it open until the gateway disconnects
+func serve(ctx context.Context, conn net.Conn, path string, options capture.ReplayOptions) (int, error) {
+	defer conn.Close()
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader, err := capture.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The gateway closing the connection stops the replay
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+	replayed, err := capture.Replay(ctx, reader, conn, options)
+	if err != nil {
+		return replayed, err
+	}
+	slog.Info("Capture replayed, waiting for the gateway to disconnect", "remote", conn.RemoteAddr(), "records", replayed)
+	<-ctx.Done()
+	return replayed, nil
+}
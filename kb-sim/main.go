@@ -0,0 +1,73 @@
+// kb-sim runs a simulated kiezbox meshtastic device, which serves the meshtastic stream API over TCP.
+// Run the gateway against it with `-transport tcp://localhost:4403`.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kiezbox/internal/simulator"
+	"kiezbox/logging"
+)
+
+func main() {
+	config := simulator.DefaultConfig()
+	listen := flag.String("listen", "localhost:4403", "Address to serve the meshtastic stream API on")
+	nodeNum := flag.Uint("node", uint(config.NodeNum), "Node number of the simulated device")
+	boxId := flag.Int("box_id", int(config.Control.BoxId), "Initial box id of the simulated kiezbox")
+	distId := flag.Int("dist_id", int(config.Control.DistId), "Initial district id of the simulated kiezbox")
+	flag.DurationVar(&config.UpdateInterval, "update_interval", config.UpdateInterval, "Interval of the synthetic core and sensor updates (0 disables them)")
+	flag.DurationVar(&config.DistressInterval, "distress_interval", config.DistressInterval, "Interval of the synthetic distress events (0 disables them)")
+	flag.Parse()
+
+	config.NodeNum = uint32(*nodeNum)
+	config.Control.BoxId = int32(*boxId)
+	config.Control.DistId = int32(*distId)
+
+	logging.InitLogger(logging.LoggerConfig{
+		Level:     slog.LevelInfo,
+		Format:    "text",
+		AddSource: true,
+		ShortPath: true,
+	})
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		slog.Error("Failed to listen", "address", *listen, "err", err)
+		os.Exit(1)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	slog.Info("Simulated device listening", "address", listener.Addr(), "node", config.NodeNum)
+
+	device := simulator.New(config)
+	go device.Run(ctx)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				slog.Info("Simulator stopped")
+				return
+			}
+			slog.Error("Failed to accept connection", "err", err)
+			continue
+		}
+		slog.Info("Gateway connected", "remote", conn.RemoteAddr())
+		go func() {
+			err := device.Serve(ctx, conn)
+			slog.Info("Gateway disconnected", "remote", conn.RemoteAddr(), "err", err)
+		}()
+	}
+}
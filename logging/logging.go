@@ -37,8 +37,9 @@ func InitLogger(cfg LoggerConfig) {
 		replace := func(groups []string, a slog.Attr) slog.Attr {
 			// Remove the directory from the source's filename.
 			if a.Key == slog.SourceKey {
-				source := a.Value.Any().(*slog.Source)
-				source.File = filepath.Base(source.File)
+				if source, ok := a.Value.Any().(*slog.Source); ok {
+					source.File = filepath.Base(source.File)
+				}
 			}
 			return a
 		}
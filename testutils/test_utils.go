@@ -34,6 +34,18 @@ func CreateKiezboxMessage(timestamp int64) *generated.KiezboxMessage {
 	}
 }
 
+// Create a KiezboxMessage containing an emergency button event
+func CreateDistressMessage(timestamp int64) *generated.KiezboxMessage {
+	return &generated.KiezboxMessage{
+		Distress: &generated.KiezboxMessage_Emergency{
+			Type:     generated.KiezboxMessage_fire,
+			ButtonId: 3,
+			UnixTime: timestamp,
+			Message:  proto.String("smoke in the staircase"),
+		},
+	}
+}
+
 // Create a file with a marshaled KiezboxMessage
 func CreateKiezboxMessageFile(dir string) {
 	// Create the message